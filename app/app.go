@@ -7,9 +7,15 @@ import (
 	"log/slog"
 	"net/netip"
 	"path"
+	"slices"
+	"strings"
+	"time"
 
+	"github.com/bepass-org/warp-plus/app/readiness"
+	"github.com/bepass-org/warp-plus/proxy/pkg/mixed"
 	"github.com/bepass-org/warp-plus/psiphon"
 	"github.com/bepass-org/warp-plus/warp"
+	"github.com/bepass-org/warp-plus/wireguard/tun/netstack"
 	"github.com/bepass-org/warp-plus/wiresocks"
 	"github.com/go-ini/ini"
 )
@@ -25,12 +31,83 @@ type WarpOptions struct {
 	Gool     bool
 	Scan     *wiresocks.ScanOptions
 	CacheDir string
+	// Fallbacks are tried in order after the other scanned endpoints when
+	// the tunnel does not work through Endpoint, gool does not use them
+	Fallbacks []string
+	// Listeners are inbound proxy addresses served next to Bind
+	Listeners []wiresocks.ProxyListener
+	// Credentials maps proxy user names to passwords, empty means no authentication
+	Credentials map[string]string
+	// AllowClients and DenyClients restrict the source networks of proxy clients
+	AllowClients []netip.Prefix
+	DenyClients  []netip.Prefix
+	// MaxClientConns caps concurrent proxy connections per client address
+	MaxClientConns int
+	// MaxConns caps concurrent proxy connections of all clients together
+	MaxConns int
+	// HandshakeTimeout drops proxy clients that stay silent after connecting,
+	// zero uses mixed.DefaultHandshakeTimeout
+	HandshakeTimeout time.Duration
+	// ProxyProtocol lists the load balancers that send a PROXY protocol
+	// header before the proxy request
+	ProxyProtocol []netip.Prefix
+	// PACBypass lists domains and networks the served PAC file sends directly
+	PACBypass []string
+	// TLS additionally accepts TLS wrapped proxy clients when set
+	TLS *TLSOptions
+	// Shadowsocks starts a Shadowsocks inbound next to the proxy when set
+	Shadowsocks *ShadowsocksOptions
+	// Forwards are static port forwards through the tunnel
+	Forwards []wiresocks.Forward
+	// DownPolicies decide what happens to proxy requests while the tunnel is
+	// down
+	DownPolicies []wiresocks.DownPolicy
+	// DownAfter is the age of the last handshake at which a tunnel counts as
+	// down, zero uses wiresocks.DefaultDownAfter
+	DownAfter time.Duration
+	// Timeouts bounds the connections relayed for proxy clients and
+	// forwards, zero values use the defaults
+	Timeouts wiresocks.RelayTimeouts
+	// DestFamily picks the address families used for destinations inside
+	// the tunnel, unlike -4 and -6 which only choose the warp endpoint
+	DestFamily netstack.AddressPreference
+	// ResolvePolicies choose by domain suffix whether destination names are
+	// resolved on this host or inside the tunnel
+	ResolvePolicies []wiresocks.ResolvePolicy
+	// TraceURL is the Cloudflare trace endpoint used to verify that traffic
+	// egresses through WARP, empty uses wiresocks.DefaultTraceURL
+	TraceURL string
+	// Readiness is ReadinessServe, ReadinessWait or ReadinessReject and
+	// decides how proxy clients are treated before the first handshake,
+	// empty means ReadinessServe
+	Readiness string
+	// ReadyFile is created with the proxy addresses once the service is
+	// ready and removed when it stops
+	ReadyFile string
+	// ShutdownGrace is how long RunWarp lets connections finish once its
+	// context is done, nil uses DefaultShutdownGrace and zero closes them
+	// right away
+	ShutdownGrace *time.Duration
+	// Routes sends the proxy requests of a user through a named outbound:
+	// warp, gool, direct or psiphon:<country>. Other users use the tunnel of
+	// the running mode.
+	Routes map[string]string
 }
 
 type PsiphonOptions struct {
 	Country string
 }
 
+type ShadowsocksOptions struct {
+	Bind     netip.AddrPort
+	Method   string
+	Password string
+}
+
+// RunWarp starts the mode selected by opts and serves until ctx is done. It
+// then stops accepting clients, lets connections finish for the shutdown
+// grace period and closes everything before returning. When connections had
+// to be cut the error wraps ErrConnectionsCut.
 func RunWarp(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
 	if opts.Psiphon != nil && opts.Gool {
 		return errors.New("can't use psiphon and gool at the same time")
@@ -40,6 +117,33 @@ func RunWarp(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
 		return errors.New("must provide country for psiphon")
 	}
 
+	if err := checkPsiphon(opts); err != nil {
+		return err
+	}
+
+	switch opts.Readiness {
+	case "", ReadinessServe, ReadinessWait, ReadinessReject:
+	default:
+		return fmt.Errorf("unknown readiness mode %q", opts.Readiness)
+	}
+
+	if err := checkRoutes(opts); err != nil {
+		return err
+	}
+
+	proxyOpts := proxyOptions(opts)
+	if opts.TLS != nil {
+		tlsConfig, err := loadTLSConfig(l.With("subsystem", "tls"), opts)
+		if err != nil {
+			return err
+		}
+		proxyOpts.TLSConfig = tlsConfig
+	}
+	svc := newService(l, opts)
+	if opts.Readiness == ReadinessReject {
+		proxyOpts.Ready = svc.ready.Ready
+	}
+
 	// create identities
 	if err := createPrimaryAndSecondaryIdentities(l.With("subsystem", "warp/account"), opts); err != nil {
 		return err
@@ -74,26 +178,93 @@ func RunWarp(ctx context.Context, l *slog.Logger, opts WarpOptions) error {
 	}
 	l.Info("using warp endpoints", "endpoints", endpoints)
 
-	var warpErr error
-	switch {
-	case opts.Psiphon != nil:
-		l.Info("running in Psiphon (cfon) mode")
-		// run primary warp on a random tcp port and run psiphon on bind address
-		warpErr = runWarpWithPsiphon(ctx, l, opts, endpoints[0])
-	case opts.Gool:
-		l.Info("running in warp-in-warp (gool) mode")
-		// run warp in warp
-		warpErr = runWarpInWarp(ctx, l, opts, endpoints)
-	default:
-		l.Info("running in normal warp mode")
-		// just run primary warp on bindAddress
-		warpErr = runWarp(ctx, l, opts, endpoints[0])
+	// the tunnels outlive ctx, so the connections they carry can drain
+	// after it is done
+	runCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+
+	started := make(chan error, 1)
+	go func() {
+		switch {
+		case opts.Psiphon != nil:
+			l.Info("running in Psiphon (cfon) mode")
+			// run primary warp on a random tcp port and run psiphon on bind address
+			started <- runWarpWithPsiphon(runCtx, l, opts, svc, endpoints[0])
+		case opts.Gool:
+			l.Info("running in warp-in-warp (gool) mode")
+			// run warp in warp
+			started <- runWarpInWarp(runCtx, l, opts, proxyOpts, svc, endpoints)
+		default:
+			l.Info("running in normal warp mode")
+			// just run primary warp on bindAddress
+			started <- runWarp(runCtx, l, opts, proxyOpts, svc, endpoints)
+		}
+	}()
+
+	select {
+	case warpErr := <-started:
+		if warpErr != nil {
+			cancel()
+			svc.close()
+			return warpErr
+		}
+		<-ctx.Done()
+	case <-ctx.Done():
+		// abandon the start, there is nothing to drain yet
+		cancel()
+		<-started
 	}
 
-	return warpErr
+	grace := DefaultShutdownGrace
+	if opts.ShutdownGrace != nil {
+		grace = *opts.ShutdownGrace
+	}
+	l.Info("shutting down")
+	if cut := svc.shutdown(cancel, grace); cut > 0 {
+		return fmt.Errorf("%w: %d", ErrConnectionsCut, cut)
+	}
+	return nil
+}
+
+// checkPsiphon rejects opts in psiphon mode when they use any option the
+// psiphon tunnel can't serve, all of them are named in the error. Options
+// left at their defaults are not counted.
+func checkPsiphon(opts WarpOptions) error {
+	if opts.Psiphon == nil {
+		return nil
+	}
+
+	unsupported := []struct {
+		name string
+		set  bool
+	}{
+		{"proxy authentication", len(opts.Credentials) > 0},
+		{"user routing", len(opts.Routes) > 0},
+		{"client access control", len(opts.AllowClients) > 0 || len(opts.DenyClients) > 0 || opts.MaxClientConns > 0},
+		{"proxy connection limits", opts.MaxConns > 0 || (opts.HandshakeTimeout > 0 && opts.HandshakeTimeout != mixed.DefaultHandshakeTimeout)},
+		{"PROXY protocol", len(opts.ProxyProtocol) > 0},
+		{"tunnel down policies", len(opts.DownPolicies) > 0},
+		{"additional listeners", len(opts.Listeners) > 0},
+		{"relay timeouts", opts.Timeouts.WithDefaults() != (wiresocks.RelayTimeouts{}).WithDefaults()},
+		{"resolve policies", len(opts.ResolvePolicies) > 0},
+		{"tls inbound", opts.TLS != nil},
+		{"shadowsocks inbound", opts.Shadowsocks != nil},
+		{"port forwards", len(opts.Forwards) > 0},
+		{"readiness gating", opts.Readiness == ReadinessWait || opts.Readiness == ReadinessReject},
+	}
+	var names []string
+	for _, option := range unsupported {
+		if option.set {
+			names = append(names, option.name)
+		}
+	}
+	if len(names) > 0 {
+		return fmt.Errorf("not supported in psiphon mode: %s", strings.Join(names, ", "))
+	}
+	return nil
 }
 
-func runWarp(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoint string) error {
+func runWarp(ctx context.Context, l *slog.Logger, opts WarpOptions, proxyOpts wiresocks.ProxyOptions, svc *service, endpoints []string) error {
 	conf, err := wiresocks.ParseConfig(path.Join(opts.CacheDir, "primary", "wgcf-profile.ini"))
 	if err != nil {
 		return err
@@ -101,7 +272,7 @@ func runWarp(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoint str
 	conf.Interface.MTU = singleMTU
 
 	for i, peer := range conf.Peers {
-		peer.Endpoint = endpoint
+		peer.Endpoint = endpoints[0]
 		peer.Trick = true
 		peer.KeepAlive = 3
 		conf.Peers[i] = peer
@@ -111,18 +282,39 @@ func runWarp(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoint str
 	if err != nil {
 		return err
 	}
+	svc.addTunnel(tnet)
+	configureTunnel(tnet, opts)
 
-	_, err = tnet.StartProxy(opts.Bind)
+	proxyOpts.Outbounds, err = startOutbounds(ctx, l, opts, svc, endpoints, tnet, nil)
 	if err != nil {
 		return err
 	}
 
-	l.Info("serving proxy", "address", opts.Bind)
+	status := newStatusPage(tnet, "warp", endpoints[0])
+	go svc.waitUp(ctx, tnet)
+	go func() {
+		if trace, err := verifyEndpoint(ctx, l, tnet, opts, status, endpoints[0], append(slices.Clone(endpoints[1:]), opts.Fallbacks...)); err == nil {
+			svc.ready.SetTrace(trace)
+		}
+	}()
+	go svc.ready.Watch(ctx, tnet)
+	proxyOpts.Status = status
+	if err := startProxy(ctx, l, tnet, opts, proxyOpts, svc.ready); err != nil {
+		return err
+	}
+
+	if err := startShadowsocks(l, tnet, opts); err != nil {
+		return err
+	}
+
+	if err := startForwards(l, tnet, opts); err != nil {
+		return err
+	}
 
 	return nil
 }
 
-func runWarpWithPsiphon(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoint string) error {
+func runWarpWithPsiphon(ctx context.Context, l *slog.Logger, opts WarpOptions, svc *service, endpoint string) error {
 	conf, err := wiresocks.ParseConfig(path.Join(opts.CacheDir, "primary", "wgcf-profile.ini"))
 	if err != nil {
 		return err
@@ -140,24 +332,36 @@ func runWarpWithPsiphon(ctx context.Context, l *slog.Logger, opts WarpOptions, e
 	if err != nil {
 		return err
 	}
+	svc.addTunnel(tnet)
+	tnet.Tnet.SetAddressPreference(opts.DestFamily)
+	tnet.SetDownAfter(opts.DownAfter)
+	go svc.waitUp(ctx, tnet)
+	go func() {
+		if trace, err := verifyEndpoint(ctx, l, tnet, opts, nil, endpoint, opts.Fallbacks); err == nil {
+			svc.ready.SetTrace(trace)
+		}
+	}()
+	go svc.ready.Watch(ctx, tnet)
 
-	warpBind, err := tnet.StartProxy(netip.MustParseAddrPort("127.0.0.1:0"))
+	warpBind, err := tnet.StartProxy([]wiresocks.ProxyListener{wiresocks.TCPListener(netip.MustParseAddrPort("127.0.0.1:0"))}, wiresocks.ProxyOptions{Internal: true})
 	if err != nil {
 		return err
 	}
 
 	// run psiphon
-	err = psiphon.RunPsiphon(ctx, l.With("subsystem", "psiphon"), warpBind.String(), opts.CacheDir, opts.Bind.String(), opts.Psiphon.Country)
+	tunnel, err := psiphon.RunPsiphon(ctx, l.With("subsystem", "psiphon"), warpBind[0].String(), opts.CacheDir, opts.Bind.String(), opts.Psiphon.Country)
 	if err != nil {
 		return fmt.Errorf("unable to run psiphon %w", err)
 	}
+	svc.addPsiphon(tunnel)
 
 	l.Info("serving proxy", "address", opts.Bind)
+	svc.ready.SetServing(opts.Bind.String())
 
 	return nil
 }
 
-func runWarpInWarp(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoints []string) error {
+func runWarpInWarp(ctx context.Context, l *slog.Logger, opts WarpOptions, proxyOpts wiresocks.ProxyOptions, svc *service, endpoints []string) error {
 	// Run outer warp
 	conf, err := wiresocks.ParseConfig(path.Join(opts.CacheDir, "primary", "wgcf-profile.ini"))
 	if err != nil {
@@ -172,41 +376,51 @@ func runWarpInWarp(ctx context.Context, l *slog.Logger, opts WarpOptions, endpoi
 		conf.Peers[i] = peer
 	}
 
-	tnet, err := wiresocks.StartWireguard(ctx, l.With("gool", "outer"), conf)
+	outer, err := wiresocks.StartWireguard(ctx, l.With("gool", "outer"), conf)
 	if err != nil {
 		return err
 	}
+	svc.addTunnel(outer)
+	configureTunnel(outer, opts)
+	// gool does not fail over: the outer and the inner tunnel stay on the
+	// first two endpoints, the inner one reaching its endpoint through the
+	// outer one, so the outer tunnel is only verified and its endpoint
+	// remembered
+	go verifyEndpoint(ctx, l.With("gool", "outer"), outer, opts, nil, endpoints[0], nil)
 
-	// Create a UDP port forward between localhost and the remote endpoint
-	addr, err := wiresocks.NewVtunUDPForwarder(ctx, netip.MustParseAddrPort("127.0.0.1:0"), endpoints[1], tnet, singleMTU)
+	// Run inner warp
+	tnet, err := startInnerWarp(ctx, l.With("gool", "inner"), opts, svc, outer, endpoints[1])
 	if err != nil {
 		return err
 	}
 
-	// Run inner warp
-	conf, err = wiresocks.ParseConfig(path.Join(opts.CacheDir, "secondary", "wgcf-profile.ini"))
+	proxyOpts.Outbounds, err = startOutbounds(ctx, l, opts, svc, endpoints, outer, tnet)
 	if err != nil {
 		return err
 	}
-	conf.Interface.MTU = doubleMTU
 
-	for i, peer := range conf.Peers {
-		peer.Endpoint = addr.String()
-		peer.KeepAlive = 10
-		conf.Peers[i] = peer
+	status := newStatusPage(tnet, "warp-in-warp (gool)", endpoints...)
+	// the inner tunnel runs over a forwarder of the outer one
+	status.tunnels = append(status.tunnels, outer)
+	go svc.waitUp(ctx, tnet)
+	go func() {
+		if trace, err := showTrace(ctx, l.With("gool", "inner"), tnet, opts, status); err == nil {
+			svc.ready.SetTrace(trace)
+		}
+	}()
+	go svc.ready.Watch(ctx, tnet)
+	proxyOpts.Status = status
+	if err := startProxy(ctx, l, tnet, opts, proxyOpts, svc.ready); err != nil {
+		return err
 	}
 
-	tnet, err = wiresocks.StartWireguard(ctx, l.With("gool", "inner"), conf)
-	if err != nil {
+	if err := startShadowsocks(l, tnet, opts); err != nil {
 		return err
 	}
 
-	_, err = tnet.StartProxy(opts.Bind)
-	if err != nil {
+	if err := startForwards(l, tnet, opts); err != nil {
 		return err
 	}
-
-	l.Info("serving proxy", "address", opts.Bind)
 	return nil
 }
 
@@ -227,3 +441,77 @@ func createPrimaryAndSecondaryIdentities(l *slog.Logger, opts WarpOptions) error
 
 	return nil
 }
+
+// configureTunnel applies the relay settings of opts to a tunnel carrying
+// user traffic
+func configureTunnel(tnet *wiresocks.VirtualTun, opts WarpOptions) {
+	tnet.Timeouts = opts.Timeouts
+	tnet.ResolvePolicies = opts.ResolvePolicies
+	tnet.Tnet.SetAddressPreference(opts.DestFamily)
+	tnet.SetDownAfter(opts.DownAfter)
+}
+
+// startProxy serves the user facing proxy on Bind and the extra listeners.
+// With ReadinessWait it holds off until the tunnel had its first handshake.
+func startProxy(ctx context.Context, l *slog.Logger, tnet *wiresocks.VirtualTun, opts WarpOptions, proxyOpts wiresocks.ProxyOptions, ready *readiness.Tracker) error {
+	if opts.Readiness == ReadinessWait && !ready.Ready() {
+		l.Info("waiting for the first handshake before serving the proxy")
+		if err := ready.Wait(ctx); err != nil {
+			return err
+		}
+	}
+
+	listeners := append([]wiresocks.ProxyListener{wiresocks.TCPListener(opts.Bind)}, opts.Listeners...)
+	addrs, err := tnet.StartProxy(listeners, proxyOpts)
+	if err != nil {
+		return err
+	}
+	serving := make([]string, len(addrs))
+	for i, addr := range addrs {
+		l.Info("serving proxy", "address", addr, "protocols", listeners[i].Protocols)
+		serving[i] = addr.String()
+	}
+	ready.SetServing(serving...)
+	return nil
+}
+
+// startShadowsocks serves the optional Shadowsocks inbound through tnet
+func startShadowsocks(l *slog.Logger, tnet *wiresocks.VirtualTun, opts WarpOptions) error {
+	if opts.Shadowsocks == nil {
+		return nil
+	}
+
+	addr, err := tnet.StartShadowsocks(opts.Shadowsocks.Bind, opts.Shadowsocks.Method, opts.Shadowsocks.Password, opts.DownPolicies)
+	if err != nil {
+		return fmt.Errorf("unable to start shadowsocks: %w", err)
+	}
+	l.Info("serving shadowsocks", "address", addr, "method", opts.Shadowsocks.Method)
+	return nil
+}
+
+// startForwards serves the static port forwards through tnet
+func startForwards(l *slog.Logger, tnet *wiresocks.VirtualTun, opts WarpOptions) error {
+	for _, forward := range opts.Forwards {
+		addr, err := tnet.StartForward(forward)
+		if err != nil {
+			return fmt.Errorf("unable to start forward %s: %w", forward, err)
+		}
+		l.Info("serving forward", "protocol", forward.Network, "address", addr, "destination", forward.Remote)
+	}
+	return nil
+}
+
+// proxyOptions collects the settings of the user facing proxy
+func proxyOptions(opts WarpOptions) wiresocks.ProxyOptions {
+	return wiresocks.ProxyOptions{
+		Credentials:       opts.Credentials,
+		Allow:             opts.AllowClients,
+		Deny:              opts.DenyClients,
+		MaxConnsPerClient: opts.MaxClientConns,
+		MaxConns:          opts.MaxConns,
+		HandshakeTimeout:  opts.HandshakeTimeout,
+		ProxyProtocol:     opts.ProxyProtocol,
+		DownPolicies:      opts.DownPolicies,
+		PACBypass:         opts.PACBypass,
+	}
+}
@@ -0,0 +1,14 @@
+package app
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/bepass-org/warp-plus/app/doctor"
+)
+
+// RunDoctor runs the doctor checks against the tunnel MTU of a normal run
+func RunDoctor(ctx context.Context, l *slog.Logger, opts doctor.Options) *doctor.Report {
+	opts.MTU = singleMTU
+	return doctor.Run(ctx, l, opts)
+}
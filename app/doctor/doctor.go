@@ -0,0 +1,410 @@
+// Package doctor diagnoses what warp needs from the network, from the WARP
+// API to the MTU of a test tunnel, and reports every check.
+package doctor
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"path"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/bepass-org/warp-plus/ipscanner"
+	"github.com/bepass-org/warp-plus/warp"
+	"github.com/bepass-org/warp-plus/wireguard/tun/netstack"
+	"github.com/bepass-org/warp-plus/wiresocks"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	// maxMTU is the largest tunnel MTU the doctor probes, it fits a 1500
+	// byte path with WireGuard over IPv4
+	maxMTU = 1420
+	// minMTU is the smallest MTU worth reporting, the IPv6 minimum
+	minMTU = 1280
+	// upTimeout bounds how long the test tunnel may take to come up
+	upTimeout = 20 * time.Second
+	// pingTimeout bounds a single ICMP echo through the tunnel
+	pingTimeout = 3 * time.Second
+	// checkTimeout bounds the DNS and API checks
+	checkTimeout = 10 * time.Second
+)
+
+var (
+	// ports are the endpoint ports handshakes are tried on
+	ports = []uint16{2408, 500, 1701, 4500}
+	// pingTarget answers ICMP echo and sits behind the tunnel
+	pingTarget = netip.MustParseAddr("1.1.1.1")
+	// dnsServer is asked directly to tell blocked UDP from blocked WARP
+	dnsServer = netip.MustParseAddrPort("1.1.1.1:53")
+)
+
+// Options configures Run
+type Options struct {
+	// Endpoint is tested next to random endpoints and preferred for the
+	// tunnel checks
+	Endpoint string
+	License  string
+	CacheDir string
+	V4       bool
+	V6       bool
+	// MTU is the tunnel MTU warp-plus uses, the probed path MTU is compared
+	// with it
+	MTU int
+}
+
+// Check is the outcome of one diagnostic
+type Check struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Took   string `json:"took,omitempty"`
+}
+
+// Report collects the checks of a doctor run. It holds no keys and can
+// be attached to bug reports as is.
+type Report struct {
+	Version   string    `json:"version"`
+	GoVersion string    `json:"go_version"`
+	OS        string    `json:"os"`
+	Arch      string    `json:"arch"`
+	Time      time.Time `json:"time"`
+	Endpoint  string    `json:"endpoint,omitempty"`
+	MTU       int       `json:"mtu,omitempty"`
+	Checks    []Check   `json:"checks"`
+}
+
+// Print writes the report for humans, one line per check
+func (r *Report) Print(w io.Writer) {
+	for _, c := range r.Checks {
+		status := "ok"
+		if !c.OK {
+			status = "FAIL"
+		}
+		line := fmt.Sprintf("[%4s] %s", status, c.Name)
+		if c.Detail != "" {
+			line += ": " + c.Detail
+		}
+		if c.Error != "" {
+			line += " (" + c.Error + ")"
+		}
+		if c.Took != "" {
+			line += " in " + c.Took
+		}
+		fmt.Fprintln(w, line)
+	}
+}
+
+// WriteJSON writes the report as indented JSON
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+func (r *Report) add(name string, took time.Duration, err error, detail string) bool {
+	c := Check{Name: name, OK: err == nil, Detail: detail}
+	if err != nil {
+		c.Error = err.Error()
+	}
+	if took > 0 {
+		c.Took = took.Round(time.Millisecond).String()
+	}
+	r.Checks = append(r.Checks, c)
+	return c.OK
+}
+
+// handshakeResult is one handshake attempt of the doctor
+type handshakeResult struct {
+	addr  netip.AddrPort
+	trick bool
+	rtt   time.Duration
+	err   error
+}
+
+// Run checks the pieces warp needs one after the other: the WARP API, plain
+// UDP, WireGuard handshakes with and without the trick, and through a test
+// tunnel ICMP, DNS and the usable MTU. Failed checks are part of the report,
+// the checks that depend on them are left out.
+func Run(ctx context.Context, l *slog.Logger, opts Options) *Report {
+	r := &Report{
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		Time:      time.Now().UTC(),
+	}
+
+	apiCtx, cancel := context.WithTimeout(ctx, checkTimeout)
+	took, err := warp.PingAPI(apiCtx)
+	cancel()
+	r.add("warp api", took, err, "https api.cloudflareclient.com")
+
+	took, err = checkDirectDNS(ctx)
+	udpOK := r.add("plain udp", took, err, "dns query to "+dnsServer.String())
+
+	identityPath := path.Join(opts.CacheDir, "primary")
+	if err := warp.LoadOrCreateIdentity(l.With("subsystem", "warp/account"), identityPath, opts.License); err != nil {
+		r.add("identity", 0, err, "")
+		return r
+	}
+	identity, err := warp.LoadIdentity(identityPath)
+	if !r.add("identity", 0, err, identityPath) {
+		return r
+	}
+
+	candidates, err := endpoints(ctx, opts)
+	if !r.add("endpoints", 0, err, fmt.Sprint(candidates)) && len(candidates) == 0 {
+		return r
+	}
+	results := runHandshakes(candidates, identity.PrivateKey, identity.Config.Peers[0].PublicKey)
+	var best *handshakeResult
+	answered, answeredTrick := 0, 0
+	for i, h := range results {
+		r.add(fmt.Sprintf("handshake %s trick=%t", h.addr, h.trick), h.rtt, h.err, "")
+		if h.err != nil {
+			continue
+		}
+		answered++
+		if h.trick {
+			answeredTrick++
+		}
+		// candidates come in order of preference, plain handshakes first
+		if best == nil {
+			best = &results[i]
+		}
+	}
+
+	switch {
+	case answered == 0 && udpOK:
+		r.add("udp", 0, errors.New("no endpoint answered"), "plain UDP works, so WARP handshakes are probably filtered")
+	case answered == 0:
+		r.add("udp", 0, errors.New("no endpoint answered"), "plain UDP fails as well, UDP is probably blocked")
+	case answeredTrick == answered:
+		r.add("udp", 0, nil, fmt.Sprintf("%d of %d handshakes answered, only with the trick", answered, len(results)))
+	default:
+		r.add("udp", 0, nil, fmt.Sprintf("%d of %d handshakes answered", answered, len(results)))
+	}
+	if best == nil {
+		return r
+	}
+	r.Endpoint = best.addr.String()
+
+	tnet, err := startTunnel(ctx, l, opts.CacheDir, *best)
+	if !r.add("tunnel", 0, err, fmt.Sprintf("%s trick=%t", best.addr, best.trick)) {
+		return r
+	}
+	defer tnet.Stop()
+
+	dnsCtx, cancel := context.WithTimeout(ctx, checkTimeout)
+	start := time.Now()
+	addrs, err := tnet.Tnet.LookupContextHost(dnsCtx, "cloudflare.com")
+	cancel()
+	r.add("dns through tunnel", time.Since(start), err, fmt.Sprint(addrs))
+
+	rtt, err := pingThrough(tnet.Tnet, pingTarget, 56)
+	if !r.add("icmp through tunnel", rtt, err, pingTarget.String()) {
+		return r
+	}
+
+	mtu := probeMTU(tnet.Tnet)
+	detail := fmt.Sprintf("largest packet through the tunnel is %d bytes, warp-plus uses %d", mtu, opts.MTU)
+	if mtu < opts.MTU {
+		r.add("mtu", 0, fmt.Errorf("path is narrower than %d", opts.MTU), detail)
+	} else {
+		r.add("mtu", 0, nil, detail)
+	}
+	r.MTU = mtu
+
+	return r
+}
+
+// checkDirectDNS resolves a name with a public DNS server over UDP without
+// the tunnel
+func checkDirectDNS(ctx context.Context) (time.Duration, error) {
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", dnsServer.String())
+		},
+	}
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	start := time.Now()
+	_, err := resolver.LookupNetIP(ctx, "ip4", "cloudflare.com")
+	return time.Since(start), err
+}
+
+// endpoints returns the endpoints to handshake with: the configured one
+// first, then one random address per family on each of ports. When some of
+// them can't be found the others are returned with the error.
+func endpoints(ctx context.Context, opts Options) ([]netip.AddrPort, error) {
+	var endpoints []netip.AddrPort
+	var errs []error
+	if opts.Endpoint != "" {
+		addrPort, err := resolveEndpoint(ctx, opts.Endpoint)
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			endpoints = append(endpoints, addrPort)
+		}
+	}
+
+	for _, family := range []struct{ v4, v6 bool }{{opts.V4, false}, {false, opts.V6}} {
+		if !family.v4 && !family.v6 {
+			continue
+		}
+		random, err := warp.RandomWarpEndpoint(family.v4, family.v6)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, port := range ports {
+			endpoints = append(endpoints, netip.AddrPortFrom(random.Addr(), port))
+		}
+	}
+	return endpoints, errors.Join(errs...)
+}
+
+// resolveEndpoint resolves the host of a host:port endpoint
+func resolveEndpoint(ctx context.Context, endpoint string) (netip.AddrPort, error) {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("unable to resolve endpoint %s: %w", endpoint, err)
+	}
+	return netip.ParseAddrPort(net.JoinHostPort(addrs[0].Unmap().String(), port))
+}
+
+// runHandshakes tries every endpoint without and with the trick at once.
+// The results keep the order of endpoints, the plain attempt first.
+func runHandshakes(endpoints []netip.AddrPort, privateKey, peerPublicKey string) []handshakeResult {
+	results := make([]handshakeResult, 0, 2*len(endpoints))
+	for _, addr := range endpoints {
+		results = append(results, handshakeResult{addr: addr}, handshakeResult{addr: addr, trick: true})
+	}
+
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(h *handshakeResult) {
+			defer wg.Done()
+			h.rtt, h.err = ipscanner.WarpHandshake(h.addr, privateKey, peerPublicKey, "", h.trick)
+		}(&results[i])
+	}
+	wg.Wait()
+	return results
+}
+
+// startTunnel brings up the primary identity through h with the
+// largest MTU the doctor probes
+func startTunnel(ctx context.Context, l *slog.Logger, cacheDir string, h handshakeResult) (*wiresocks.VirtualTun, error) {
+	conf, err := wiresocks.ParseConfig(path.Join(cacheDir, "primary", "wgcf-profile.ini"))
+	if err != nil {
+		return nil, err
+	}
+	conf.Interface.MTU = maxMTU
+
+	for i, peer := range conf.Peers {
+		peer.Endpoint = h.addr.String()
+		peer.Trick = h.trick
+		peer.KeepAlive = 3
+		conf.Peers[i] = peer
+	}
+
+	tnet, err := wiresocks.StartWireguard(ctx, l, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	upCtx, cancel := context.WithTimeout(ctx, upTimeout)
+	defer cancel()
+	if err := tnet.WaitUp(upCtx); err != nil {
+		tnet.Stop()
+		return nil, fmt.Errorf("no handshake within %s: %w", upTimeout, err)
+	}
+	return tnet, nil
+}
+
+// pingThrough sends an ICMP echo with size bytes of payload to dst through
+// tnet and waits for the reply
+func pingThrough(tnet *netstack.Net, dst netip.Addr, size int) (time.Duration, error) {
+	conn, err := tnet.DialPingAddr(netip.Addr{}, dst)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	var id [2]byte
+	_, _ = rand.Read(id[:])
+	request := icmp.Echo{ID: int(binary.BigEndian.Uint16(id[:])), Seq: 1, Data: make([]byte, size)}
+	packet, err := (&icmp.Message{Type: ipv4.ICMPTypeEcho, Body: &request}).Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(pingTimeout))
+	start := time.Now()
+	if _, err := conn.Write(packet); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, len(packet)+64)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+		reply, err := icmp.ParseMessage(1, buf[:n])
+		if err != nil {
+			return 0, err
+		}
+		if echo, ok := reply.Body.(*icmp.Echo); ok && echo.Seq == request.Seq && len(echo.Data) == size {
+			return time.Since(start), nil
+		}
+	}
+}
+
+// probeMTU finds the largest IPv4 packet that crosses the tunnel with a
+// binary search over ICMP echo sizes, zero when not even minMTU does
+func probeMTU(tnet *netstack.Net) int {
+	const overhead = 28 // IPv4 and ICMP headers
+	fits := func(mtu int) bool {
+		// a lost echo is not a verdict yet
+		for range 2 {
+			if _, err := pingThrough(tnet, pingTarget, mtu-overhead); err == nil {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !fits(minMTU) {
+		return 0
+	}
+	lo, hi := minMTU, maxMTU
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if fits(mid) {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return lo
+}
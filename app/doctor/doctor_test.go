@@ -0,0 +1,63 @@
+package doctor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestReportPrint(t *testing.T) {
+	var r Report
+	qt.Assert(t, r.add("warp api", 42*time.Millisecond, nil, "https api.cloudflareclient.com"), qt.IsTrue)
+	qt.Assert(t, r.add("plain udp", 0, errors.New("i/o timeout"), "dns query to 1.1.1.1:53"), qt.IsFalse)
+	r.add("tunnel", 0, nil, "")
+
+	var out bytes.Buffer
+	r.Print(&out)
+	qt.Assert(t, out.String(), qt.Equals, `[  ok] warp api: https api.cloudflareclient.com in 42ms
+[FAIL] plain udp: dns query to 1.1.1.1:53 (i/o timeout)
+[  ok] tunnel
+`)
+}
+
+func TestReportWriteJSON(t *testing.T) {
+	r := Report{Version: "v1.2.3", Endpoint: "162.159.192.1:2408", MTU: 1420}
+	r.add("mtu", 0, errors.New("path is narrower than 1330"), "")
+
+	var out bytes.Buffer
+	qt.Assert(t, r.WriteJSON(&out), qt.IsNil)
+	var decoded Report
+	qt.Assert(t, json.Unmarshal(out.Bytes(), &decoded), qt.IsNil)
+	qt.Assert(t, decoded.Version, qt.Equals, "v1.2.3")
+	qt.Assert(t, decoded.MTU, qt.Equals, 1420)
+	qt.Assert(t, decoded.Checks, qt.DeepEquals, []Check{{Name: "mtu", Error: "path is narrower than 1330"}})
+}
+
+func TestEndpoints(t *testing.T) {
+	ctx := context.Background()
+
+	got, err := endpoints(ctx, Options{Endpoint: "127.0.0.1:2408", V4: true})
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, got, qt.HasLen, 1+len(ports))
+	qt.Assert(t, got[0], qt.Equals, netip.MustParseAddrPort("127.0.0.1:2408"))
+	for i, port := range ports {
+		qt.Assert(t, got[1+i].Addr().Is4(), qt.IsTrue)
+		qt.Assert(t, got[1+i].Port(), qt.Equals, port)
+	}
+
+	got, err = endpoints(ctx, Options{V4: true, V6: true})
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, got, qt.HasLen, 2*len(ports))
+	qt.Assert(t, got[len(ports)].Addr().Is6(), qt.IsTrue)
+
+	// a broken endpoint is reported, the random ones are still tried
+	got, err = endpoints(ctx, Options{Endpoint: "no-port", V4: true})
+	qt.Assert(t, err, qt.ErrorMatches, ".*missing port in address")
+	qt.Assert(t, got, qt.HasLen, len(ports))
+}
@@ -0,0 +1,179 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/netip"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+// lastEndpointFile stores the endpoint of the last tunnel that came up
+const lastEndpointFile = "last-endpoint"
+
+// errNoHandshake is returned by checkTrace when the tunnel did not come up
+var errNoHandshake = errors.New("no handshake")
+
+const (
+	// traceTimeout bounds one trace check, including the wait for the first
+	// handshake
+	traceTimeout = 20 * time.Second
+	// traceRetryInterval separates trace checks on the same endpoint
+	traceRetryInterval = 30 * time.Second
+	// traceAttempts is how many trace checks an endpoint gets
+	traceAttempts = 3
+)
+
+// LastEndpoint returns the endpoint that last carried a working tunnel, if any
+func LastEndpoint(cacheDir string) (string, bool) {
+	b, err := os.ReadFile(path.Join(cacheDir, lastEndpointFile))
+	if err != nil {
+		return "", false
+	}
+	endpoint := strings.TrimSpace(string(b))
+	if _, err := netip.ParseAddrPort(endpoint); err != nil {
+		return "", false
+	}
+	return endpoint, true
+}
+
+// rememberEndpoint records endpoint as the last good one once tnet is up
+func rememberEndpoint(ctx context.Context, l *slog.Logger, tnet *wiresocks.VirtualTun, cacheDir, endpoint string) {
+	if err := tnet.WaitUp(ctx); err != nil {
+		return
+	}
+	if err := os.WriteFile(path.Join(cacheDir, lastEndpointFile), []byte(endpoint+"\n"), 0o644); err != nil {
+		l.Warn("failed to save endpoint", "error", err)
+	}
+}
+
+// verifyEndpoint checks through the trace endpoint that traffic of tnet
+// egresses through WARP. The tunnel fails over to the next of fallbacks right
+// away when the endpoint gives no handshake or the trace shows that traffic
+// does not egress through WARP, and after traceAttempts failed checks for any
+// other reason, such as a trace URL the endpoint can't reach. A failed
+// endpoint is forgotten. Once the fallbacks ran out the last endpoint gets
+// traceAttempts checks and the error of the last one is returned. The
+// endpoint that passed is remembered like rememberEndpoint does and its trace
+// is returned. status may be nil.
+func verifyEndpoint(ctx context.Context, l *slog.Logger, tnet *wiresocks.VirtualTun, opts WarpOptions, status *statusPage, endpoint string, fallbacks []string) (*wiresocks.Trace, error) {
+	var candidates []string
+	for _, fallback := range fallbacks {
+		if fallback != endpoint && !slices.Contains(candidates, fallback) {
+			candidates = append(candidates, fallback)
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		trace, err := checkTrace(ctx, tnet, opts.TraceURL)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		reportTrace(l.With("endpoint", endpoint), status, trace, err)
+		if err == nil {
+			if err := os.WriteFile(path.Join(opts.CacheDir, lastEndpointFile), []byte(endpoint+"\n"), 0o644); err != nil {
+				l.Warn("failed to save endpoint", "error", err)
+			}
+			return trace, nil
+		}
+
+		if attempt >= traceAttempts || errors.Is(err, errNoHandshake) || errors.Is(err, wiresocks.ErrWarpOff) {
+			forgetEndpoint(opts.CacheDir, endpoint)
+			if next, ok := switchEndpoint(l, tnet, status, &candidates); ok {
+				endpoint, attempt = next, 0
+				continue
+			}
+			if attempt >= traceAttempts {
+				return nil, err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(traceRetryInterval):
+		}
+	}
+}
+
+// switchEndpoint moves tnet to the first of candidates it can be pointed at
+// and removes the endpoints it tried from candidates. It reports false when
+// none is left.
+func switchEndpoint(l *slog.Logger, tnet *wiresocks.VirtualTun, status *statusPage, candidates *[]string) (string, bool) {
+	for len(*candidates) > 0 {
+		endpoint := (*candidates)[0]
+		*candidates = (*candidates)[1:]
+
+		l.Info("switching endpoint", "endpoint", endpoint)
+		if err := tnet.SetEndpoint(endpoint); err != nil {
+			l.Warn("failed to switch endpoint", "endpoint", endpoint, "error", err)
+			continue
+		}
+		if status != nil {
+			status.setEndpoint(endpoint)
+		}
+		return endpoint, true
+	}
+	return "", false
+}
+
+// showTrace verifies tnet once it is up and reports the result, for tunnels
+// without an endpoint of their own to fail over. It makes up to traceAttempts
+// checks and returns the trace or the error of the last one.
+func showTrace(ctx context.Context, l *slog.Logger, tnet *wiresocks.VirtualTun, opts WarpOptions, status *statusPage) (*wiresocks.Trace, error) {
+	for attempt := 1; ; attempt++ {
+		trace, err := checkTrace(ctx, tnet, opts.TraceURL)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		reportTrace(l, status, trace, err)
+		if err == nil {
+			return trace, nil
+		}
+		if attempt >= traceAttempts {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(traceRetryInterval):
+		}
+	}
+}
+
+// reportTrace logs the outcome of a trace check and shows it on status,
+// which may be nil
+func reportTrace(l *slog.Logger, status *statusPage, trace *wiresocks.Trace, err error) {
+	if status != nil {
+		status.setTrace(trace, err)
+	}
+	if err != nil {
+		l.Warn("warp verification failed", "error", err)
+		return
+	}
+	l.Info("verified warp", "warp", trace.Warp, "ip", trace.IP, "colo", trace.Colo, "loc", trace.Loc)
+}
+
+// checkTrace waits for the tunnel to come up and fetches the trace through it
+func checkTrace(ctx context.Context, tnet *wiresocks.VirtualTun, url string) (*wiresocks.Trace, error) {
+	ctx, cancel := context.WithTimeout(ctx, traceTimeout)
+	defer cancel()
+	if err := tnet.WaitUp(ctx); err != nil {
+		return nil, errNoHandshake
+	}
+	return tnet.Trace(ctx, url)
+}
+
+// forgetEndpoint removes endpoint from the cache when it is the remembered one
+func forgetEndpoint(cacheDir, endpoint string) {
+	if last, ok := LastEndpoint(cacheDir); ok && last == endpoint {
+		_ = os.Remove(path.Join(cacheDir, lastEndpointFile))
+	}
+}
@@ -0,0 +1,121 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"time"
+
+	"github.com/bepass-org/warp-plus/app/netcat"
+	"github.com/bepass-org/warp-plus/warp"
+	"github.com/bepass-org/warp-plus/wireguard/tun/netstack"
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+// netcatUpTimeout bounds how long the tunnel may take to come up
+const netcatUpTimeout = 30 * time.Second
+
+// NetcatOptions configures RunNetcat
+type NetcatOptions struct {
+	Endpoint string
+	// Fallback is tried once when the tunnel does not come up through
+	// Endpoint, which is then forgotten if it was the remembered one
+	Fallback string
+	License  string
+	CacheDir string
+	// Network is "tcp" or "udp"
+	Network string
+	// Address is the host:port to connect to, host names are resolved with
+	// the DNS servers of the tunnel
+	Address string
+	// DestFamily picks the address families used to reach Address
+	DestFamily netstack.AddressPreference
+}
+
+// RunNetcat brings up the primary warp tunnel and pipes stdin and stdout to
+// the destination until either side is done. With udp every read from stdin
+// is sent as one datagram.
+func RunNetcat(ctx context.Context, l *slog.Logger, opts NetcatOptions, stdin io.Reader, stdout io.Writer) error {
+	if err := warp.LoadOrCreateIdentity(l.With("subsystem", "warp/account"), path.Join(opts.CacheDir, "primary"), opts.License); err != nil {
+		return err
+	}
+
+	conf, err := wiresocks.ParseConfig(path.Join(opts.CacheDir, "primary", "wgcf-profile.ini"))
+	if err != nil {
+		return err
+	}
+	conf.Interface.MTU = singleMTU
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	endpoint := opts.Endpoint
+	tnet, stop, err := startNetcatTunnel(ctx, l, conf, endpoint, opts.DestFamily)
+	if err != nil && ctx.Err() == nil && opts.Fallback != "" {
+		// a remembered endpoint that stopped working must not be tried again
+		forgetEndpoint(opts.CacheDir, endpoint)
+		l.Warn("tunnel did not come up, trying another endpoint", "endpoint", endpoint, "fallback", opts.Fallback, "error", err)
+		endpoint = opts.Fallback
+		tnet, stop, err = startNetcatTunnel(ctx, l, conf, endpoint, opts.DestFamily)
+	}
+	if err != nil {
+		return err
+	}
+	defer stop()
+	rememberEndpoint(ctx, l, tnet, opts.CacheDir, endpoint)
+
+	conn, err := tnet.Tnet.DialContext(ctx, opts.Network, opts.Address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// the pipes end once conn is closed
+	context.AfterFunc(ctx, func() { _ = conn.Close() })
+	l.Debug("connected", "protocol", opts.Network, "destination", opts.Address)
+
+	if opts.Network == "udp" {
+		err = netcat.Datagrams(conn, stdin, stdout, netcat.UDPLinger)
+	} else {
+		err = netcat.Stream(conn, stdin, stdout)
+	}
+	if ctx.Err() != nil {
+		// interrupted, the pipe failed because conn was closed
+		return ctx.Err()
+	}
+	return err
+}
+
+// startNetcatTunnel brings up a tunnel through endpoint and waits for its
+// first handshake. stop takes the tunnel down again.
+func startNetcatTunnel(ctx context.Context, l *slog.Logger, conf *wiresocks.Configuration, endpoint string, family netstack.AddressPreference) (tnet *wiresocks.VirtualTun, stop func(), err error) {
+	for i, peer := range conf.Peers {
+		peer.Endpoint = endpoint
+		peer.Trick = true
+		peer.KeepAlive = 3
+		conf.Peers[i] = peer
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	tnet, err = wiresocks.StartWireguard(ctx, l, conf)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	stop = func() {
+		cancel()
+		tnet.Stop()
+	}
+	tnet.Tnet.SetAddressPreference(family)
+
+	upCtx, upCancel := context.WithTimeout(ctx, netcatUpTimeout)
+	defer upCancel()
+	if err := tnet.WaitUp(upCtx); err != nil {
+		// release the socket before another endpoint is tried
+		cancel()
+		tnet.Close()
+		return nil, nil, fmt.Errorf("tunnel did not come up through %s: %w", endpoint, err)
+	}
+	return tnet, stop, nil
+}
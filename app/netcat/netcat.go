@@ -0,0 +1,62 @@
+// Package netcat pipes stdin and stdout to a connection for the nc
+// subcommand.
+package netcat
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+)
+
+// UDPLinger is how long replies are still read after stdin ends
+const UDPLinger = 5 * time.Second
+
+// Stream copies stdin to conn and conn to stdout. The end of stdin is passed
+// on as a half-close, the pipe ends when the destination closes.
+func Stream(conn net.Conn, stdin io.Reader, stdout io.Writer) error {
+	go func() {
+		_, _ = io.Copy(conn, stdin)
+		_ = statute.CloseWrite(conn)
+	}()
+
+	_, err := io.Copy(stdout, conn)
+	return err
+}
+
+// Datagrams sends every read from stdin as a datagram and writes the replies
+// to stdout. Replies are awaited for linger after stdin ends.
+func Datagrams(conn net.Conn, stdin io.Reader, stdout io.Writer, linger time.Duration) error {
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := stdin.Read(buf)
+			if n > 0 {
+				if _, err := conn.Write(buf[:n]); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				_ = conn.SetReadDeadline(time.Now().Add(linger))
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.Is(err, net.ErrClosed) || errors.As(err, &netErr) && netErr.Timeout() {
+				return nil
+			}
+			return err
+		}
+		if _, err := stdout.Write(buf[:n]); err != nil {
+			return err
+		}
+	}
+}
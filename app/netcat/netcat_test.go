@@ -0,0 +1,76 @@
+package netcat
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestStream(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	qt.Assert(t, err, qt.IsNil)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// answer once the request ended, which needs the half-close
+		req, _ := io.ReadAll(conn)
+		_, _ = conn.Write(append([]byte("echo: "), req...))
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	qt.Assert(t, err, qt.IsNil)
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	var out bytes.Buffer
+	err = Stream(conn, strings.NewReader("hello"), &out)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, out.String(), qt.Equals, "echo: hello")
+}
+
+func TestDatagrams(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	qt.Assert(t, err, qt.IsNil)
+	defer server.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = server.WriteTo(bytes.ToUpper(buf[:n]), addr)
+		}
+	}()
+
+	conn, err := net.Dial("udp", server.LocalAddr().String())
+	qt.Assert(t, err, qt.IsNil)
+	defer conn.Close()
+
+	// every read from stdin is one datagram
+	stdin, w := io.Pipe()
+	var out bytes.Buffer
+	done := make(chan error, 1)
+	go func() { done <- Datagrams(conn, stdin, &out, 100*time.Millisecond) }()
+	_, _ = w.Write([]byte("ping"))
+	_, _ = w.Write([]byte("pong"))
+	_ = w.Close()
+
+	// the replies are read until the linger after stdin ended is over
+	select {
+	case err := <-done:
+		qt.Assert(t, err, qt.IsNil)
+	case <-time.After(5 * time.Second):
+		t.Fatal("pipe did not end after the linger")
+	}
+	qt.Assert(t, out.String(), qt.Equals, "PINGPONG")
+}
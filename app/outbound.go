@@ -0,0 +1,159 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/bepass-org/warp-plus/psiphon"
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+// names of the outbounds users can be routed to
+const (
+	OutboundWarp          = "warp"
+	OutboundGool          = "gool"
+	OutboundDirect        = "direct"
+	OutboundPsiphonPrefix = "psiphon:"
+)
+
+// checkRoutes validates the user routes of opts
+func checkRoutes(opts WarpOptions) error {
+	if len(opts.Routes) == 0 {
+		return nil
+	}
+	if len(opts.Credentials) == 0 {
+		return errors.New("user routing needs proxy authentication")
+	}
+
+	var country string
+	for user, outbound := range opts.Routes {
+		if _, ok := opts.Credentials[user]; !ok {
+			return fmt.Errorf("route for unknown user %q", user)
+		}
+		switch {
+		case outbound == OutboundWarp, outbound == OutboundGool, outbound == OutboundDirect:
+		case strings.HasPrefix(outbound, OutboundPsiphonPrefix):
+			c := strings.TrimPrefix(outbound, OutboundPsiphonPrefix)
+			if c == "" {
+				return fmt.Errorf("outbound %q is missing the psiphon country", outbound)
+			}
+			// psiphon keeps global state, so only one instance can run
+			if country != "" && c != country {
+				return errors.New("only one psiphon country can be routed to")
+			}
+			country = c
+		default:
+			return fmt.Errorf("unknown outbound %q for user %q", outbound, user)
+		}
+	}
+	return nil
+}
+
+// startOutbounds starts the outbounds named by the user routes and returns
+// them by user. primary is the first warp tunnel, inner the warp-in-warp
+// tunnel when the mode already runs one.
+func startOutbounds(ctx context.Context, l *slog.Logger, opts WarpOptions, svc *service, endpoints []string, primary, inner *wiresocks.VirtualTun) (map[string]wiresocks.Outbound, error) {
+	if len(opts.Routes) == 0 {
+		return nil, nil
+	}
+
+	users := make([]string, 0, len(opts.Routes))
+	for user := range opts.Routes {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+
+	started := make(map[string]wiresocks.Outbound)
+	outbounds := make(map[string]wiresocks.Outbound, len(users))
+	for _, user := range users {
+		name := opts.Routes[user]
+		outbound, ok := started[name]
+		if !ok {
+			ol := l.With("outbound", name)
+			switch {
+			case name == OutboundWarp:
+				outbound = primary
+			case name == OutboundGool:
+				if inner == nil {
+					var err error
+					inner, err = startInnerWarp(ctx, ol, opts, svc, primary, endpoints[1])
+					if err != nil {
+						return nil, fmt.Errorf("unable to start outbound %s: %w", name, err)
+					}
+				}
+				outbound = inner
+			case name == OutboundDirect:
+				direct := wiresocks.NewDirectOutbound(ol)
+				direct.Timeouts = opts.Timeouts
+				direct.Drainer = svc.drainer
+				outbound = direct
+			default:
+				country := strings.TrimPrefix(name, OutboundPsiphonPrefix)
+				socks, err := startPsiphonOutbound(ctx, ol, opts, svc, primary, country)
+				if err != nil {
+					return nil, fmt.Errorf("unable to start outbound %s: %w", name, err)
+				}
+				socks.Timeouts = opts.Timeouts
+				socks.Drainer = svc.drainer
+				outbound = socks
+			}
+			started[name] = outbound
+			l.Info("started outbound", "outbound", name)
+		}
+		outbounds[user] = outbound
+	}
+	return outbounds, nil
+}
+
+// startPsiphonOutbound runs psiphon through the primary tunnel and connects
+// to its local SOCKS proxy
+func startPsiphonOutbound(ctx context.Context, l *slog.Logger, opts WarpOptions, svc *service, primary *wiresocks.VirtualTun, country string) (*wiresocks.DialOutbound, error) {
+	warpBind, err := primary.StartProxy([]wiresocks.ProxyListener{wiresocks.TCPListener(netip.MustParseAddrPort("127.0.0.1:0"))}, wiresocks.ProxyOptions{Internal: true})
+	if err != nil {
+		return nil, err
+	}
+
+	tunnel, err := psiphon.RunPsiphon(ctx, l.With("subsystem", "psiphon"), warpBind[0].String(), opts.CacheDir, "127.0.0.1:0", country)
+	if err != nil {
+		return nil, fmt.Errorf("unable to run psiphon %w", err)
+	}
+	svc.addPsiphon(tunnel)
+	return wiresocks.NewSOCKS5Outbound(l, netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), uint16(tunnel.SOCKSProxyPort)).String())
+}
+
+// startInnerWarp runs the secondary identity inside primary, reaching
+// endpoint through a UDP forward in the primary tunnel. svc may be nil when
+// the caller closes the tunnel itself.
+func startInnerWarp(ctx context.Context, l *slog.Logger, opts WarpOptions, svc *service, primary *wiresocks.VirtualTun, endpoint string) (*wiresocks.VirtualTun, error) {
+	// Create a UDP port forward between localhost and the remote endpoint
+	forwarder, err := wiresocks.NewVtunUDPForwarder(ctx, netip.MustParseAddrPort("127.0.0.1:0"), endpoint, primary, singleMTU)
+	if err != nil {
+		return nil, err
+	}
+
+	conf, err := wiresocks.ParseConfig(path.Join(opts.CacheDir, "secondary", "wgcf-profile.ini"))
+	if err != nil {
+		return nil, err
+	}
+	conf.Interface.MTU = doubleMTU
+
+	for i, peer := range conf.Peers {
+		peer.Endpoint = forwarder.LocalAddr().String()
+		peer.KeepAlive = 10
+		conf.Peers[i] = peer
+	}
+
+	tnet, err := wiresocks.StartWireguard(ctx, l, conf)
+	if err != nil {
+		return nil, err
+	}
+	svc.addTunnel(tnet)
+	configureTunnel(tnet, opts)
+	return tnet, nil
+}
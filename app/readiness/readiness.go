@@ -0,0 +1,216 @@
+// Package readiness follows the start of the service and announces it to
+// systemd over NOTIFY_SOCKET and with a ready file.
+package readiness
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+// maxNotifyInterval bounds how long a change of the tunnel state takes to
+// reach the service manager
+const maxNotifyInterval = 5 * time.Second
+
+// Tunnel reports whether a tunnel is up
+type Tunnel interface {
+	Up() bool
+}
+
+// Tracker follows the start of the service. The service is ready once the
+// tunnel had its first handshake and the proxy serves. A trace check of the
+// tunnel only adds to the status, a trace URL that can't be reached does not
+// hold the service back.
+type Tracker struct {
+	l    *slog.Logger
+	file string
+
+	mu       sync.Mutex
+	up       chan struct{}
+	trace    *wiresocks.Trace
+	serving  []string
+	notified bool
+}
+
+// New returns a Tracker that creates file with the proxy addresses once the
+// service is ready, file may be empty
+func New(l *slog.Logger, file string) *Tracker {
+	return &Tracker{l: l, file: file, up: make(chan struct{})}
+}
+
+// Ready reports whether the tunnel had its first handshake
+func (r *Tracker) Ready() bool {
+	select {
+	case <-r.up:
+		return true
+	default:
+		return false
+	}
+}
+
+// Wait blocks until the tunnel had its first handshake or ctx is done
+func (r *Tracker) Wait(ctx context.Context) error {
+	select {
+	case <-r.up:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SetUp records the first handshake of the tunnel
+func (r *Tracker) SetUp() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	select {
+	case <-r.up:
+		return
+	default:
+	}
+	close(r.up)
+	r.announce()
+}
+
+// SetTrace records a passed trace check of the tunnel for the status
+func (r *Tracker) SetTrace(trace *wiresocks.Trace) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.trace = trace
+	r.announce()
+}
+
+// SetServing records that the proxy accepts clients on addrs
+func (r *Tracker) SetServing(addrs ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.serving = append(r.serving, addrs...)
+	r.announce()
+}
+
+// status describes the service for the service manager, r.mu must be held
+func (r *Tracker) status() string {
+	var parts []string
+	if len(r.serving) > 0 {
+		parts = append(parts, "serving on "+strings.Join(r.serving, ", "))
+	}
+	switch {
+	case r.trace != nil:
+		parts = append(parts, fmt.Sprintf("warp=%s ip=%s colo=%s", r.trace.Warp, r.trace.IP, r.trace.Colo))
+	case r.Ready():
+		parts = append(parts, "tunnel up")
+	default:
+		parts = append(parts, "waiting for a handshake")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// announce tells the service manager once both the tunnel and the proxy are
+// ready, r.mu must be held
+func (r *Tracker) announce() {
+	if r.notified || !r.Ready() || len(r.serving) == 0 {
+		if err := sdNotify("STATUS=" + r.status()); err != nil {
+			r.l.Debug("failed to notify service manager", "error", err)
+		}
+		return
+	}
+	r.notified = true
+
+	if err := sdNotify("READY=1\nSTATUS=" + r.status()); err != nil {
+		r.l.Warn("failed to notify service manager", "error", err)
+	}
+	if r.file != "" {
+		if err := os.WriteFile(r.file, []byte(strings.Join(r.serving, "\n")+"\n"), 0o644); err != nil {
+			r.l.Warn("failed to write ready file", "error", err)
+		}
+	}
+	r.l.Info("ready", "serving", r.serving)
+}
+
+// Stopping tells the service manager the service is shutting down and
+// removes the ready file
+func (r *Tracker) Stopping() {
+	_ = sdNotify("STOPPING=1")
+	if r.file != "" {
+		_ = os.Remove(r.file)
+	}
+}
+
+// Watch reports the state of tunnel and pings the systemd watchdog until ctx
+// is done. The watchdog is only pinged while the tunnel is up, so a tunnel
+// that stays down for WatchdogSec gets the service restarted.
+func (r *Tracker) Watch(ctx context.Context, tunnel Tunnel) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+
+	watchdog := watchdogInterval()
+	interval := maxNotifyInterval
+	if watchdog > 0 && watchdog/2 < interval {
+		interval = watchdog / 2
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	wasUp := true
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		up := tunnel.Up()
+		if up != wasUp {
+			state := "STATUS=tunnel is down"
+			if up {
+				r.mu.Lock()
+				state = "STATUS=" + r.status()
+				r.mu.Unlock()
+			}
+			_ = sdNotify(state)
+			wasUp = up
+		}
+		if up && watchdog > 0 {
+			_ = sdNotify("WATCHDOG=1")
+		}
+	}
+}
+
+// watchdogInterval returns the watchdog timeout systemd expects pings
+// within, zero when the watchdog is off or meant for another process
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// sdNotify sends state to the service manager over NOTIFY_SOCKET, it does
+// nothing when the variable is not set
+func sdNotify(state string) error {
+	// a leading @ names a socket in the abstract namespace, net handles it
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,128 @@
+package readiness
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+// notifySocket listens on a temporary NOTIFY_SOCKET and returns a function
+// reading the next state sent to it
+func notifySocket(t *testing.T) func() string {
+	socket := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	qt.Assert(t, err, qt.IsNil)
+	t.Cleanup(func() { _ = conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", socket)
+
+	return func() string {
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 4096)
+		n, err := conn.Read(buf)
+		qt.Assert(t, err, qt.IsNil)
+		return string(buf[:n])
+	}
+}
+
+func TestTracker(t *testing.T) {
+	next := notifySocket(t)
+	file := filepath.Join(t.TempDir(), "ready")
+	r := New(slog.Default(), file)
+
+	r.SetServing("127.0.0.1:8086")
+	qt.Assert(t, next(), qt.Equals, "STATUS=serving on 127.0.0.1:8086, waiting for a handshake")
+	qt.Assert(t, r.Ready(), qt.IsFalse)
+	_, err := os.Stat(file)
+	qt.Assert(t, os.IsNotExist(err), qt.IsTrue)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	qt.Assert(t, r.Wait(ctx), qt.Equals, context.DeadlineExceeded)
+
+	// the first handshake makes the service ready, no trace needed
+	r.SetUp()
+	qt.Assert(t, next(), qt.Equals, "READY=1\nSTATUS=serving on 127.0.0.1:8086, tunnel up")
+	qt.Assert(t, r.Ready(), qt.IsTrue)
+	qt.Assert(t, r.Wait(context.Background()), qt.IsNil)
+	b, err := os.ReadFile(file)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, string(b), qt.Equals, "127.0.0.1:8086\n")
+
+	// later changes only update the status
+	r.SetUp()
+	r.SetTrace(&wiresocks.Trace{Warp: "on", IP: netip.MustParseAddr("192.0.2.1"), Colo: "FRA"})
+	qt.Assert(t, next(), qt.Equals, "STATUS=serving on 127.0.0.1:8086, warp=on ip=192.0.2.1 colo=FRA")
+	r.SetServing("unix:/run/warp.sock")
+	qt.Assert(t, next(), qt.Equals, "STATUS=serving on 127.0.0.1:8086, unix:/run/warp.sock, warp=on ip=192.0.2.1 colo=FRA")
+
+	r.Stopping()
+	qt.Assert(t, next(), qt.Equals, "STOPPING=1")
+	_, err = os.Stat(file)
+	qt.Assert(t, os.IsNotExist(err), qt.IsTrue)
+}
+
+func TestTrackerUpBeforeServing(t *testing.T) {
+	next := notifySocket(t)
+	r := New(slog.Default(), "")
+
+	r.SetUp()
+	qt.Assert(t, next(), qt.Equals, "STATUS=tunnel up")
+	r.SetServing("127.0.0.1:8086")
+	qt.Assert(t, next(), qt.Equals, "READY=1\nSTATUS=serving on 127.0.0.1:8086, tunnel up")
+}
+
+// tunnel is a Tunnel whose state the test sets
+type tunnel chan bool
+
+func (t tunnel) Up() bool { return <-t }
+
+func TestWatch(t *testing.T) {
+	next := notifySocket(t)
+	t.Setenv("WATCHDOG_USEC", "20000")
+	t.Setenv("WATCHDOG_PID", "")
+	r := New(slog.Default(), "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	state := make(tunnel)
+	go r.Watch(ctx, state)
+
+	state <- true
+	qt.Assert(t, next(), qt.Equals, "WATCHDOG=1")
+	// a tunnel that is down gets no watchdog pings
+	state <- false
+	qt.Assert(t, next(), qt.Equals, "STATUS=tunnel is down")
+	state <- true
+	qt.Assert(t, next(), qt.Equals, "STATUS=waiting for a handshake")
+	qt.Assert(t, next(), qt.Equals, "WATCHDOG=1")
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	tests := []struct {
+		usec, pid string
+		want      time.Duration
+	}{
+		{"", "", 0},
+		{"30000000", "", 30 * time.Second},
+		{"30000000", strconv.Itoa(os.Getpid()), 30 * time.Second},
+		// the watchdog of another process
+		{"30000000", strconv.Itoa(os.Getpid() + 1), 0},
+		{"0", "", 0},
+		{"soon", "", 0},
+	}
+	for _, test := range tests {
+		t.Setenv("WATCHDOG_USEC", test.usec)
+		t.Setenv("WATCHDOG_PID", test.pid)
+		qt.Check(t, watchdogInterval(), qt.Equals, test.want, qt.Commentf("WATCHDOG_USEC=%q WATCHDOG_PID=%q", test.usec, test.pid))
+	}
+}
@@ -0,0 +1,18 @@
+package app
+
+// modes of WarpOptions.Readiness
+const (
+	// ReadinessServe serves proxy clients as soon as the tunnel device is up
+	ReadinessServe = "serve"
+	// ReadinessWait opens the proxy only once the tunnel had its first
+	// handshake
+	ReadinessWait = "wait"
+	// ReadinessReject accepts proxy clients but rejects them until the
+	// tunnel had its first handshake
+	ReadinessReject = "reject"
+)
+
+// ReadinessModes lists the valid values of WarpOptions.Readiness
+func ReadinessModes() []string {
+	return []string{ReadinessServe, ReadinessWait, ReadinessReject}
+}
@@ -0,0 +1,103 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/bepass-org/warp-plus/app/readiness"
+	"github.com/bepass-org/warp-plus/psiphon"
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+// DefaultShutdownGrace is how long connections may take to finish on
+// shutdown before they are cut
+const DefaultShutdownGrace = 10 * time.Second
+
+// ErrConnectionsCut is returned by RunWarp when connections were still
+// active after the shutdown grace period and had to be closed
+var ErrConnectionsCut = errors.New("connections were cut after the shutdown grace period")
+
+// service holds what RunWarp started, so it can report readiness and shut
+// everything down in order
+type service struct {
+	l       *slog.Logger
+	ready   *readiness.Tracker
+	drainer *wiresocks.Drainer
+
+	mu      sync.Mutex
+	tunnels []*wiresocks.VirtualTun
+	psiphon []*psiphon.Tunnel
+}
+
+func newService(l *slog.Logger, opts WarpOptions) *service {
+	return &service{
+		l:       l,
+		ready:   readiness.New(l, opts.ReadyFile),
+		drainer: wiresocks.NewDrainer(),
+	}
+}
+
+// addTunnel tracks the connections of tnet for draining and registers it to
+// be closed on shutdown. svc may be nil for tunnels closed by their owner.
+func (svc *service) addTunnel(tnet *wiresocks.VirtualTun) {
+	if svc == nil {
+		return
+	}
+	tnet.Drainer = svc.drainer
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	svc.tunnels = append(svc.tunnels, tnet)
+}
+
+// waitUp marks the service ready once tnet had its first handshake
+func (svc *service) waitUp(ctx context.Context, tnet *wiresocks.VirtualTun) {
+	if tnet.WaitUp(ctx) == nil {
+		svc.ready.SetUp()
+	}
+}
+
+// addPsiphon registers a psiphon tunnel to be stopped on shutdown
+func (svc *service) addPsiphon(tunnel *psiphon.Tunnel) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	svc.psiphon = append(svc.psiphon, tunnel)
+}
+
+// shutdown stops accepting clients, gives the relayed connections grace to
+// finish, then stops everything started by RunWarp through cancel, psiphon
+// and the tunnel devices, newest first. It returns how many connections had
+// to be cut.
+func (svc *service) shutdown(cancel context.CancelFunc, grace time.Duration) int {
+	svc.ready.Stopping()
+
+	if n := svc.drainer.Active(); n > 0 {
+		svc.l.Info("waiting for connections to finish", "connections", n, "grace", grace)
+	}
+	ctx, cancelGrace := context.WithTimeout(context.Background(), grace)
+	cut := svc.drainer.Drain(ctx)
+	if cut > 0 {
+		svc.l.Warn("closed connections still active after the grace period", "connections", cut)
+	}
+	cancelGrace()
+
+	cancel()
+	svc.close()
+	svc.l.Info("shutdown complete")
+	return cut
+}
+
+// close stops psiphon and closes the tunnels
+func (svc *service) close() {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	for _, tunnel := range svc.psiphon {
+		tunnel.Stop()
+	}
+	for i := len(svc.tunnels) - 1; i >= 0; i-- {
+		svc.tunnels[i].Close()
+	}
+	svc.psiphon, svc.tunnels = nil, nil
+}
@@ -0,0 +1,96 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"time"
+
+	"github.com/bepass-org/warp-plus/warp"
+	"github.com/bepass-org/warp-plus/wireguard/tun/netstack"
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+// speedTestUpTimeout bounds how long the tunnels may take to come up
+const speedTestUpTimeout = 30 * time.Second
+
+// SpeedTestOptions configures RunSpeedTest
+type SpeedTestOptions struct {
+	// Endpoints are the warp endpoints, gool needs two
+	Endpoints []string
+	License   string
+	CacheDir  string
+	// Gool measures warp-in-warp instead of a single tunnel
+	Gool bool
+	// MTU overrides the MTU of the primary tunnel, zero keeps the default
+	MTU int
+	// DestFamily picks the address families used to reach the test servers
+	DestFamily netstack.AddressPreference
+	Test       wiresocks.SpeedTestOptions
+}
+
+// RunSpeedTest brings up the tunnel of the selected mode, waits until it
+// passes traffic and measures it with VirtualTun.SpeedTest
+func RunSpeedTest(ctx context.Context, l *slog.Logger, opts SpeedTestOptions) (*wiresocks.SpeedTestResult, error) {
+	if len(opts.Endpoints) == 0 || opts.Gool && len(opts.Endpoints) < 2 {
+		return nil, errors.New("not enough warp endpoints")
+	}
+
+	warpOpts := WarpOptions{License: opts.License, CacheDir: opts.CacheDir, DestFamily: opts.DestFamily}
+	if opts.Gool {
+		if err := createPrimaryAndSecondaryIdentities(l.With("subsystem", "warp/account"), warpOpts); err != nil {
+			return nil, err
+		}
+	} else if err := warp.LoadOrCreateIdentity(l.With("subsystem", "warp/account"), path.Join(opts.CacheDir, "primary"), opts.License); err != nil {
+		return nil, err
+	}
+
+	conf, err := wiresocks.ParseConfig(path.Join(opts.CacheDir, "primary", "wgcf-profile.ini"))
+	if err != nil {
+		return nil, err
+	}
+	conf.Interface.MTU = singleMTU
+	if opts.MTU != 0 {
+		conf.Interface.MTU = opts.MTU
+	}
+
+	for i, peer := range conf.Peers {
+		peer.Endpoint = opts.Endpoints[0]
+		peer.Trick = true
+		peer.KeepAlive = 3
+		conf.Peers[i] = peer
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	tnet, err := wiresocks.StartWireguard(ctx, l, conf)
+	if err != nil {
+		return nil, err
+	}
+	defer tnet.Stop()
+	configureTunnel(tnet, warpOpts)
+
+	upCtx, upCancel := context.WithTimeout(ctx, speedTestUpTimeout)
+	defer upCancel()
+	if err := tnet.WaitUp(upCtx); err != nil {
+		return nil, fmt.Errorf("tunnel did not come up through %s: %w", opts.Endpoints[0], err)
+	}
+
+	if opts.Gool {
+		inner, err := startInnerWarp(ctx, l.With("gool", "inner"), warpOpts, nil, tnet, opts.Endpoints[1])
+		if err != nil {
+			return nil, err
+		}
+		defer inner.Stop()
+		if err := inner.WaitUp(upCtx); err != nil {
+			return nil, fmt.Errorf("inner tunnel did not come up through %s: %w", opts.Endpoints[1], err)
+		}
+		tnet = inner
+	}
+
+	l.Info("running speed test", "endpoints", opts.Endpoints, "gool", opts.Gool, "mtu", conf.Interface.MTU)
+	return tnet.SpeedTest(ctx, opts.Test)
+}
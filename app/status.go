@@ -0,0 +1,203 @@
+package app
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wiresocks"
+)
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>warp-plus</title></head>
+<body>
+<h1>warp-plus</h1>
+<table>
+<tr><td>Mode</td><td>{{.Mode}}</td></tr>
+<tr><td>Endpoint</td><td>{{range $i, $e := .Endpoints}}{{if $i}}, {{end}}{{$e}}{{end}}</td></tr>
+<tr><td>Uptime</td><td>{{.Uptime}}</td></tr>
+{{with .Trace}}<tr><td>WARP</td><td>{{.Warp}}</td></tr>
+<tr><td>Exit IP</td><td>{{.IP}}</td></tr>
+<tr><td>Location</td><td>{{.Loc}} ({{.Colo}})</td></tr>
+{{end}}{{with .TraceError}}<tr><td>WARP</td><td>not verified: {{.}}</td></tr>
+{{end}}</table>
+{{with .Forwarders}}<h2>UDP forwards</h2>
+<table>
+<tr><th>Local</th><th>Destination</th><th>Sessions</th><th>Packets out</th><th>Packets in</th><th>Bytes out</th><th>Bytes in</th><th>Dropped</th></tr>
+{{range .}}<tr><td>{{.Local}}</td><td>{{.Dest}}</td><td>{{.ActiveSessions}} / {{.TotalSessions}}</td><td>{{.PacketsOut}}</td><td>{{.PacketsIn}}</td><td>{{.BytesOut}}</td><td>{{.BytesIn}}</td><td>{{.Dropped}}</td></tr>
+{{end}}</table>
+{{end}}<p>Point your browser or device at <a href="/proxy.pac">/proxy.pac</a> for automatic proxy configuration.</p>
+<p>Run a speed test from this host with <code>curl -X POST</code> on /speedtest, add <code>-u user</code> when the proxy takes credentials.</p>
+</body>
+</html>
+`))
+
+const (
+	// maxSpeedTestStreams caps the streams of a /speedtest request
+	maxSpeedTestStreams = 16
+	// maxSpeedTestDuration caps the duration of a /speedtest request
+	maxSpeedTestDuration = time.Minute
+)
+
+// statusPage is the landing page served on the proxy address. It also runs
+// speed tests through the tunnel for clients on this host.
+type statusPage struct {
+	tnet      *wiresocks.VirtualTun
+	mode      string
+	endpoints []string
+	started   time.Time
+	// tunnels are the tunnels whose UDP forwarders are listed
+	tunnels []*wiresocks.VirtualTun
+
+	// mu guards the endpoint and the trace check result, which change
+	// while running
+	mu       sync.Mutex
+	trace    *wiresocks.Trace
+	traceErr error
+
+	// testing is held while a speed test runs
+	testing sync.Mutex
+}
+
+func newStatusPage(tnet *wiresocks.VirtualTun, mode string, endpoints ...string) *statusPage {
+	return &statusPage{
+		tnet:      tnet,
+		mode:      mode,
+		endpoints: slices.Clone(endpoints),
+		started:   time.Now(),
+		tunnels:   []*wiresocks.VirtualTun{tnet},
+	}
+}
+
+// forwarderStatus is a row of the UDP forwards table
+type forwarderStatus struct {
+	Local netip.AddrPort
+	Dest  string
+	wiresocks.UDPForwarderStats
+}
+
+func (s *statusPage) forwarders() []forwarderStatus {
+	var rows []forwarderStatus
+	for _, vt := range s.tunnels {
+		for _, f := range vt.UDPForwarders() {
+			rows = append(rows, forwarderStatus{Local: f.LocalAddr(), Dest: f.Dest(), UDPForwarderStats: f.Stats()})
+		}
+	}
+	return rows
+}
+
+func (s *statusPage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/speedtest" {
+		s.serveSpeedTest(w, r)
+		return
+	}
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.mu.Lock()
+	data := struct {
+		Mode       string
+		Endpoints  []string
+		Uptime     time.Duration
+		Trace      *wiresocks.Trace
+		TraceError string
+		Forwarders []forwarderStatus
+	}{
+		Mode:       s.mode,
+		Endpoints:  slices.Clone(s.endpoints),
+		Uptime:     time.Since(s.started).Round(time.Second),
+		Trace:      s.trace,
+		Forwarders: s.forwarders(),
+	}
+	if s.traceErr != nil {
+		data.TraceError = s.traceErr.Error()
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_ = statusTemplate.Execute(w, data)
+}
+
+// setEndpoint shows endpoint as the first endpoint after a failover
+func (s *statusPage) setEndpoint(endpoint string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.endpoints[0] = endpoint
+}
+
+// setTrace shows the result of the latest trace check
+func (s *statusPage) setTrace(trace *wiresocks.Trace, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.trace, s.traceErr = trace, err
+	if err != nil {
+		s.trace = nil
+	}
+}
+
+// serveSpeedTest runs a speed test on POST and answers with the result as
+// JSON. The query may set download, upload and latency URLs, streams and a
+// duration per direction, larger values are lowered to the caps. Only clients on this host may
+// start one, it uses a lot of bandwidth. With credentials the proxy already
+// made them authenticate. Browsers send an Origin with every POST, so a
+// request carrying one is refused to keep web pages from starting tests.
+func (s *statusPage) serveSpeedTest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "use POST to start a speed test", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Header.Get("Origin") != "" {
+		http.Error(w, "speed tests can not be started from a web page", http.StatusForbidden)
+		return
+	}
+	// unix socket clients have no address and are guarded by the socket mode
+	if addr, err := netip.ParseAddrPort(r.RemoteAddr); err == nil && !addr.Addr().Unmap().IsLoopback() {
+		http.Error(w, "speed tests can only be started from this host", http.StatusForbidden)
+		return
+	}
+	if !s.testing.TryLock() {
+		http.Error(w, "a speed test is already running", http.StatusConflict)
+		return
+	}
+	defer s.testing.Unlock()
+
+	q := r.URL.Query()
+	opts := wiresocks.SpeedTestOptions{
+		DownloadURL: q.Get("download"),
+		UploadURL:   q.Get("upload"),
+		LatencyURL:  q.Get("latency"),
+	}
+	if v := q.Get("streams"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "invalid streams", http.StatusBadRequest)
+			return
+		}
+		opts.Streams = min(n, maxSpeedTestStreams)
+	}
+	if v := q.Get("duration"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid duration", http.StatusBadRequest)
+			return
+		}
+		opts.Duration = min(d, maxSpeedTestDuration)
+	}
+
+	result, err := s.tnet.SpeedTest(r.Context(), opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(result)
+}
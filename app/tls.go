@@ -0,0 +1,121 @@
+package app
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	tlsCertFile = "cert.pem"
+	tlsKeyFile  = "key.pem"
+	// selfSignedValidity is long on purpose, clients pin the persisted
+	// certificate and should not have to trust a new one every year
+	selfSignedValidity = 10 * 365 * 24 * time.Hour
+)
+
+type TLSOptions struct {
+	// CertFile and KeyFile point to a PEM encoded certificate and key, when
+	// empty a self-signed certificate is generated in the cache directory
+	CertFile string
+	KeyFile  string
+}
+
+// loadTLSConfig returns the server config of the TLS wrapped proxy inbound
+func loadTLSConfig(l *slog.Logger, opts WarpOptions) (*tls.Config, error) {
+	certFile, keyFile := opts.TLS.CertFile, opts.TLS.KeyFile
+	if certFile == "" && keyFile == "" {
+		dir := filepath.Join(opts.CacheDir, "tls")
+		certFile, keyFile = filepath.Join(dir, tlsCertFile), filepath.Join(dir, tlsKeyFile)
+		if err := createSelfSigned(l, dir, opts.Bind); err != nil {
+			return nil, err
+		}
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tls certificate: %w", err)
+	}
+	fingerprint := sha256.Sum256(cert.Certificate[0])
+	l.Info("loaded tls certificate", "file", certFile, "sha256", hex.EncodeToString(fingerprint[:]))
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// createSelfSigned generates a certificate and key in dir unless they exist
+func createSelfSigned(l *slog.Logger, dir string, bind netip.AddrPort) error {
+	certPath, keyPath := filepath.Join(dir, tlsCertFile), filepath.Join(dir, tlsKeyFile)
+	if _, err := os.Stat(certPath); err == nil {
+		return nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "warp-plus"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	if ip := bind.Addr(); ip.IsValid() && !ip.IsUnspecified() && !ip.IsLoopback() {
+		template.IPAddresses = append(template.IPAddresses, ip.AsSlice())
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		return err
+	}
+
+	l.Info("generated self-signed tls certificate", "file", certPath)
+	return nil
+}
@@ -62,6 +62,7 @@ func (h *WarpPing) PingContext(_ context.Context) statute.IPingResult {
 		h.PrivateKey,
 		h.PeerPublicKey,
 		h.PresharedKey,
+		true,
 	)
 	if err != nil {
 		return h.errorResult(err)
@@ -125,7 +126,14 @@ func randomInt(min, max int) int {
 	return int(nBig.Int64()) + min
 }
 
-func initiateHandshake(serverAddr netip.AddrPort, privateKeyBase64, peerPublicKeyBase64, presharedKeyBase64 string) (time.Duration, error) {
+// Handshake sends a WireGuard handshake initiation to serverAddr and returns
+// the round trip time of the response. With trick a few random packets are
+// sent first, the way peers with the trick option start their handshakes.
+func Handshake(serverAddr netip.AddrPort, privateKeyBase64, peerPublicKeyBase64, presharedKeyBase64 string, trick bool) (time.Duration, error) {
+	return initiateHandshake(serverAddr, privateKeyBase64, peerPublicKeyBase64, presharedKeyBase64, trick)
+}
+
+func initiateHandshake(serverAddr netip.AddrPort, privateKeyBase64, peerPublicKeyBase64, presharedKeyBase64 string, trick bool) (time.Duration, error) {
 	staticKeyPair, err := staticKeypair(privateKeyBase64)
 	if err != nil {
 		return 0, err
@@ -207,25 +215,27 @@ func initiateHandshake(serverAddr netip.AddrPort, privateKeyBase64, peerPublicKe
 	}
 	defer conn.Close()
 
-	// Generate a random number of packets between 5 and 10
-	numPackets := randomInt(1, 2)
-	for i := 0; i < numPackets; i++ {
-		// Generate a random packet size between 10 and 40 bytes
-		packetSize := randomInt(1, 100)
-		randomPacket := make([]byte, packetSize)
-		_, err := rand.Read(randomPacket)
-		if err != nil {
-			return 0, fmt.Errorf("error generating random packet: %w", err)
+	if trick {
+		// Generate a random number of packets between 5 and 10
+		numPackets := randomInt(1, 2)
+		for i := 0; i < numPackets; i++ {
+			// Generate a random packet size between 10 and 40 bytes
+			packetSize := randomInt(1, 100)
+			randomPacket := make([]byte, packetSize)
+			_, err := rand.Read(randomPacket)
+			if err != nil {
+				return 0, fmt.Errorf("error generating random packet: %w", err)
+			}
+
+			// Send the random packet
+			_, err = conn.Write(randomPacket)
+			if err != nil {
+				return 0, fmt.Errorf("error sending random packet: %w", err)
+			}
+
+			// Wait for a random duration between 200 and 500 milliseconds
+			time.Sleep(time.Duration(randomInt(200, 500)) * time.Millisecond)
 		}
-
-		// Send the random packet
-		_, err = conn.Write(randomPacket)
-		if err != nil {
-			return 0, fmt.Errorf("error sending random packet: %w", err)
-		}
-
-		// Wait for a random duration between 200 and 500 milliseconds
-		time.Sleep(time.Duration(randomInt(200, 500)) * time.Millisecond)
 	}
 
 	_, err = initiationPacket.WriteTo(conn)
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/bepass-org/warp-plus/ipscanner/internal/engine"
+	"github.com/bepass-org/warp-plus/ipscanner/internal/ping"
 	"github.com/bepass-org/warp-plus/ipscanner/internal/statute"
 )
 
@@ -268,3 +269,10 @@ func (i *IPScanner) GetAvailableIPs() []statute.IPInfo {
 }
 
 type IPInfo = statute.IPInfo
+
+// WarpHandshake performs a single WireGuard handshake with addr the way the
+// warp scanner does and returns its round trip time. trick sends a few random
+// packets before the initiation.
+func WarpHandshake(addr netip.AddrPort, privateKey, peerPublicKey, presharedKey string, trick bool) (time.Duration, error) {
+	return ping.Handshake(addr, privateKey, peerPublicKey, presharedKey, trick)
+}
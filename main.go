@@ -2,13 +2,17 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/netip"
 	"os"
 	"os/signal"
 	"path"
+	"slices"
+	"strings"
 	"syscall"
 	"time"
 
@@ -16,7 +20,12 @@ import (
 
 	"github.com/adrg/xdg"
 	"github.com/bepass-org/warp-plus/app"
+	"github.com/bepass-org/warp-plus/app/doctor"
+	"github.com/bepass-org/warp-plus/proxy/pkg/mixed"
+	"github.com/bepass-org/warp-plus/proxy/pkg/shadowsocks"
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
 	"github.com/bepass-org/warp-plus/warp"
+	"github.com/bepass-org/warp-plus/wireguard/tun/netstack"
 	"github.com/bepass-org/warp-plus/wiresocks"
 
 	"github.com/carlmjohnson/versioninfo"
@@ -64,6 +73,14 @@ var psiphonCountries = []string{
 
 var version string = ""
 
+// exitConnectionsCut is the exit status of a shutdown that had to cut
+// connections still active after the grace period
+const exitConnectionsCut = 2
+
+// endpointFallbacks is how many random endpoints the tunnel may fail over to
+// when the endpoint it started with does not work
+const endpointFallbacks = 3
+
 func main() {
 	fs := ff.NewFlagSet(appName)
 	var (
@@ -79,19 +96,86 @@ func main() {
 		scan     = fs.BoolLong("scan", "enable warp scanning")
 		rtt      = fs.DurationLong("rtt", 1000*time.Millisecond, "scanner rtt limit")
 		cacheDir = fs.StringLong("cache-dir", "", "directory to store generated profiles")
+		listen   = fs.StringListLong("listen", "also serve the proxy on [socks|socks5|socks4|http,...@]host:port or unix:path[:mode] (can be repeated)")
+		auth     = fs.StringListLong("auth", "require proxy authentication as user:password (can be repeated)")
+		allow    = fs.StringListLong("allow", "only accept proxy clients from this address or CIDR (can be repeated)")
+		deny     = fs.StringListLong("deny", "reject proxy clients from this address or CIDR (can be repeated)")
+		maxConns = fs.IntLong("max-client-conns", 0, "limit concurrent proxy connections per client address (0 means unlimited)")
+		maxTotal = fs.IntLong("max-conns", 0, "limit concurrent proxy connections of all clients (0 means unlimited)")
+		grace    = fs.DurationLong("shutdown-grace", app.DefaultShutdownGrace, "on shutdown, let connections finish for this long before closing them, 0 closes them right away")
+		hsTime   = fs.DurationLong("handshake-timeout", mixed.DefaultHandshakeTimeout, "drop proxy clients that send nothing for this long after connecting")
+		tcpIdle  = fs.DurationLong("tcp-idle-timeout", wiresocks.DefaultTCPIdleTimeout, "close relayed tcp connections without traffic in either direction for this long")
+		tcpLife  = fs.DurationLong("tcp-max-lifetime", 0, "close relayed tcp connections after this long regardless of traffic (0 means unlimited)")
+		udpIdle  = fs.DurationLong("udp-idle-timeout", statute.DefaultUDPIdleTimeout, "forget udp destinations without traffic for this long")
+		udpLife  = fs.DurationLong("udp-max-lifetime", 0, "close udp associations and forward sessions after this long (0 means unlimited)")
+		destFam  = fs.StringEnumLong("dest-family", fmt.Sprintf("address families for destinations inside the tunnel (valid values: %s)", netstack.AddressPreferences()), netstack.AddressPreferences()...)
+		ppFrom   = fs.StringListLong("proxy-protocol-from", "expect a PROXY protocol header from this balancer address or CIDR (can be repeated)")
+		bypass   = fs.StringListLong("pac-bypass", "domain or CIDR the served PAC file sends directly (can be repeated)")
+		tlsFlag  = fs.BoolLong("tls", "also accept TLS wrapped proxy clients (HTTPS proxy, SOCKS over TLS)")
+		tlsCert  = fs.StringLong("tls-cert", "", "PEM certificate for --tls (default: self-signed certificate in the cache directory)")
+		tlsKey   = fs.StringLong("tls-key", "", "PEM private key for --tls-cert")
+		ssBind   = fs.StringLong("ss-bind", "", "serve shadowsocks (tcp and udp) on this address")
+		ssMethod = fs.StringEnumLong("ss-method", fmt.Sprintf("shadowsocks cipher (valid values: %s)", shadowsocks.Methods()), shadowsocks.Methods()...)
+		ssPass   = fs.StringLong("ss-password", "", "shadowsocks password, base64 key for 2022 methods")
+		forwards = fs.StringListLong("forward", "forward [tcp/|udp/]local:port=host:port through the tunnel (can be repeated)")
+		down     = fs.StringListLong("tunnel-down", "while the tunnel is down, handle destinations as domain|CIDR|*=fail|direct|queue[:duration] (can be repeated, first match wins)")
+		downAft  = fs.DurationLong("tunnel-down-after", wiresocks.DefaultDownAfter, "count the tunnel as down once its last handshake is this old")
+		resolve  = fs.StringListLong("resolve", "resolve destination names under a domain (or *) on this host or inside the tunnel as domain=local|remote (can be repeated, first match wins)")
+		traceURL = fs.StringLong("trace-url", wiresocks.DefaultTraceURL, "cloudflare trace endpoint fetched through the tunnel to verify warp")
+		readyMod = fs.StringEnumLong("readiness", fmt.Sprintf("serve, hold off (wait) or reject proxy clients until the first handshake (valid values: %s)", app.ReadinessModes()), app.ReadinessModes()...)
+		readyFil = fs.StringLong("ready-file", "", "create this file with the proxy addresses once ready, removed on exit")
+		routes   = fs.StringListLong("route", "send an authenticated user through an outbound as user=warp|gool|direct|psiphon:<country> (can be repeated)")
 		_        = fs.String('c', "config", "", "path to config file")
 		verFlag  = fs.BoolLong("version", "displays version number")
 	)
 
-	err := ff.Parse(
-		fs,
+	ncFS := ff.NewFlagSet("nc").SetParent(fs)
+	ncUDP := ncFS.BoolLong("udp", "send every read from stdin as a UDP datagram")
+	ncCmd := &ff.Command{
+		Name:      "nc",
+		Usage:     appName + " nc [FLAGS] <host> <port>",
+		ShortHelp: "pipe stdin and stdout to host:port through warp, e.g. as ssh ProxyCommand",
+		Flags:     ncFS,
+	}
+	doctorFS := ff.NewFlagSet("doctor").SetParent(fs)
+	doctorJSON := doctorFS.StringLong("json", "", "also write the report as JSON to this file for bug reports, - prints only the JSON to stdout")
+	doctorCmd := &ff.Command{
+		Name:      "doctor",
+		Usage:     appName + " doctor [FLAGS]",
+		ShortHelp: "check the network for what warp needs and print a report",
+		Flags:     doctorFS,
+	}
+	speedFS := ff.NewFlagSet("speedtest").SetParent(fs)
+	var (
+		speedDown     = speedFS.StringLong("download-url", wiresocks.DefaultSpeedTestDownloadURL, "URL fetched repeatedly for the download test")
+		speedUp       = speedFS.StringLong("upload-url", wiresocks.DefaultSpeedTestUploadURL, "URL posted to for the upload test, - skips it")
+		speedLatency  = speedFS.StringLong("latency-url", wiresocks.DefaultSpeedTestLatencyURL, "URL with a short answer for the latency test")
+		speedStreams  = speedFS.IntLong("streams", 4, "parallel connections per direction")
+		speedDuration = speedFS.DurationLong("duration", 10*time.Second, "how long each direction is measured")
+		speedMTU      = speedFS.IntLong("mtu", 0, "MTU of the primary tunnel (default: the MTU of a normal run)")
+		speedJSON     = speedFS.BoolLong("json", "print the result as JSON")
+	)
+	speedCmd := &ff.Command{
+		Name:      "speedtest",
+		Usage:     appName + " speedtest [FLAGS]",
+		ShortHelp: "measure latency and throughput through warp, also with --gool",
+		Flags:     speedFS,
+	}
+	root := &ff.Command{
+		Name:        appName,
+		Usage:       appName + " [FLAGS] [SUBCOMMAND]",
+		Flags:       fs,
+		Subcommands: []*ff.Command{ncCmd, doctorCmd, speedCmd},
+	}
+
+	err := root.Parse(
 		os.Args[1:],
 		ff.WithConfigFileFlag("config"),
 		ff.WithConfigFileParser(ffjson.Parse),
 	)
 	switch {
 	case errors.Is(err, ff.ErrHelp):
-		fmt.Fprintf(os.Stderr, "%s\n", ffhelp.Flags(fs))
+		fmt.Fprintf(os.Stderr, "%s\n", ffhelp.Command(root.GetSelected()))
 		os.Exit(0)
 	case err != nil:
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
@@ -112,6 +196,53 @@ func main() {
 		l = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
 	}
 
+	if root.GetSelected() == ncCmd {
+		// stdout carries the connection, so only warnings are logged to stderr
+		level := slog.LevelWarn
+		if *verbose {
+			level = slog.LevelDebug
+		}
+		l = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+		runNetcat(l, ncFS.GetArgs(), *ncUDP, *endpoint, *key, cacheDirectory(*cacheDir), *v4, *v6, destFamily(l, *destFam))
+		return
+	}
+
+	if root.GetSelected() == doctorCmd {
+		// the report goes to stdout, logs only distract from it
+		level := slog.LevelWarn
+		if *verbose {
+			level = slog.LevelDebug
+		}
+		l = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+		runDoctor(l, *doctorJSON, *endpoint, *key, cacheDirectory(*cacheDir), *v4, *v6)
+		return
+	}
+
+	if root.GetSelected() == speedCmd {
+		// keep stdout for the result
+		level := slog.LevelInfo
+		if *verbose {
+			level = slog.LevelDebug
+		}
+		l = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+		opts := app.SpeedTestOptions{
+			License:    *key,
+			CacheDir:   cacheDirectory(*cacheDir),
+			Gool:       *gool,
+			MTU:        *speedMTU,
+			DestFamily: destFamily(l, *destFam),
+			Test: wiresocks.SpeedTestOptions{
+				DownloadURL: *speedDown,
+				UploadURL:   *speedUp,
+				LatencyURL:  *speedLatency,
+				Streams:     *speedStreams,
+				Duration:    *speedDuration,
+			},
+		}
+		runSpeedTest(l, opts, *endpoint, *v4, *v6, *speedJSON)
+		return
+	}
+
 	if *psiphon && *gool {
 		fatal(l, errors.New("can't use cfon and gool at the same time"))
 	}
@@ -136,16 +267,111 @@ func main() {
 		Gool:     *gool,
 	}
 
-	switch {
-	case *cacheDir != "":
-		opts.CacheDir = *cacheDir
-	case xdg.CacheHome != "":
-		opts.CacheDir = path.Join(xdg.CacheHome, appName)
-	case os.Getenv("HOME") != "":
-		opts.CacheDir = path.Join(os.Getenv("HOME"), ".cache", appName)
-	default:
-		opts.CacheDir = "warp_plus_cache"
+	if len(*auth) > 0 {
+		opts.Credentials = make(map[string]string, len(*auth))
+		for _, entry := range *auth {
+			user, password, ok := strings.Cut(entry, ":")
+			if !ok || user == "" {
+				fatal(l, fmt.Errorf("invalid auth entry %q, expected user:password", entry))
+			}
+			opts.Credentials[user] = password
+		}
+	}
+
+	if opts.AllowClients, err = parsePrefixes(*allow); err != nil {
+		fatal(l, fmt.Errorf("invalid allow entry: %w", err))
+	}
+	if opts.DenyClients, err = parsePrefixes(*deny); err != nil {
+		fatal(l, fmt.Errorf("invalid deny entry: %w", err))
+	}
+	if opts.ProxyProtocol, err = parsePrefixes(*ppFrom); err != nil {
+		fatal(l, fmt.Errorf("invalid proxy-protocol-from entry: %w", err))
+	}
+	opts.MaxClientConns = *maxConns
+	opts.MaxConns = *maxTotal
+	opts.HandshakeTimeout = *hsTime
+	opts.PACBypass = *bypass
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		fatal(l, errors.New("--tls-cert and --tls-key must be used together"))
+	}
+	if *tlsFlag {
+		opts.TLS = &app.TLSOptions{CertFile: *tlsCert, KeyFile: *tlsKey}
+	}
+
+	if *ssBind != "" {
+		ssAddrPort, err := netip.ParseAddrPort(*ssBind)
+		if err != nil {
+			fatal(l, fmt.Errorf("invalid shadowsocks bind address: %w", err))
+		}
+		if _, err := shadowsocks.NewCipher(*ssMethod, *ssPass); err != nil {
+			fatal(l, err)
+		}
+		if *ssPass == "" {
+			fatal(l, errors.New("shadowsocks needs a password"))
+		}
+		opts.Shadowsocks = &app.ShadowsocksOptions{Bind: ssAddrPort, Method: *ssMethod, Password: *ssPass}
+	}
+
+	for _, entry := range *forwards {
+		forward, err := wiresocks.ParseForward(entry)
+		if err != nil {
+			fatal(l, err)
+		}
+		opts.Forwards = append(opts.Forwards, forward)
+	}
+
+	opts.DestFamily = destFamily(l, *destFam)
+
+	opts.Timeouts = wiresocks.RelayTimeouts{
+		TCP: wiresocks.Timeouts{Idle: *tcpIdle, MaxLifetime: *tcpLife},
+		UDP: wiresocks.Timeouts{Idle: *udpIdle, MaxLifetime: *udpLife},
+	}
+
+	for _, entry := range *listen {
+		listener, err := wiresocks.ParseProxyListener(entry)
+		if err != nil {
+			fatal(l, err)
+		}
+		opts.Listeners = append(opts.Listeners, listener)
+	}
+
+	for _, entry := range *down {
+		policy, err := wiresocks.ParseDownPolicy(entry)
+		if err != nil {
+			fatal(l, err)
+		}
+		opts.DownPolicies = append(opts.DownPolicies, policy)
 	}
+	opts.DownAfter = *downAft
+
+	for _, entry := range *resolve {
+		policy, err := wiresocks.ParseResolvePolicy(entry)
+		if err != nil {
+			fatal(l, err)
+		}
+		opts.ResolvePolicies = append(opts.ResolvePolicies, policy)
+	}
+
+	if len(*routes) > 0 {
+		opts.Routes = make(map[string]string, len(*routes))
+		for _, entry := range *routes {
+			user, outbound, ok := strings.Cut(entry, "=")
+			if !ok || user == "" {
+				fatal(l, fmt.Errorf("invalid route %q, expected user=outbound", entry))
+			}
+			if country, ok := strings.CutPrefix(outbound, app.OutboundPsiphonPrefix); ok && !slices.Contains(psiphonCountries, country) {
+				fatal(l, fmt.Errorf("invalid psiphon country %q in route for %q", country, user))
+			}
+			opts.Routes[user] = outbound
+		}
+	}
+
+	opts.CacheDir = cacheDirectory(*cacheDir)
+	opts.TraceURL = *traceURL
+	opts.ShutdownGrace = grace
+	opts.Readiness = *readyMod
+	opts.ReadyFile = *readyFil
 
 	if *psiphon {
 		l.Info("psiphon mode enabled", "country", *country)
@@ -165,18 +391,237 @@ func main() {
 		}
 		opts.Endpoint = addrPort.String()
 	}
+	for len(opts.Fallbacks) < endpointFallbacks {
+		addrPort, err := warp.RandomWarpEndpoint(*v4, *v6)
+		if err != nil {
+			fatal(l, err)
+		}
+		if endpoint := addrPort.String(); endpoint != opts.Endpoint && !slices.Contains(opts.Fallbacks, endpoint) {
+			opts.Fallbacks = append(opts.Fallbacks, endpoint)
+		}
+	}
+
+	if err := app.RunWarp(shutdownContext(l), l, opts); err != nil {
+		if errors.Is(err, app.ErrConnectionsCut) {
+			// the shutdown went through but was not clean
+			l.Warn(err.Error())
+			os.Exit(exitConnectionsCut)
+		}
+		fatal(l, err)
+	}
+}
+
+// shutdownContext is canceled by the first SIGINT or SIGTERM, which starts a
+// graceful shutdown. A second signal exits right away with the status of a
+// process killed by it.
+func shutdownContext(l *slog.Logger) context.Context {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
 
-	ctx, _ := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
-		if err := app.RunWarp(ctx, l, opts); err != nil {
-			fatal(l, err)
+		sig := <-signals
+		l.Info("received signal, shutting down (repeat to force)", "signal", sig)
+		cancel()
+
+		sig = <-signals
+		l.Warn("received signal again, exiting now", "signal", sig)
+		code := 1
+		if s, ok := sig.(syscall.Signal); ok {
+			code = 128 + int(s)
 		}
+		os.Exit(code)
 	}()
+	return ctx
+}
+
+// runNetcat pipes stdin and stdout to the host and port in args through the
+// tunnel and exits
+func runNetcat(l *slog.Logger, args []string, udp bool, endpoint, key, cacheDir string, v4, v6 bool, family netstack.AddressPreference) {
+	if len(args) != 2 {
+		fatal(l, errors.New("nc needs a host and a port"))
+	}
+
+	if !v4 && !v6 {
+		v4, v6 = true, true
+	}
+	random := func() string {
+		addrPort, err := warp.RandomWarpEndpoint(v4, v6)
+		if err != nil {
+			fatal(l, err)
+		}
+		return addrPort.String()
+	}
+
+	// prefer the endpoint that worked last time over a random one, which
+	// stays the fallback in case it stopped working
+	var fallback string
+	if endpoint == "" {
+		if last, ok := app.LastEndpoint(cacheDir); ok {
+			endpoint, fallback = last, random()
+		} else {
+			endpoint = random()
+		}
+	}
+
+	opts := app.NetcatOptions{
+		Endpoint: endpoint,
+		Fallback: fallback,
+		License:  key,
+		CacheDir: cacheDir,
+		Network:  "tcp",
+		Address:  net.JoinHostPort(args[0], args[1]),
+
+		DestFamily: family,
+	}
+	if udp {
+		opts.Network = "udp"
+	}
+
+	ctx, stop := signalContext()
+	defer stop()
+	if err := app.RunNetcat(ctx, l, opts, os.Stdin, os.Stdout); err != nil {
+		fatal(l, err)
+	}
+}
+
+// runSpeedTest measures the tunnel and prints the result
+func runSpeedTest(l *slog.Logger, opts app.SpeedTestOptions, endpoint string, v4, v6, asJSON bool) {
+	if v4 && v6 {
+		fatal(l, errors.New("can't force v4 and v6 at the same time"))
+	}
+	if !v4 && !v6 {
+		v4, v6 = true, true
+	}
+	if opts.MTU != 0 && (opts.MTU < 1280 || opts.MTU > 1500) {
+		fatal(l, fmt.Errorf("invalid mtu %d, must be between 1280 and 1500", opts.MTU))
+	}
+
+	if endpoint == "" {
+		addrPort, err := warp.RandomWarpEndpoint(v4, v6)
+		if err != nil {
+			fatal(l, err)
+		}
+		endpoint = addrPort.String()
+	}
+	opts.Endpoints = []string{endpoint, endpoint}
+
+	ctx, stop := signalContext()
+	defer stop()
+	result, err := app.RunSpeedTest(ctx, l, opts)
+	if err != nil {
+		fatal(l, err)
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(result); err != nil {
+			fatal(l, err)
+		}
+		return
+	}
+	fmt.Println(result)
+}
+
+// runDoctor runs the diagnostics and prints the report, as JSON as well when
+// jsonPath is set
+func runDoctor(l *slog.Logger, jsonPath, endpoint, key, cacheDir string, v4, v6 bool) {
+	if v4 && v6 {
+		fatal(l, errors.New("can't force v4 and v6 at the same time"))
+	}
+	if !v4 && !v6 {
+		v4, v6 = true, true
+	}
+
+	ctx, stop := signalContext()
+	defer stop()
+	fmt.Fprintln(os.Stderr, "running checks, this takes up to a minute...")
+	report := app.RunDoctor(ctx, l, doctor.Options{
+		Endpoint: endpoint,
+		License:  key,
+		CacheDir: cacheDir,
+		V4:       v4,
+		V6:       v6,
+	})
+	if version == "" {
+		version = versioninfo.Short()
+	}
+	report.Version = version
 
-	<-ctx.Done()
+	if jsonPath == "-" {
+		// stdout stays parseable
+		if err := report.WriteJSON(os.Stdout); err != nil {
+			fatal(l, err)
+		}
+		return
+	}
+
+	report.Print(os.Stdout)
+	if jsonPath == "" {
+		return
+	}
+	f, err := os.Create(jsonPath)
+	if err != nil {
+		fatal(l, err)
+	}
+	defer f.Close()
+	if err := report.WriteJSON(f); err != nil {
+		fatal(l, err)
+	}
+	fmt.Fprintf(os.Stderr, "report saved to %s\n", jsonPath)
+}
+
+// cacheDirectory returns the directory for profiles and state, dir when set
+func cacheDirectory(dir string) string {
+	switch {
+	case dir != "":
+		return dir
+	case xdg.CacheHome != "":
+		return path.Join(xdg.CacheHome, appName)
+	case os.Getenv("HOME") != "":
+		return path.Join(os.Getenv("HOME"), ".cache", appName)
+	default:
+		return "warp_plus_cache"
+	}
+}
+
+// destFamily parses the --dest-family value, the enum flag already rejected
+// unknown names
+func destFamily(l *slog.Logger, name string) netstack.AddressPreference {
+	family, err := netstack.ParseAddressPreference(name)
+	if err != nil {
+		fatal(l, err)
+	}
+	return family
+}
+
+// signalContext returns a context canceled by SIGINT or SIGTERM. Only the
+// first signal is caught, a second one kills the process as usual.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	context.AfterFunc(ctx, stop)
+	return ctx, stop
 }
 
 func fatal(l *slog.Logger, err error) {
 	l.Error(err.Error())
 	os.Exit(1)
 }
+
+// parsePrefixes parses a list of CIDRs, a bare address is taken as a single host
+func parsePrefixes(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		if addr, err := netip.ParseAddr(entry); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
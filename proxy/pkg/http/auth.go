@@ -0,0 +1,275 @@
+package http
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+)
+
+const (
+	defaultRealm = "proxy"
+	// nonceLifetime is how long a digest nonce stays valid before the client
+	// is asked to retry with a fresh one
+	nonceLifetime = 5 * time.Minute
+	// maxTrackedNonces bounds the nonce counts kept to detect replays
+	maxTrackedNonces = 4096
+)
+
+// authHeaders are the status and headers of an authentication challenge
+type authHeaders struct {
+	status      int
+	challenge   string
+	credentials string
+}
+
+var (
+	// proxyAuth challenges proxy requests
+	proxyAuth = authHeaders{http.StatusProxyAuthRequired, "Proxy-Authenticate", "Proxy-Authorization"}
+	// originAuth challenges requests addressed to the proxy itself, such as
+	// the status page, which browsers answer like any web server
+	originAuth = authHeaders{http.StatusUnauthorized, "WWW-Authenticate", "Authorization"}
+)
+
+// digestAuth issues and verifies digest nonces. A nonce is the issue time
+// followed by an HMAC of it, so issuing one keeps no state. The highest nonce
+// count accepted for each nonce is tracked, so a captured header cannot be
+// replayed while its nonce is still valid.
+type digestAuth struct {
+	secret [32]byte
+
+	mu     sync.Mutex
+	counts map[string]nonceCount
+	// forgotten is the newest issue time of a nonce whose count was evicted,
+	// such nonces and older untracked ones are answered as stale
+	forgotten time.Time
+}
+
+type nonceCount struct {
+	issued time.Time
+	nc     uint64
+}
+
+func newDigestAuth() *digestAuth {
+	d := &digestAuth{counts: make(map[string]nonceCount)}
+	if _, err := rand.Read(d.secret[:]); err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func (d *digestAuth) sign(ts []byte) []byte {
+	mac := hmac.New(sha256.New, d.secret[:])
+	mac.Write(ts)
+	return mac.Sum(nil)[:16]
+}
+
+func (d *digestAuth) nonce() string {
+	buf := make([]byte, 8, 24)
+	binary.BigEndian.PutUint64(buf, uint64(time.Now().Unix()))
+	return base64.RawURLEncoding.EncodeToString(append(buf, d.sign(buf)...))
+}
+
+// checkNonce reports whether nonce was issued by us and when
+func (d *digestAuth) checkNonce(nonce string) (issued time.Time, valid bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(raw) != 24 {
+		return time.Time{}, false
+	}
+	if !hmac.Equal(raw[8:], d.sign(raw[:8])) {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(binary.BigEndian.Uint64(raw[:8])), 0), true
+}
+
+// useCount records nc as the nonce count of nonce. It fails when nc does not
+// increase the highest count seen, and reports stale when the count of nonce
+// may have been evicted, so the client retries with a fresh nonce.
+func (d *digestAuth) useCount(nonce string, issued time.Time, nc uint64) (ok, stale bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	last, found := d.counts[nonce]
+	switch {
+	case found && nc <= last.nc:
+		return false, false
+	case !found && !issued.After(d.forgotten):
+		return false, true
+	case !found && len(d.counts) >= maxTrackedNonces:
+		d.evict()
+	}
+	d.counts[nonce] = nonceCount{issued: issued, nc: nc}
+	return true, false
+}
+
+// evict drops the counts of expired nonces, or the oldest count when none
+// expired, d.mu must be held
+func (d *digestAuth) evict() {
+	var oldest string
+	for nonce, count := range d.counts {
+		if time.Since(count.issued) > nonceLifetime {
+			delete(d.counts, nonce)
+			continue
+		}
+		if oldest == "" || count.issued.Before(d.counts[oldest].issued) {
+			oldest = nonce
+		}
+	}
+	if len(d.counts) < maxTrackedNonces || oldest == "" {
+		return
+	}
+	if issued := d.counts[oldest].issued; issued.After(d.forgotten) {
+		d.forgotten = issued
+	}
+	delete(d.counts, oldest)
+}
+
+// authenticate checks the credentials header of req against the server
+// credentials. It returns the user name on success and whether a digest
+// nonce was rejected only because it had expired.
+func (s *Server) authenticate(req *http.Request, h authHeaders) (user string, ok, stale bool) {
+	header := req.Header.Get(h.credentials)
+	scheme, params, found := strings.Cut(header, " ")
+	if !found {
+		return "", false, false
+	}
+
+	switch strings.ToLower(scheme) {
+	case "basic":
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(params))
+		if err != nil {
+			return "", false, false
+		}
+		user, password, found := strings.Cut(string(decoded), ":")
+		if !found || !statute.ValidCredentials(s.Credentials, user, password) {
+			return "", false, false
+		}
+		return user, true, false
+	case "digest":
+		return s.checkDigest(req, parseDigestParams(params))
+	default:
+		return "", false, false
+	}
+}
+
+func (s *Server) checkDigest(req *http.Request, p map[string]string) (string, bool, bool) {
+	user := p["username"]
+	password, found := s.Credentials.Password(user)
+	// some clients put the origin-form of the target in uri instead of the
+	// absolute form of the request line, accept both
+	if !found || p["realm"] != s.Realm || (p["uri"] != req.RequestURI && p["uri"] != req.URL.RequestURI()) {
+		return "", false, false
+	}
+
+	issued, valid := s.digest.checkNonce(p["nonce"])
+	if !valid {
+		return "", false, false
+	}
+
+	var newHash func() hash.Hash
+	switch strings.ToUpper(p["algorithm"]) {
+	case "", "MD5":
+		newHash = md5.New
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		return "", false, false
+	}
+	h := func(parts ...string) string {
+		sum := newHash()
+		sum.Write([]byte(strings.Join(parts, ":")))
+		return hex.EncodeToString(sum.Sum(nil))
+	}
+
+	ha1 := h(user, s.Realm, password)
+	ha2 := h(req.Method, p["uri"])
+	var want string
+	// without qop there is no nonce count, such a nonce can be used once
+	nc := uint64(1)
+	switch p["qop"] {
+	case "":
+		want = h(ha1, p["nonce"], ha2)
+	case "auth":
+		var err error
+		if nc, err = strconv.ParseUint(p["nc"], 16, 64); err != nil {
+			return "", false, false
+		}
+		want = h(ha1, p["nonce"], p["nc"], p["cnonce"], p["qop"], ha2)
+	default:
+		return "", false, false
+	}
+
+	if subtle.ConstantTimeCompare([]byte(want), []byte(strings.ToLower(p["response"]))) != 1 {
+		return "", false, false
+	}
+	if time.Since(issued) > nonceLifetime {
+		return "", false, true
+	}
+	if ok, stale := s.digest.useCount(p["nonce"], issued, nc); !ok {
+		return "", false, stale
+	}
+	return user, true, false
+}
+
+// parseDigestParams splits the comma separated key=value list of a digest
+// credentials header, honouring quoted values that contain commas
+func parseDigestParams(s string) map[string]string {
+	params := map[string]string{}
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " ,")
+		key, rest, found := strings.Cut(s, "=")
+		if !found {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				break
+			}
+			value, s = rest[1:end+1], rest[end+2:]
+		} else {
+			value, s, _ = strings.Cut(rest, ",")
+			value = strings.TrimSpace(value)
+		}
+		params[key] = value
+	}
+	return params
+}
+
+// sendAuthRequired answers with the challenge of h offering both Basic and
+// Digest schemes
+func (s *Server) sendAuthRequired(conn net.Conn, stale bool, h authHeaders) error {
+	digest := fmt.Sprintf(`Digest realm=%q, qop="auth", algorithm=MD5, nonce=%q`, s.Realm, s.digest.nonce())
+	if stale {
+		digest += ", stale=true"
+	}
+
+	header := http.Header{}
+	header.Add(h.challenge, fmt.Sprintf("Basic realm=%q", s.Realm))
+	header.Add(h.challenge, digest)
+	resp := &http.Response{
+		StatusCode: h.status,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Close:      true,
+	}
+	return resp.Write(conn)
+}
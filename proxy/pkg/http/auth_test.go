@@ -0,0 +1,198 @@
+package http
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+)
+
+func newAuthServer() *Server {
+	return NewServer(func(s *Server) {
+		s.Credentials = statute.StaticCredentials{"alice": "secret"}
+	})
+}
+
+func md5Hex(parts ...string) string {
+	sum := md5.Sum([]byte(strings.Join(parts, ":")))
+	return hex.EncodeToString(sum[:])
+}
+
+// digestRequest builds a CONNECT request carrying a digest response computed
+// like a client would
+func digestRequest(s *Server, password, nonce, nc string) *http.Request {
+	const uri = "example.com:443"
+	ha1 := md5Hex("alice", s.Realm, password)
+	ha2 := md5Hex(http.MethodConnect, uri)
+	response := md5Hex(ha1, nonce, nc, "c0ffee", "auth", ha2)
+
+	req := &http.Request{Method: http.MethodConnect, RequestURI: uri, Header: http.Header{}}
+	req.Header.Set("Proxy-Authorization", fmt.Sprintf(
+		`Digest username="alice", realm=%q, nonce=%q, uri=%q, qop=auth, nc=%s, cnonce="c0ffee", response=%q`,
+		s.Realm, nonce, uri, nc, response))
+	return req
+}
+
+func TestBasicAuth(t *testing.T) {
+	s := newAuthServer()
+	for _, tc := range []struct {
+		header string
+		ok     bool
+	}{
+		{"Basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret")), true},
+		{"Basic " + base64.StdEncoding.EncodeToString([]byte("alice:wrong")), false},
+		{"Basic " + base64.StdEncoding.EncodeToString([]byte("bob:secret")), false},
+		{"Basic " + base64.StdEncoding.EncodeToString([]byte("alice")), false},
+		{"Basic not-base64", false},
+		{"Bearer token", false},
+		{"", false},
+	} {
+		req := &http.Request{Header: http.Header{}}
+		req.Header.Set("Proxy-Authorization", tc.header)
+		user, ok, _ := s.authenticate(req, proxyAuth)
+		qt.Check(t, ok, qt.Equals, tc.ok, qt.Commentf("header %q", tc.header))
+		if tc.ok {
+			qt.Check(t, user, qt.Equals, "alice")
+		}
+	}
+}
+
+func TestDigestAuth(t *testing.T) {
+	s := newAuthServer()
+	nonce := s.digest.nonce()
+
+	user, ok, stale := s.authenticate(digestRequest(s, "secret", nonce, "00000001"), proxyAuth)
+	qt.Assert(t, ok, qt.IsTrue)
+	qt.Assert(t, stale, qt.IsFalse)
+	qt.Assert(t, user, qt.Equals, "alice")
+
+	// the same nonce may be used again with a higher count
+	_, ok, _ = s.authenticate(digestRequest(s, "secret", nonce, "00000002"), proxyAuth)
+	qt.Assert(t, ok, qt.IsTrue)
+
+	_, ok, stale = s.authenticate(digestRequest(s, "wrong", s.digest.nonce(), "00000001"), proxyAuth)
+	qt.Assert(t, ok, qt.IsFalse)
+	qt.Assert(t, stale, qt.IsFalse)
+}
+
+func TestDigestAuthReplay(t *testing.T) {
+	s := newAuthServer()
+	nonce := s.digest.nonce()
+
+	replayed := digestRequest(s, "secret", nonce, "00000002")
+	_, ok, _ := s.authenticate(replayed, proxyAuth)
+	qt.Assert(t, ok, qt.IsTrue)
+
+	_, ok, stale := s.authenticate(replayed, proxyAuth)
+	qt.Assert(t, ok, qt.IsFalse)
+	qt.Assert(t, stale, qt.IsFalse)
+
+	// a lower count is a replay as well
+	_, ok, _ = s.authenticate(digestRequest(s, "secret", nonce, "00000001"), proxyAuth)
+	qt.Assert(t, ok, qt.IsFalse)
+
+	_, ok, _ = s.authenticate(digestRequest(s, "secret", nonce, "xyz"), proxyAuth)
+	qt.Assert(t, ok, qt.IsFalse)
+}
+
+func TestDigestAuthNonce(t *testing.T) {
+	s := newAuthServer()
+
+	// a nonce signed with another secret
+	_, ok, stale := s.authenticate(digestRequest(s, "secret", newDigestAuth().nonce(), "00000001"), proxyAuth)
+	qt.Assert(t, ok, qt.IsFalse)
+	qt.Assert(t, stale, qt.IsFalse)
+
+	_, ok, _ = s.authenticate(digestRequest(s, "secret", "garbage", "00000001"), proxyAuth)
+	qt.Assert(t, ok, qt.IsFalse)
+
+	// an expired nonce with a correct response asks for a retry
+	ts := make([]byte, 8, 24)
+	binary.BigEndian.PutUint64(ts, uint64(time.Now().Add(-nonceLifetime-time.Minute).Unix()))
+	expired := base64.RawURLEncoding.EncodeToString(append(ts, s.digest.sign(ts)...))
+	_, ok, stale = s.authenticate(digestRequest(s, "secret", expired, "00000001"), proxyAuth)
+	qt.Assert(t, ok, qt.IsFalse)
+	qt.Assert(t, stale, qt.IsTrue)
+}
+
+func TestDigestAuthEviction(t *testing.T) {
+	d := newDigestAuth()
+	issued := time.Now()
+	for i := range maxTrackedNonces {
+		ok, _ := d.useCount(fmt.Sprint(i), issued.Add(-time.Duration(maxTrackedNonces-i)*time.Millisecond), 1)
+		qt.Assert(t, ok, qt.IsTrue)
+	}
+
+	ok, _ := d.useCount("new", issued, 1)
+	qt.Assert(t, ok, qt.IsTrue)
+	qt.Assert(t, len(d.counts) <= maxTrackedNonces, qt.IsTrue)
+
+	// the count of the evicted nonce is gone, it must not be accepted again
+	ok, stale := d.useCount("0", issued.Add(-maxTrackedNonces*time.Millisecond), 2)
+	qt.Assert(t, ok, qt.IsFalse)
+	qt.Assert(t, stale, qt.IsTrue)
+}
+
+func TestParseDigestParams(t *testing.T) {
+	got := parseDigestParams(`username="alice", realm="a, b", nc=00000001 ,qop=auth, uri="/x"`)
+	qt.Assert(t, got, qt.DeepEquals, map[string]string{
+		"username": "alice",
+		"realm":    "a, b",
+		"nc":       "00000001",
+		"qop":      "auth",
+		"uri":      "/x",
+	})
+
+	// an unterminated quote ends the list
+	got = parseDigestParams(`username="alice, realm=x`)
+	qt.Assert(t, got, qt.DeepEquals, map[string]string{})
+}
+
+// serveLocalRequest sends raw to a server with a local handler and returns
+// the answer, which names the authenticated user in X-User
+func serveLocalRequest(t *testing.T, s *Server, raw string) *http.Response {
+	s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-User", LocalUser(r))
+		_, _ = w.Write([]byte("status"))
+	})
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() { _ = s.ServeConn(server) }()
+
+	_, err := client.Write([]byte(raw))
+	qt.Assert(t, err, qt.IsNil)
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	qt.Assert(t, err, qt.IsNil)
+	_ = resp.Body.Close()
+	return resp
+}
+
+func TestLocalAuth(t *testing.T) {
+	resp := serveLocalRequest(t, newAuthServer(), "GET / HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	qt.Assert(t, resp.StatusCode, qt.Equals, http.StatusUnauthorized)
+	qt.Assert(t, resp.Header.Values("WWW-Authenticate"), qt.HasLen, 2)
+
+	// proxy credentials are not sent to the proxy as an origin server
+	basic := base64.StdEncoding.EncodeToString([]byte("alice:secret"))
+	resp = serveLocalRequest(t, newAuthServer(), "GET / HTTP/1.1\r\nHost: proxy\r\nProxy-Authorization: Basic "+basic+"\r\n\r\n")
+	qt.Assert(t, resp.StatusCode, qt.Equals, http.StatusUnauthorized)
+
+	resp = serveLocalRequest(t, newAuthServer(), "GET / HTTP/1.1\r\nHost: proxy\r\nAuthorization: Basic "+basic+"\r\n\r\n")
+	qt.Assert(t, resp.StatusCode, qt.Equals, http.StatusOK)
+	qt.Assert(t, resp.Header.Get("X-User"), qt.Equals, "alice")
+
+	resp = serveLocalRequest(t, NewServer(), "GET / HTTP/1.1\r\nHost: proxy\r\n\r\n")
+	qt.Assert(t, resp.StatusCode, qt.Equals, http.StatusOK)
+	qt.Assert(t, resp.Header.Get("X-User"), qt.Equals, "")
+}
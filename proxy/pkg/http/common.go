@@ -1,13 +1,17 @@
 package http
 
 import (
-	"bytes"
+	"bufio"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
-	"sync"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
 )
 
+var errAuthFailed = errors.New("proxy authentication failed")
+
 // copyBuffer is a helper function to copy data between two net.Conn objects.
 // func copyBuffer(dst, src net.Conn, buf []byte) (int64, error) {
 // 	return io.CopyBuffer(dst, src, buf)
@@ -55,30 +59,17 @@ func (rw *responseWriter) Write(data []byte) (int, error) {
 	return rw.conn.Write(data)
 }
 
-type customConn struct {
+// bufferedConn reads through the reader that already consumed the request
+// line, so bytes a client sent right after its request are not lost
+type bufferedConn struct {
 	net.Conn
-	req         *http.Request
-	initialData []byte
-	once        sync.Once
+	reader *bufio.Reader
 }
 
-func (c *customConn) Read(p []byte) (n int, err error) {
-	c.once.Do(func() {
-		buf := &bytes.Buffer{}
-		err = c.req.Write(buf)
-		if err != nil {
-			n = 0
-			return
-		}
-		c.initialData = buf.Bytes()
-	})
-
-	if len(c.initialData) > 0 {
-		copy(p, c.initialData)
-		n = len(p)
-		c.initialData = nil
-		return
-	}
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
 
-	return c.Conn.Read(p)
+func (c *bufferedConn) CloseWrite() error {
+	return statute.CloseWrite(c.Conn)
 }
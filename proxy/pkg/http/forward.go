@@ -0,0 +1,323 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// hopHeaders are meaningful for a single connection only and must not be
+// passed on by a proxy
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// maxUpstreams caps the upstream connections kept open for one client, the
+// least recently used one is closed to make room for another host
+const maxUpstreams = 8
+
+// upstream is a connection to an origin server that can carry several
+// requests of the same client
+type upstream struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	// used orders the upstreams of a client by their last use
+	used uint64
+}
+
+// forwarder relays the plain HTTP requests of one client connection. Every
+// request is routed on its own, so a keep-alive client may address several
+// hosts, and one upstream connection per host, up to maxUpstreams, is kept
+// for reuse.
+type forwarder struct {
+	s      *Server
+	ctx    context.Context
+	conn   net.Conn
+	reader *bufio.Reader
+	// user authenticated the current request, the upstreams were dialed on
+	// its behalf
+	user      string
+	upstreams map[string]*upstream
+	uses      uint64
+}
+
+func (s *Server) serveForward(ctx context.Context, conn net.Conn, reader *bufio.Reader, req *http.Request, user string) error {
+	f := &forwarder{
+		s:         s,
+		ctx:       ctx,
+		conn:      conn,
+		reader:    reader,
+		user:      user,
+		upstreams: make(map[string]*upstream),
+	}
+	defer func() {
+		f.closeUpstreams()
+		_ = conn.Close()
+	}()
+
+	for {
+		keepAlive, err := f.forward(req)
+		if err != nil || !keepAlive {
+			return err
+		}
+
+		req, err = http.ReadRequest(reader)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		// requests to the proxy itself authenticate in serveLocal
+		if req.URL.Host != "" {
+			user, ok, err := s.checkAuth(conn, req, proxyAuth)
+			if !ok {
+				return err
+			}
+			if user != f.user {
+				// upstreams may be routed differently for another user
+				f.closeUpstreams()
+				f.user = user
+			}
+		}
+		if req.Method == http.MethodConnect {
+			f.closeUpstreams()
+			return s.handleConnect(ctx, &bufferedConn{Conn: conn, reader: reader}, req, f.user)
+		}
+	}
+}
+
+// forward sends req to its origin server and copies the response back to the
+// client. It reports whether the client connection can take another request.
+func (f *forwarder) forward(req *http.Request) (bool, error) {
+	if req.URL.Host == "" {
+		if f.s.Handler != nil {
+			return false, f.s.serveLocal(f.ctx, f.conn, req)
+		}
+		http.Error(NewHTTPResponseWriter(f.conn), "not a proxy request", http.StatusBadRequest)
+		return false, nil
+	}
+
+	target := targetAddress(req)
+	upgrade := upgradeProtocol(req.Header)
+	removeHopHeaders(req.Header)
+	if upgrade != "" {
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", upgrade)
+	}
+
+	resp, written, err := f.roundTrip(target, req)
+	if err != nil {
+		f.dropUpstream(target)
+		http.Error(NewHTTPResponseWriter(f.conn), err.Error(), http.StatusBadGateway)
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return false, f.switchProtocols(target, resp)
+	}
+
+	removeHopHeaders(resp.Header)
+	keepAlive := !req.Close && !resp.Close
+	resp.Close = !keepAlive
+	if err := resp.Write(f.conn); err != nil {
+		f.dropUpstream(target)
+		return false, err
+	}
+	if !keepAlive {
+		// the rest of a body the server did not wait for is discarded with
+		// the connection
+		return false, nil
+	}
+	if err := <-written; err != nil {
+		f.dropUpstream(target)
+		return false, err
+	}
+	return true, nil
+}
+
+// roundTrip writes req to the upstream of target and reads its final
+// response. Interim 1xx responses are passed to the client as they arrive.
+// The request is written concurrently so a client waiting for
+// "100 Continue" before sending the body does not stall. A reused connection
+// that turns out to be closed by the server is replaced once for requests
+// without a body.
+func (f *forwarder) roundTrip(target string, req *http.Request) (*http.Response, <-chan error, error) {
+	for attempt := 0; ; attempt++ {
+		up, reused, err := f.upstream(target)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		written := make(chan error, 1)
+		go func() {
+			written <- req.Write(up.conn)
+		}()
+
+		resp, err := f.readResponse(up, req)
+		if err == nil {
+			return resp, written, nil
+		}
+		f.dropUpstream(target)
+		if !reused || attempt > 0 || req.Body != http.NoBody {
+			return nil, nil, err
+		}
+		<-written
+	}
+}
+
+func (f *forwarder) readResponse(up *upstream, req *http.Request) (*http.Response, error) {
+	for {
+		resp, err := http.ReadResponse(up.reader, req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode >= 200 || resp.StatusCode == http.StatusSwitchingProtocols {
+			return resp, nil
+		}
+		if err := writeHead(f.conn, resp); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// switchProtocols completes an upgrade accepted by the server and then
+// tunnels the raw connection
+func (f *forwarder) switchProtocols(target string, resp *http.Response) error {
+	up := f.upstreams[target]
+	delete(f.upstreams, target)
+	if err := writeHead(f.conn, resp); err != nil {
+		_ = up.conn.Close()
+		return err
+	}
+	return f.s.tunnel(
+		f.ctx,
+		&bufferedConn{Conn: up.conn, reader: up.reader},
+		&bufferedConn{Conn: f.conn, reader: f.reader},
+	)
+}
+
+// upstream returns the connection to target, dialing it unless one is
+// already open, and whether it was reused
+func (f *forwarder) upstream(target string) (*upstream, bool, error) {
+	f.uses++
+	if up, ok := f.upstreams[target]; ok {
+		up.used = f.uses
+		return up, true, nil
+	}
+	if len(f.upstreams) >= maxUpstreams {
+		f.dropUpstream(f.leastRecentlyUsed())
+	}
+	conn, err := f.s.dial(f.ctx, f.conn.RemoteAddr(), target, f.user)
+	if err != nil {
+		return nil, false, err
+	}
+	up := &upstream{conn: conn, reader: bufio.NewReader(conn), used: f.uses}
+	f.upstreams[target] = up
+	return up, false, nil
+}
+
+// leastRecentlyUsed returns the target of the upstream used longest ago
+func (f *forwarder) leastRecentlyUsed() string {
+	var oldest string
+	for target, up := range f.upstreams {
+		if oldest == "" || up.used < f.upstreams[oldest].used {
+			oldest = target
+		}
+	}
+	return oldest
+}
+
+func (f *forwarder) dropUpstream(target string) {
+	if up, ok := f.upstreams[target]; ok {
+		_ = up.conn.Close()
+		delete(f.upstreams, target)
+	}
+}
+
+func (f *forwarder) closeUpstreams() {
+	for target := range f.upstreams {
+		f.dropUpstream(target)
+	}
+}
+
+// dial opens a connection to target. With a user handler the handler gets
+// one end of an in-memory pipe as the client connection of a regular TCP
+// request of user and the forwarder talks HTTP over the other end.
+func (s *Server) dial(ctx context.Context, source net.Addr, target, user string) (net.Conn, error) {
+	if s.UserConnectHandle == nil {
+		return s.ProxyDial(ctx, "tcp", target)
+	}
+
+	client, server := net.Pipe()
+	proxyReq, err := s.newProxyRequest(ctx, server, source, target, user)
+	if err == nil && s.ConnectCheck != nil {
+		err = s.ConnectCheck(proxyReq)
+	}
+	if err != nil {
+		_ = client.Close()
+		_ = server.Close()
+		return nil, err
+	}
+	go func() {
+		if err := s.UserConnectHandle(proxyReq); err != nil {
+			s.Logger.Error(err.Error())
+		}
+		_ = server.Close()
+	}()
+	return client, nil
+}
+
+// writeHead writes the status line and headers of a response without a body
+func writeHead(w io.Writer, resp *http.Response) error {
+	if _, err := fmt.Fprintf(w, "HTTP/%d.%d %s\r\n", resp.ProtoMajor, resp.ProtoMinor, resp.Status); err != nil {
+		return err
+	}
+	if err := resp.Header.Write(w); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
+
+// upgradeProtocol returns the protocol a client asks to switch to, or an
+// empty string when the request is not an upgrade
+func upgradeProtocol(h http.Header) string {
+	for _, v := range h["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return h.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// removeHopHeaders deletes the hop-by-hop headers, including those the
+// Connection header declares as such
+func removeHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
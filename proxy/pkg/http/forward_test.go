@@ -0,0 +1,130 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// newOrigin starts a server that answers every request with name
+func newOrigin(t *testing.T, name string) *httptest.Server {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, name+" "+r.URL.Path)
+	}))
+	t.Cleanup(origin.Close)
+	return origin
+}
+
+// forwardClient serves one client connection on a proxy that records the
+// upstream connections it dials and returns the client side
+func forwardClient(t *testing.T) (net.Conn, *bufio.Reader, func() []string) {
+	var (
+		mu    sync.Mutex
+		dials []string
+	)
+	s := NewServer(WithProxyDial(func(ctx context.Context, network, address string) (net.Conn, error) {
+		mu.Lock()
+		dials = append(dials, address)
+		mu.Unlock()
+		var d net.Dialer
+		return d.DialContext(ctx, network, address)
+	}))
+
+	client, server := net.Pipe()
+	go func() { _ = s.ServeConn(server) }()
+	t.Cleanup(func() { _ = client.Close() })
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	return client, bufio.NewReader(client), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), dials...)
+	}
+}
+
+// get sends a proxy request for url over conn and returns the response body
+func get(t *testing.T, conn net.Conn, reader *bufio.Reader, url, header string) (*http.Response, string) {
+	host := strings.TrimPrefix(url, "http://")
+	host, _, _ = strings.Cut(host, "/")
+	_, err := fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\n%s\r\n", url, host, header)
+	qt.Assert(t, err, qt.IsNil)
+
+	resp, err := http.ReadResponse(reader, nil)
+	qt.Assert(t, err, qt.IsNil)
+	body, err := io.ReadAll(resp.Body)
+	qt.Assert(t, err, qt.IsNil)
+	_ = resp.Body.Close()
+	return resp, string(body)
+}
+
+func TestForwardKeepAlive(t *testing.T) {
+	first := newOrigin(t, "first")
+	second := newOrigin(t, "second")
+	conn, reader, dials := forwardClient(t)
+
+	resp, body := get(t, conn, reader, first.URL+"/a", "")
+	qt.Assert(t, resp.StatusCode, qt.Equals, http.StatusOK)
+	qt.Assert(t, resp.Close, qt.IsFalse)
+	qt.Assert(t, body, qt.Equals, "first /a")
+
+	// the next request on the same connection goes to another host
+	resp, body = get(t, conn, reader, second.URL+"/b", "")
+	qt.Assert(t, resp.Close, qt.IsFalse)
+	qt.Assert(t, body, qt.Equals, "second /b")
+
+	// and the upstream of the first host is reused
+	_, body = get(t, conn, reader, first.URL+"/c", "")
+	qt.Assert(t, body, qt.Equals, "first /c")
+
+	qt.Assert(t, dials(), qt.DeepEquals, []string{
+		strings.TrimPrefix(first.URL, "http://"),
+		strings.TrimPrefix(second.URL, "http://"),
+	})
+}
+
+func TestForwardConnectionClose(t *testing.T) {
+	origin := newOrigin(t, "origin")
+	conn, reader, _ := forwardClient(t)
+
+	resp, body := get(t, conn, reader, origin.URL+"/", "Connection: close\r\n")
+	qt.Assert(t, body, qt.Equals, "origin /")
+	qt.Assert(t, resp.Close, qt.IsTrue)
+
+	// the proxy hangs up after the response
+	_, err := reader.ReadByte()
+	qt.Assert(t, err, qt.Equals, io.EOF)
+}
+
+func TestForwardMaxUpstreams(t *testing.T) {
+	origins := make([]*httptest.Server, maxUpstreams+1)
+	for i := range origins {
+		origins[i] = newOrigin(t, fmt.Sprint(i))
+	}
+	conn, reader, dials := forwardClient(t)
+
+	for i, origin := range origins[:maxUpstreams] {
+		_, body := get(t, conn, reader, origin.URL+"/", "")
+		qt.Assert(t, body, qt.Equals, fmt.Sprintf("%d /", i))
+	}
+	// keep the first upstream in use, so the second is the oldest
+	get(t, conn, reader, origins[0].URL+"/", "")
+
+	// another host takes the place of the least recently used upstream
+	_, body := get(t, conn, reader, origins[maxUpstreams].URL+"/", "")
+	qt.Assert(t, body, qt.Equals, fmt.Sprintf("%d /", maxUpstreams))
+	get(t, conn, reader, origins[0].URL+"/", "")
+	qt.Assert(t, len(dials()), qt.Equals, maxUpstreams+1)
+	get(t, conn, reader, origins[1].URL+"/", "")
+	qt.Assert(t, len(dials()), qt.Equals, maxUpstreams+2)
+	qt.Assert(t, dials()[maxUpstreams+1], qt.Equals, strings.TrimPrefix(origins[1].URL, "http://"))
+}
@@ -0,0 +1,77 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+)
+
+// userKey keys the user a local request authenticated as
+type userKey struct{}
+
+// LocalUser returns the proxy user the local request r authenticated as, it
+// is empty when the proxy takes no credentials
+func LocalUser(r *http.Request) string {
+	user, _ := r.Context().Value(userKey{}).(string)
+	return user
+}
+
+// serveLocal answers an origin-form request, which is addressed to the proxy
+// itself rather than to an upstream server, with Handler. With credentials
+// set the request has to authenticate like with a web server. The local
+// address of conn is available to the handler under
+// http.LocalAddrContextKey, the user under LocalUser.
+func (s *Server) serveLocal(ctx context.Context, conn net.Conn, req *http.Request) error {
+	user, ok, err := s.checkAuth(conn, req, originAuth)
+	if !ok {
+		return err
+	}
+
+	ctx = context.WithValue(ctx, http.LocalAddrContextKey, conn.LocalAddr())
+	ctx = context.WithValue(ctx, userKey{}, user)
+	req = req.WithContext(ctx)
+	req.RemoteAddr = conn.RemoteAddr().String()
+
+	rec := &responseRecorder{header: http.Header{}, status: http.StatusOK}
+	s.Handler.ServeHTTP(rec, req)
+
+	resp := &http.Response{
+		StatusCode:    rec.status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        rec.header,
+		ContentLength: int64(rec.body.Len()),
+		Body:          io.NopCloser(&rec.body),
+		Close:         true,
+		Request:       req,
+	}
+	return resp.Write(conn)
+}
+
+// responseRecorder buffers a locally generated response so it can be sent
+// with a Content-Length
+type responseRecorder struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) WriteHeader(statusCode int) {
+	if r.wroteHeader {
+		return
+	}
+	r.status = statusCode
+	r.wroteHeader = true
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(data)
+}
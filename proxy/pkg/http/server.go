@@ -7,6 +7,7 @@ import (
 	"log/slog"
 	"net"
 	"net/http"
+	"net/netip"
 	"strconv"
 
 	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
@@ -23,12 +24,24 @@ type Server struct {
 	ProxyDial statute.ProxyDialFunc
 	// UserConnectHandle gives the user control to handle the TCP CONNECT requests
 	UserConnectHandle statute.UserConnectHandler
+	// ConnectCheck may refuse a request before it is confirmed to the client
+	ConnectCheck statute.ConnectCheck
 	// Logger error log
 	Logger *slog.Logger
 	// Context is default context
 	Context context.Context
 	// BytesPool getting and returning temporary bytes for use by io.CopyBuffer
 	BytesPool statute.BytesPool
+	// Credentials enables Basic and Digest proxy authentication when set
+	Credentials statute.CredentialStore
+	// Realm is the protection space announced in authentication challenges
+	Realm string
+	// Handler serves requests addressed to the proxy itself, such as a PAC
+	// file. With Credentials set they authenticate like requests to a web
+	// server.
+	Handler http.Handler
+
+	digest *digestAuth
 }
 
 func NewServer(options ...ServerOption) *Server {
@@ -37,6 +50,8 @@ func NewServer(options ...ServerOption) *Server {
 		ProxyDial: statute.DefaultProxyDial(),
 		Logger:    slog.Default(),
 		Context:   statute.DefaultContext(),
+		Realm:     defaultRealm,
+		digest:    newDigestAuth(),
 	}
 
 	for _, option := range options {
@@ -112,6 +127,12 @@ func WithConnectHandle(handler statute.UserConnectHandler) ServerOption {
 	}
 }
 
+func WithConnectCheck(check statute.ConnectCheck) ServerOption {
+	return func(s *Server) {
+		s.ConnectCheck = check
+	}
+}
+
 func WithProxyDial(proxyDial statute.ProxyDialFunc) ServerOption {
 	return func(s *Server) {
 		s.ProxyDial = proxyDial
@@ -130,82 +151,134 @@ func WithBytesPool(bytesPool statute.BytesPool) ServerOption {
 	}
 }
 
+func WithCredentials(credentials statute.CredentialStore) ServerOption {
+	return func(s *Server) {
+		s.Credentials = credentials
+	}
+}
+
+func WithRealm(realm string) ServerOption {
+	return func(s *Server) {
+		s.Realm = realm
+	}
+}
+
+func WithHandler(handler http.Handler) ServerOption {
+	return func(s *Server) {
+		s.Handler = handler
+	}
+}
+
 func (s *Server) ServeConn(conn net.Conn) error {
+	return s.ServeConnContext(s.Context, conn)
+}
+
+// ServeConnContext serves conn like ServeConn, the context of its requests
+// derives from ctx instead of the server context
+func (s *Server) ServeConnContext(ctx context.Context, conn net.Conn) error {
 	reader := bufio.NewReader(conn)
 	req, err := http.ReadRequest(reader)
 	if err != nil {
 		return err
 	}
 
-	return s.handleHTTP(conn, req, req.Method == http.MethodConnect)
+	// the context of the connection ends with ServeConnContext
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if req.URL.Host == "" && s.Handler != nil {
+		defer conn.Close()
+		return s.serveLocal(ctx, conn, req)
+	}
+
+	user, ok, err := s.checkAuth(conn, req, proxyAuth)
+	if !ok {
+		_ = conn.Close()
+		return err
+	}
+
+	if req.Method == http.MethodConnect {
+		return s.handleConnect(ctx, &bufferedConn{Conn: conn, reader: reader}, req, user)
+	}
+	return s.serveForward(ctx, conn, reader, req, user)
 }
 
-func (s *Server) handleHTTP(conn net.Conn, req *http.Request, isConnectMethod bool) error {
-	if s.UserConnectHandle == nil {
-		return s.embedHandleHTTP(conn, req, isConnectMethod)
+// checkAuth verifies the credentials of req and answers with the challenge of
+// h when they are missing or wrong. On success it returns the authenticated user,
+// which is empty without credentials. The error is only set for a rejected
+// attempt, a request that merely lacked credentials is the normal start of
+// the handshake.
+func (s *Server) checkAuth(conn net.Conn, req *http.Request, h authHeaders) (string, bool, error) {
+	if s.Credentials == nil {
+		return "", true, nil
+	}
+	if user, ok, stale := s.authenticate(req, h); ok {
+		return user, true, nil
+	} else if err := s.sendAuthRequired(conn, stale, h); err != nil {
+		return "", false, err
+	} else if req.Header.Get(h.credentials) != "" && !stale {
+		return "", false, errAuthFailed
 	}
+	return "", false, nil
+}
 
-	if isConnectMethod {
-		_, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
-		if err != nil {
-			return err
-		}
-	} else {
-		cConn := &customConn{
-			Conn: conn,
-			req:  req,
-		}
-		conn = cConn
+// rejectRetryAfter is how many seconds a client turned away with 503 Service
+// Unavailable is asked to wait before trying again
+const rejectRetryAfter = "5"
+
+// RejectConn reads the request of a client that may not use the proxy and
+// answers it with status, usually 403 Forbidden. A 503 Service Unavailable
+// for a proxy that is not ready yet carries a Retry-After.
+func RejectConn(conn net.Conn, status int) error {
+	if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+		return err
+	}
+	resp := &http.Response{
+		StatusCode: status,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Close:      true,
+	}
+	if status == http.StatusServiceUnavailable {
+		resp.Header.Set("Retry-After", rejectRetryAfter)
 	}
+	return resp.Write(conn)
+}
 
-	targetAddr := req.URL.Host
-	host, portStr, err := net.SplitHostPort(targetAddr)
-	if err != nil {
-		host = targetAddr
-		if req.URL.Scheme == "https" || isConnectMethod {
-			portStr = "443"
-		} else {
-			portStr = "80"
-		}
-		targetAddr = net.JoinHostPort(host, portStr)
+func (s *Server) handleConnect(ctx context.Context, conn net.Conn, req *http.Request, user string) error {
+	if s.UserConnectHandle == nil {
+		return s.embedHandleConnect(ctx, conn, req)
 	}
 
-	portInt, err := strconv.Atoi(portStr)
+	proxyReq, err := s.newProxyRequest(ctx, conn, conn.RemoteAddr(), targetAddress(req), user)
 	if err != nil {
-		return err // Handle the error if the port string is not a valid integer.
+		return err
 	}
-	port := int32(portInt)
-
-	proxyReq := &statute.ProxyRequest{
-		Conn:        conn,
-		Reader:      io.Reader(conn),
-		Writer:      io.Writer(conn),
-		Network:     "tcp",
-		Destination: targetAddr,
-		DestHost:    host,
-		DestPort:    port,
+	if s.ConnectCheck != nil {
+		if err := s.ConnectCheck(proxyReq); err != nil {
+			http.Error(
+				NewHTTPResponseWriter(conn),
+				err.Error(),
+				http.StatusServiceUnavailable,
+			)
+			return err
+		}
 	}
 
+	_, err = conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	if err != nil {
+		return err
+	}
 	return s.UserConnectHandle(proxyReq)
 }
 
-func (s *Server) embedHandleHTTP(conn net.Conn, req *http.Request, isConnectMethod bool) error {
+func (s *Server) embedHandleConnect(ctx context.Context, conn net.Conn, req *http.Request) error {
 	defer func() {
 		_ = conn.Close()
 	}()
 
-	host, portStr, err := net.SplitHostPort(req.URL.Host)
-	if err != nil {
-		host = req.URL.Host
-		if req.URL.Scheme == "https" || isConnectMethod {
-			portStr = "443"
-		} else {
-			portStr = "80"
-		}
-	}
-	targetAddr := net.JoinHostPort(host, portStr)
-
-	target, err := s.ProxyDial(s.Context, "tcp", targetAddr)
+	target, err := s.ProxyDial(ctx, "tcp", targetAddress(req))
 	if err != nil {
 		http.Error(
 			NewHTTPResponseWriter(conn),
@@ -218,18 +291,15 @@ func (s *Server) embedHandleHTTP(conn net.Conn, req *http.Request, isConnectMeth
 		_ = target.Close()
 	}()
 
-	if isConnectMethod {
-		_, err = conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
-		if err != nil {
-			return err
-		}
-	} else {
-		err = req.Write(target)
-		if err != nil {
-			return err
-		}
+	_, err = conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	if err != nil {
+		return err
 	}
+	return s.tunnel(ctx, target, conn)
+}
 
+// tunnel copies data between both connections until either side is done
+func (s *Server) tunnel(ctx context.Context, c1, c2 net.Conn) error {
 	var buf1, buf2 []byte
 	if s.BytesPool != nil {
 		buf1 = s.BytesPool.Get()
@@ -242,5 +312,52 @@ func (s *Server) embedHandleHTTP(conn net.Conn, req *http.Request, isConnectMeth
 		buf1 = make([]byte, 32*1024)
 		buf2 = make([]byte, 32*1024)
 	}
-	return statute.Tunnel(s.Context, target, conn, buf1, buf2)
+	return statute.Tunnel(ctx, c1, c2, buf1, buf2)
+}
+
+// targetAddress returns the host:port the request is meant for, using the
+// default port of the scheme when the request does not carry one
+func targetAddress(req *http.Request) string {
+	if _, _, err := net.SplitHostPort(req.URL.Host); err == nil {
+		return req.URL.Host
+	}
+	port := "80"
+	if req.URL.Scheme == "https" || req.Method == http.MethodConnect {
+		port = "443"
+	}
+	return net.JoinHostPort(req.URL.Host, port)
+}
+
+// newProxyRequest describes a request of the client at source to targetAddr,
+// conn carries its data and ctx is the context of the client connection
+func (s *Server) newProxyRequest(ctx context.Context, conn net.Conn, source net.Addr, targetAddr, user string) (*statute.ProxyRequest, error) {
+	host, portStr, err := net.SplitHostPort(targetAddr)
+	if err != nil {
+		return nil, err
+	}
+	portInt, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err // Handle the error if the port string is not a valid integer.
+	}
+
+	return &statute.ProxyRequest{
+		Conn:        conn,
+		Reader:      io.Reader(conn),
+		Writer:      io.Writer(conn),
+		Network:     "tcp",
+		Destination: targetAddr,
+		DestHost:    host,
+		DestPort:    int32(portInt),
+
+		DestIsDomain: !isIPLiteral(host),
+		User:         user,
+		Protocol:     statute.ProtocolHTTP,
+		Source:       statute.SourceAddr(source),
+		Context:      ctx,
+	}, nil
+}
+
+func isIPLiteral(host string) bool {
+	_, err := netip.ParseAddr(host)
+	return err == nil
 }
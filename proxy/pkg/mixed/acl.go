@@ -0,0 +1,74 @@
+package mixed
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+)
+
+// AccessControl decides which clients are allowed to use the proxy
+type AccessControl struct {
+	// Allow lists the source networks that may connect, empty allows everyone
+	Allow []netip.Prefix
+	// Deny lists source networks that are always rejected, it takes
+	// precedence over Allow
+	Deny []netip.Prefix
+	// MaxConnsPerSource caps the concurrent connections of a single source
+	// address, zero means no limit
+	MaxConnsPerSource int
+}
+
+// sourceTracker counts the live connections of every source address
+type sourceTracker struct {
+	mu    sync.Mutex
+	conns map[netip.Addr]int
+}
+
+func (t *sourceTracker) acquire(addr netip.Addr, limit int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conns == nil {
+		t.conns = make(map[netip.Addr]int)
+	}
+	if limit > 0 && t.conns[addr] >= limit {
+		return false
+	}
+	t.conns[addr]++
+	return true
+}
+
+func (t *sourceTracker) release(addr netip.Addr) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conns[addr] <= 1 {
+		delete(t.conns, addr)
+		return
+	}
+	t.conns[addr]--
+}
+
+// check returns the reason addr is refused by the lists, or an empty string
+func (a *AccessControl) check(addr netip.Addr) string {
+	for _, prefix := range a.Deny {
+		if prefix.Contains(addr) {
+			return "source is denied"
+		}
+	}
+	if len(a.Allow) == 0 {
+		return ""
+	}
+	for _, prefix := range a.Allow {
+		if prefix.Contains(addr) {
+			return ""
+		}
+	}
+	return "source is not allowed"
+}
+
+// sourceAddr extracts the client IP of conn, v4-mapped addresses are unmapped
+// so they match IPv4 prefixes
+func sourceAddr(conn net.Conn) netip.Addr {
+	return statute.SourceAddr(conn.RemoteAddr()).Addr()
+}
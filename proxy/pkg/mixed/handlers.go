@@ -2,8 +2,12 @@ package mixed
 
 import (
 	"context"
+	"crypto/tls"
 	"log/slog"
 	"net"
+	"net/http"
+	"net/netip"
+	"time"
 
 	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
 )
@@ -61,6 +65,22 @@ func WithUserUDPHandler(handler userHandler) Option {
 	}
 }
 
+// WithConnectCheck lets check refuse connect requests of every protocol before
+// they are confirmed to the client
+func WithConnectCheck(check statute.ConnectCheck) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.ConnectCheck = check
+		p.socks4Proxy.ConnectCheck = check
+		p.httpProxy.ConnectCheck = check
+	}
+}
+
+func WithUserBindHandler(handler statute.UserBindHandler) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.UserBindHandle = handler
+	}
+}
+
 func WithUserDialFunc(proxyDial statute.ProxyDialFunc) Option {
 	return func(p *Proxy) {
 		p.userDialFunc = proxyDial
@@ -76,6 +96,12 @@ func WithUserListenPacketFunc(proxyListenPacket statute.ProxyListenPacket) Optio
 	}
 }
 
+func WithUserListenFunc(proxyListen statute.ProxyListenFunc) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.ProxyListen = proxyListen
+	}
+}
+
 func WithUserForwardAddressFunc(packetForwardAddress statute.PacketForwardAddress) Option {
 	return func(p *Proxy) {
 		p.socks5Proxy.PacketForwardAddress = packetForwardAddress
@@ -98,3 +124,76 @@ func WithBytesPool(bytesPool statute.BytesPool) Option {
 		p.httpProxy.BytesPool = bytesPool
 	}
 }
+
+func WithCredentials(credentials statute.CredentialStore) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.Credentials = credentials
+		p.socks4Proxy.Credentials = credentials
+		p.httpProxy.Credentials = credentials
+	}
+}
+
+func WithAccessControl(acl AccessControl) Option {
+	return func(p *Proxy) {
+		p.acl = &acl
+	}
+}
+
+// WithPACBypass adds domains and networks that the served PAC file sends
+// directly instead of through the proxy
+func WithPACBypass(rules []string) Option {
+	return func(p *Proxy) {
+		p.pacBypass = rules
+	}
+}
+
+// WithStatusHandler serves handler to browsers that open the proxy address
+// itself
+func WithStatusHandler(handler http.Handler) Option {
+	return func(p *Proxy) {
+		p.statusHandler = handler
+	}
+}
+
+// WithTLSConfig accepts TLS wrapped clients next to plaintext ones, the
+// decrypted stream may carry any of the supported proxy protocols
+func WithTLSConfig(config *tls.Config) Option {
+	return func(p *Proxy) {
+		p.tlsConfig = config
+	}
+}
+
+// WithMaxConnections caps the concurrent connections of all clients on all
+// listeners. Once reached, new clients are closed right away until a
+// connection ends.
+func WithMaxConnections(n int) Option {
+	return func(p *Proxy) {
+		p.maxConns = n
+	}
+}
+
+// WithHandshakeTimeout drops clients that do not send their first protocol
+// byte within d, zero disables the timeout
+func WithHandshakeTimeout(d time.Duration) Option {
+	return func(p *Proxy) {
+		p.handshakeTimeout = d
+	}
+}
+
+// WithReadyCheck rejects clients right away while ready reports false, so
+// they can retry elsewhere instead of timing out. HTTP clients are answered
+// with 503 Service Unavailable and a Retry-After.
+func WithReadyCheck(ready func() bool) Option {
+	return func(p *Proxy) {
+		p.ready = ready
+	}
+}
+
+// WithProxyProtocol expects a PROXY protocol v1 or v2 header on connections
+// from the trusted networks and treats the client it names as the source of
+// the connection
+func WithProxyProtocol(trusted []netip.Prefix) Option {
+	return func(p *Proxy) {
+		p.proxyProtocol = trusted
+	}
+}
@@ -0,0 +1,119 @@
+package mixed
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+)
+
+// localNetworks are always reached directly by PAC clients, proxying LAN
+// traffic through the tunnel would only break it
+var localNetworks = []netip.Prefix{
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+}
+
+// localHandler serves the requests browsers send to the proxy itself: the
+// PAC file under its usual names and the status page on every other path
+func (p *Proxy) localHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/proxy.pac", p.servePAC)
+	mux.HandleFunc("/wpad.dat", p.servePAC)
+	if p.statusHandler != nil {
+		mux.Handle("/", p.statusHandler)
+	}
+	return mux
+}
+
+// protocolsKey keys the protocols served on the listener of a local request
+type protocolsKey struct{}
+
+func (p *Proxy) servePAC(w http.ResponseWriter, r *http.Request) {
+	// announce the address the client reached us on, the bind address may
+	// be a wildcard
+	addr := p.bind
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if _, ok := local.(*net.UnixAddr); ok {
+			// a socket path can not be named in a PAC file
+			http.NotFound(w, r)
+			return
+		}
+		addr = local.String()
+	}
+	protocols, _ := r.Context().Value(protocolsKey{}).([]string)
+
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.Header().Set("Cache-Control", "no-cache")
+	_, _ = w.Write([]byte(generatePAC(addr, protocols, p.pacBypass)))
+}
+
+// generatePAC renders a proxy auto-config script sending everything except
+// plain host names, local networks and the bypass rules through addr, using
+// the protocols served there or all of them when protocols is empty. A rule
+// is either a network or a domain, a domain also matches its subdomains.
+func generatePAC(addr string, protocols, bypass []string) string {
+	networks := append([]netip.Prefix{}, localNetworks...)
+	var domains []string
+	for _, rule := range bypass {
+		rule = strings.TrimSpace(rule)
+		if prefix, err := netip.ParsePrefix(rule); err == nil {
+			networks = append(networks, prefix.Masked())
+		} else if ip, err := netip.ParseAddr(rule); err == nil {
+			networks = append(networks, netip.PrefixFrom(ip, ip.BitLen()))
+		} else if rule != "" {
+			domains = append(domains, strings.ToLower(strings.Trim(rule, ".*")))
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("\tif (isPlainHostName(host) || host == \"localhost\")\n\t\treturn \"DIRECT\";\n")
+	for _, domain := range domains {
+		fmt.Fprintf(&b, "\tif (host == %q || dnsDomainIs(host, %q))\n\t\treturn \"DIRECT\";\n", domain, "."+domain)
+	}
+
+	// networks only match literal addresses so the browser never has to
+	// resolve names outside the tunnel
+	b.WriteString("\tvar v4 = /^[0-9]+\\.[0-9]+\\.[0-9]+\\.[0-9]+$/.test(host);\n")
+	b.WriteString("\tvar v6 = host.indexOf(\":\") >= 0 && typeof isInNetEx == \"function\";\n")
+	for _, prefix := range networks {
+		if prefix.Addr().Is4() {
+			mask := net.CIDRMask(prefix.Bits(), 32)
+			fmt.Fprintf(&b, "\tif (v4 && isInNet(host, %q, %q))\n\t\treturn \"DIRECT\";\n", prefix.Addr(), net.IP(mask).String())
+		} else {
+			fmt.Fprintf(&b, "\tif (v6 && isInNetEx(host, %q))\n\t\treturn \"DIRECT\";\n", prefix)
+		}
+	}
+
+	fmt.Fprintf(&b, "\treturn %q;\n}\n", pacProxies(addr, protocols))
+	return b.String()
+}
+
+// pacProxies lists addr once for every protocol served there that browsers
+// know, HTTP first
+func pacProxies(addr string, protocols []string) string {
+	serves := func(protocol string) bool {
+		return len(protocols) == 0 || slices.Contains(protocols, protocol)
+	}
+	var proxies []string
+	if serves(statute.ProtocolHTTP) {
+		proxies = append(proxies, "PROXY "+addr)
+	}
+	if serves(statute.ProtocolSOCKS5) {
+		proxies = append(proxies, "SOCKS5 "+addr)
+	} else if serves(statute.ProtocolSOCKS4) {
+		proxies = append(proxies, "SOCKS "+addr)
+	}
+	return strings.Join(proxies, "; ")
+}
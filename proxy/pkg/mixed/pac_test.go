@@ -0,0 +1,123 @@
+package mixed
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+)
+
+func TestGeneratePAC(t *testing.T) {
+	tests := []struct {
+		name    string
+		bypass  []string
+		want    []string
+		notWant []string
+	}{{
+		name: "defaults",
+		want: []string{
+			"if (isPlainHostName(host) || host == \"localhost\")\n\t\treturn \"DIRECT\";\n",
+			"if (v4 && isInNet(host, \"192.168.0.0\", \"255.255.0.0\"))\n\t\treturn \"DIRECT\";\n",
+			"if (v6 && isInNetEx(host, \"fc00::/7\"))\n\t\treturn \"DIRECT\";\n",
+		},
+		notWant: []string{"dnsDomainIs"},
+	}, {
+		name:   "domains",
+		bypass: []string{"Example.COM", "*.example.org", ".example.net."},
+		want: []string{
+			"if (host == \"example.com\" || dnsDomainIs(host, \".example.com\"))\n",
+			"if (host == \"example.org\" || dnsDomainIs(host, \".example.org\"))\n",
+			"if (host == \"example.net\" || dnsDomainIs(host, \".example.net\"))\n",
+		},
+	}, {
+		name:   "networks",
+		bypass: []string{"198.51.100.7/24", "203.0.113.9", "2001:db8::1/32", "2001:db8:1::1"},
+		want: []string{
+			"isInNet(host, \"198.51.100.0\", \"255.255.255.0\")",
+			"isInNet(host, \"203.0.113.9\", \"255.255.255.255\")",
+			"isInNetEx(host, \"2001:db8::/32\")",
+			"isInNetEx(host, \"2001:db8:1::1/128\")",
+		},
+		notWant: []string{"dnsDomainIs"},
+	}, {
+		name:    "blank rules",
+		bypass:  []string{"", "  ", " example.com "},
+		want:    []string{"dnsDomainIs(host, \".example.com\")"},
+		notWant: []string{"dnsDomainIs(host, \".\")"},
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pac := generatePAC("192.0.2.1:8086", nil, test.bypass)
+			qt.Assert(t, strings.HasPrefix(pac, "function FindProxyForURL(url, host) {\n"), qt.IsTrue)
+			qt.Assert(t, strings.HasSuffix(pac, "\treturn \"PROXY 192.0.2.1:8086; SOCKS5 192.0.2.1:8086\";\n}\n"), qt.IsTrue, qt.Commentf("%s", pac))
+			for _, want := range test.want {
+				qt.Check(t, pac, qt.Contains, want)
+			}
+			for _, notWant := range test.notWant {
+				qt.Check(t, strings.Contains(pac, notWant), qt.IsFalse, qt.Commentf("%q in\n%s", notWant, pac))
+			}
+		})
+	}
+}
+
+func TestPACProxies(t *testing.T) {
+	tests := []struct {
+		protocols []string
+		want      string
+	}{
+		{nil, "PROXY 192.0.2.1:8086; SOCKS5 192.0.2.1:8086"},
+		{[]string{statute.ProtocolHTTP}, "PROXY 192.0.2.1:8086"},
+		{[]string{statute.ProtocolHTTP, statute.ProtocolSOCKS5}, "PROXY 192.0.2.1:8086; SOCKS5 192.0.2.1:8086"},
+		{[]string{statute.ProtocolSOCKS4, statute.ProtocolHTTP}, "PROXY 192.0.2.1:8086; SOCKS 192.0.2.1:8086"},
+		{[]string{statute.ProtocolSOCKS5, statute.ProtocolSOCKS4}, "SOCKS5 192.0.2.1:8086"},
+	}
+	for _, test := range tests {
+		qt.Check(t, pacProxies("192.0.2.1:8086", test.protocols), qt.Equals, test.want, qt.Commentf("protocols %v", test.protocols))
+	}
+}
+
+func TestServePAC(t *testing.T) {
+	p := NewProxy(WithBindAddress("0.0.0.0:8086"))
+
+	serve := func(local net.Addr, protocols []string) *httptest.ResponseRecorder {
+		ctx := context.WithValue(context.Background(), http.LocalAddrContextKey, local)
+		if protocols != nil {
+			ctx = context.WithValue(ctx, protocolsKey{}, protocols)
+		}
+		r := httptest.NewRequest(http.MethodGet, "/proxy.pac", nil).WithContext(ctx)
+		w := httptest.NewRecorder()
+		p.localHandler().ServeHTTP(w, r)
+		return w
+	}
+
+	// the address the client reached the proxy on is announced
+	w := serve(&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 8086}, []string{statute.ProtocolHTTP})
+	qt.Assert(t, w.Code, qt.Equals, http.StatusOK)
+	qt.Assert(t, w.Header().Get("Content-Type"), qt.Equals, "application/x-ns-proxy-autoconfig")
+	qt.Assert(t, w.Body.String(), qt.Contains, "return \"PROXY 192.0.2.1:8086\";")
+
+	// unix socket clients get no PAC file
+	w = serve(&net.UnixAddr{Name: "/run/warp.sock", Net: "unix"}, nil)
+	qt.Assert(t, w.Code, qt.Equals, http.StatusNotFound)
+
+	// a served listener passes its protocols on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	qt.Assert(t, err, qt.IsNil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = NewProxy(WithContext(ctx)).Serve(ln, statute.ProtocolHTTP) }()
+	resp, err := http.Get("http://" + ln.Addr().String() + "/proxy.pac")
+	qt.Assert(t, err, qt.IsNil)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, string(body), qt.Contains, "return \"PROXY "+ln.Addr().String()+"\";")
+}
@@ -3,8 +3,15 @@ package mixed
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"log/slog"
 	"net"
+	nethttp "net/http"
+	"net/netip"
+	"slices"
+	"time"
 
 	"github.com/bepass-org/warp-plus/proxy/pkg/http"
 	"github.com/bepass-org/warp-plus/proxy/pkg/socks4"
@@ -12,6 +19,22 @@ import (
 	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
 )
 
+const (
+	// rejectTimeout bounds how long a refused client may take to send its request
+	rejectTimeout = 10 * time.Second
+	// tlsHandshakeTimeout bounds the TLS handshake of a wrapped client
+	tlsHandshakeTimeout = 10 * time.Second
+	// tlsRecordHandshake is the first byte of a TLS ClientHello
+	tlsRecordHandshake = 0x16
+	// minAcceptDelay and maxAcceptDelay bound the backoff after failed accepts
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+// DefaultHandshakeTimeout bounds how long a client may take to send its first
+// byte unless WithHandshakeTimeout sets another limit
+const DefaultHandshakeTimeout = 30 * time.Second
+
 type userHandler func(request *statute.ProxyRequest) error
 
 type Proxy struct {
@@ -38,6 +61,30 @@ type Proxy struct {
 	logger *slog.Logger
 	// ctx is default context
 	ctx context.Context
+	// acl restricts which clients are served, nil serves everyone
+	acl *AccessControl
+	// sources counts live connections per client for acl
+	sources sourceTracker
+	// pacBypass lists the domains and networks the PAC file sends directly
+	pacBypass []string
+	// statusHandler serves the landing page for browsers opening the proxy address
+	statusHandler nethttp.Handler
+	// tlsConfig terminates TLS wrapped clients before protocol detection, nil
+	// treats every client as plaintext
+	tlsConfig *tls.Config
+	// maxConns caps the concurrent connections of all clients, zero means no
+	// limit
+	maxConns int
+	// handshakeTimeout drops clients that do not start their protocol in time
+	handshakeTimeout time.Duration
+	// proxyProtocol lists the balancers whose connections start with a PROXY
+	// protocol header naming the real client
+	proxyProtocol []netip.Prefix
+	// slots holds a token for every connection being served, nil when
+	// maxConns is unlimited
+	slots chan struct{}
+	// ready reports whether clients can be served yet, nil always serves
+	ready func() bool
 }
 
 func NewProxy(options ...Option) *Proxy {
@@ -49,11 +96,17 @@ func NewProxy(options ...Option) *Proxy {
 		userDialFunc: statute.DefaultProxyDial(),
 		logger:       slog.Default(),
 		ctx:          statute.DefaultContext(),
+
+		handshakeTimeout: DefaultHandshakeTimeout,
 	}
 
 	for _, option := range options {
 		option(p)
 	}
+	p.httpProxy.Handler = p.localHandler()
+	if p.maxConns > 0 {
+		p.slots = make(chan struct{}, p.maxConns)
+	}
 
 	return p
 }
@@ -79,6 +132,11 @@ func (c *SwitchConn) Read(p []byte) (n int, err error) {
 	return c.Reader.Read(p)
 }
 
+// CloseWrite half-closes the wrapped connection
+func (c *SwitchConn) CloseWrite() error {
+	return statute.CloseWrite(c.Conn)
+}
+
 func (p *Proxy) ListenAndServe() error {
 	// Create a new listener
 	if p.listener == nil {
@@ -89,12 +147,20 @@ func (p *Proxy) ListenAndServe() error {
 		p.listener = ln
 	}
 
-	p.bind = p.listener.Addr().(*net.TCPAddr).String()
-	p.logger.Debug("started proxy", "address", p.bind)
+	p.bind = p.listener.Addr().String()
+	return p.Serve(p.listener)
+}
+
+// Serve accepts clients on ln until it fails or the proxy context is done.
+// When protocols are given only clients speaking one of them are served, the
+// others are refused. Serve may be called for several listeners at once,
+// they share the connection limits of the proxy.
+func (p *Proxy) Serve(ln net.Listener, protocols ...string) error {
+	p.logger.Debug("started proxy", "address", ln.Addr(), "protocols", protocols)
 
 	// ensure listener will be closed
 	defer func() {
-		_ = p.listener.Close()
+		_ = ln.Close()
 	}()
 
 	// Create a cancelable context based on p.Context
@@ -102,33 +168,100 @@ func (p *Proxy) ListenAndServe() error {
 	defer cancel() // Ensure resources are cleaned up
 
 	// Start to accept connections and serve them
+	var acceptDelay time.Duration
 	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-			conn, err := p.listener.Accept()
-			if err != nil {
-				p.logger.Error(err.Error())
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+
+			// back off so running out of file descriptors does not spin
+			if acceptDelay == 0 {
+				acceptDelay = minAcceptDelay
+			} else {
+				acceptDelay = min(2*acceptDelay, maxAcceptDelay)
+			}
+			p.logger.Error("failed to accept connection", "error", err, "retry", acceptDelay)
+			select {
+			case <-time.After(acceptDelay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			continue
+		}
+		acceptDelay = 0
+
+		if p.slots != nil {
+			// the limit is shared by all listeners, a client over it is
+			// dropped before it costs a goroutine
+			select {
+			case p.slots <- struct{}{}:
+			default:
+				p.logger.Warn("rejected client", "address", conn.RemoteAddr(), "reason", "too many connections")
+				_ = conn.Close()
 				continue
 			}
+		}
 
-			// Start a new goroutine to handle each connection
-			// This way, the server can handle multiple connections concurrently
-			go func() {
-				defer conn.Close()
-				err := p.handleConnection(conn)
-				if err != nil {
-					p.logger.Error(err.Error()) // Log errors from ServeConn
+		// Start a new goroutine to handle each connection
+		// This way, the server can handle multiple connections concurrently
+		go func() {
+			defer func() {
+				_ = conn.Close()
+				if p.slots != nil {
+					<-p.slots
 				}
 			}()
-		}
+			err := p.handleConnection(conn, protocols)
+			if err != nil {
+				p.logger.Error(err.Error()) // Log errors from ServeConn
+			}
+		}()
 	}
 }
 
-func (p *Proxy) handleConnection(conn net.Conn) error {
+func (p *Proxy) handleConnection(conn net.Conn, protocols []string) error {
 	// Create a SwitchConn
 	switchConn := NewSwitchConn(conn)
+	if p.handshakeTimeout > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(p.handshakeTimeout))
+	}
+
+	if p.trustsProxyHeader(conn) {
+		remote, err := readProxyHeader(switchConn.Reader)
+		if err != nil {
+			return fmt.Errorf("PROXY protocol header from %s: %w", conn.RemoteAddr(), err)
+		}
+		if remote != nil {
+			// everything after this point sees the real client
+			switchConn.Conn = &proxyConn{Conn: conn, remote: remote}
+		}
+	}
+
+	// count the client against its source limit before it sends anything,
+	// idle connections hold resources as well
+	var reason string
+	// HTTP clients learn from the status whether trying again later helps
+	status := nethttp.StatusForbidden
+	if p.acl != nil && !isUnix(conn) {
+		addr := sourceAddr(switchConn)
+		reason = p.acl.check(addr)
+		if reason == "" {
+			if p.sources.acquire(addr, p.acl.MaxConnsPerSource) {
+				defer p.sources.release(addr)
+			} else {
+				reason = "too many connections"
+			}
+		}
+	}
+	if reason == "" && p.ready != nil && !p.ready() {
+		reason = "not ready"
+		status = nethttp.StatusServiceUnavailable
+	}
 
 	// Peek one byte to determine the protocol
 	buf, err := switchConn.Peek(1)
@@ -136,14 +269,84 @@ func (p *Proxy) handleConnection(conn net.Conn) error {
 		return err
 	}
 
+	if buf[0] == tlsRecordHandshake && p.tlsConfig != nil {
+		// detect the proxy protocol again on the decrypted stream, refused
+		// clients are answered on it as well
+		tlsConn := tls.Server(switchConn, p.tlsConfig)
+		_ = tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+		if err := tlsConn.HandshakeContext(p.ctx); err != nil {
+			return err
+		}
+		if p.handshakeTimeout > 0 {
+			_ = tlsConn.SetDeadline(time.Now().Add(p.handshakeTimeout))
+		} else {
+			_ = tlsConn.SetDeadline(time.Time{})
+		}
+
+		switchConn = NewSwitchConn(tlsConn)
+		if buf, err = switchConn.Peek(1); err != nil {
+			return err
+		}
+	}
+
+	if reason != "" {
+		p.logger.Warn("rejected client", "address", switchConn.RemoteAddr(), "reason", reason)
+		return p.reject(switchConn, buf[0], status)
+	}
+	if len(protocols) > 0 && !slices.Contains(protocols, detectProtocol(buf[0])) {
+		p.logger.Warn("rejected client", "address", switchConn.RemoteAddr(), "reason", "protocol is not served on "+conn.LocalAddr().String())
+		return p.reject(switchConn, buf[0], nethttp.StatusForbidden)
+	}
+	_ = switchConn.SetDeadline(time.Time{})
+
 	switch buf[0] {
 	case 5:
 		err = p.socks5Proxy.ServeConn(switchConn)
 	case 4:
 		err = p.socks4Proxy.ServeConn(switchConn)
 	default:
-		err = p.httpProxy.ServeConn(switchConn)
+		// the PAC file offers the protocols of the listener
+		ctx := context.WithValue(p.ctx, protocolsKey{}, protocols)
+		err = p.httpProxy.ServeConnContext(ctx, switchConn)
 	}
 
 	return err
 }
+
+// detectProtocol names the inbound protocol a client starting with first
+// speaks
+func detectProtocol(first byte) string {
+	switch first {
+	case 5:
+		return statute.ProtocolSOCKS5
+	case 4:
+		return statute.ProtocolSOCKS4
+	default:
+		return statute.ProtocolHTTP
+	}
+}
+
+// isUnix reports whether conn arrived on a unix socket, those are guarded by
+// file permissions rather than source addresses
+func isUnix(conn net.Conn) bool {
+	_, ok := conn.LocalAddr().(*net.UnixAddr)
+	return ok
+}
+
+// reject answers a refused client in its own protocol instead of just
+// dropping the socket, HTTP clients get status
+func (p *Proxy) reject(conn *SwitchConn, version byte, status int) error {
+	_ = conn.SetDeadline(time.Now().Add(rejectTimeout))
+
+	switch version {
+	case 5:
+		return socks5.RejectConn(conn)
+	case 4:
+		return socks4.RejectConn(conn)
+	case tlsRecordHandshake:
+		// TLS is not configured, there is no plaintext way to answer
+		return nil
+	default:
+		return http.RejectConn(conn, status)
+	}
+}
@@ -0,0 +1,154 @@
+package mixed
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"math/big"
+	"net"
+	nethttp "net/http"
+	"net/netip"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+)
+
+// testCertificate returns a self-signed certificate for 127.0.0.1
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	qt.Assert(t, err, qt.IsNil)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	qt.Assert(t, err, qt.IsNil)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// startProxy serves a proxy built from options on a loopback listener until
+// the test ends
+func startProxy(t *testing.T, options ...Option) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	qt.Assert(t, err, qt.IsNil)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	p := NewProxy(append(options, WithContext(ctx))...)
+	go func() { _ = p.Serve(ln) }()
+	return ln.Addr().String()
+}
+
+// connectStatus sends a CONNECT request over conn and returns the status code
+// of the answer
+func connectStatus(t *testing.T, conn net.Conn) int {
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err := conn.Write([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"))
+	qt.Assert(t, err, qt.IsNil)
+	resp, err := nethttp.ReadResponse(bufio.NewReader(conn), nil)
+	qt.Assert(t, err, qt.IsNil)
+	_ = resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestRejectDeniedClient(t *testing.T) {
+	deny := WithAccessControl(AccessControl{Deny: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}})
+	addr := startProxy(t, deny)
+
+	conn, err := net.Dial("tcp", addr)
+	qt.Assert(t, err, qt.IsNil)
+	defer conn.Close()
+	qt.Assert(t, connectStatus(t, conn), qt.Equals, nethttp.StatusForbidden)
+}
+
+func TestRejectNotReady(t *testing.T) {
+	ready := false
+	addr := startProxy(t, WithReadyCheck(func() bool { return ready }))
+
+	// a proxy that is not ready yet asks the client to come back
+	conn, err := net.Dial("tcp", addr)
+	qt.Assert(t, err, qt.IsNil)
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"))
+	qt.Assert(t, err, qt.IsNil)
+	resp, err := nethttp.ReadResponse(bufio.NewReader(conn), nil)
+	qt.Assert(t, err, qt.IsNil)
+	_ = resp.Body.Close()
+	qt.Assert(t, resp.StatusCode, qt.Equals, nethttp.StatusServiceUnavailable)
+	qt.Assert(t, resp.Header.Get("Retry-After"), qt.Equals, "5")
+}
+
+func TestRejectDeniedTLSClient(t *testing.T) {
+	deny := WithAccessControl(AccessControl{Deny: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}})
+	config := &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}}
+	addr := startProxy(t, deny, WithTLSConfig(config))
+
+	// the refusal is answered inside the TLS session
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	qt.Assert(t, err, qt.IsNil)
+	defer conn.Close()
+	qt.Assert(t, connectStatus(t, conn), qt.Equals, nethttp.StatusForbidden)
+}
+
+func TestMaxConnectionsSharedByListeners(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	// tunnels stay open until the client leaves
+	hold := WithUserTCPHandler(func(req *statute.ProxyRequest) error {
+		_, err := io.Copy(io.Discard, req.Conn)
+		return err
+	})
+	p := NewProxy(WithContext(ctx), WithMaxConnections(1), hold)
+
+	var addrs []string
+	for range 2 {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		qt.Assert(t, err, qt.IsNil)
+		go func() { _ = p.Serve(ln) }()
+		addrs = append(addrs, ln.Addr().String())
+	}
+
+	// an idle listener holds no slot, the second one serves the only client
+	first, err := net.Dial("tcp", addrs[1])
+	qt.Assert(t, err, qt.IsNil)
+	defer first.Close()
+	qt.Assert(t, connectStatus(t, first), qt.Equals, nethttp.StatusOK)
+
+	// while it is connected clients of either listener are dropped
+	for _, addr := range addrs {
+		conn, err := net.Dial("tcp", addr)
+		qt.Assert(t, err, qt.IsNil)
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		qt.Assert(t, err, qt.Equals, io.EOF)
+		_ = conn.Close()
+	}
+
+	// the slot is free again once the client leaves
+	_ = first.Close()
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", addrs[0])
+		qt.Assert(t, err, qt.IsNil)
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, _ = conn.Write([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"))
+		resp, err := nethttp.ReadResponse(bufio.NewReader(conn), nil)
+		_ = conn.Close()
+		if err == nil {
+			qt.Assert(t, resp.StatusCode, qt.Equals, nethttp.StatusOK)
+			break
+		}
+		qt.Assert(t, i < 100, qt.IsTrue, qt.Commentf("slot was not released"))
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,161 @@
+package mixed
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+)
+
+const (
+	// proxyV1MaxLength is the longest v1 header line including CRLF
+	proxyV1MaxLength = 107
+	proxyV1Prefix    = "PROXY "
+)
+
+// proxyV2Signature starts every PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errNoProxyHeader = errors.New("missing PROXY protocol header")
+
+// proxyConn reports the client address recovered from a PROXY protocol
+// header instead of the address of the balancer
+type proxyConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *proxyConn) CloseWrite() error {
+	return statute.CloseWrite(c.Conn)
+}
+
+// trustsProxyHeader reports whether conn comes from a balancer that sends
+// PROXY protocol headers
+func (p *Proxy) trustsProxyHeader(conn net.Conn) bool {
+	addr := sourceAddr(conn)
+	for _, prefix := range p.proxyProtocol {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyHeader consumes a v1 or v2 PROXY protocol header from r. It
+// returns the original client address, or nil when the balancer sent a
+// health check or a connection of unknown origin.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case proxyV1Prefix[0]:
+		return readProxyV1(r)
+	case proxyV2Signature[0]:
+		return readProxyV2(r)
+	default:
+		return nil, errNoProxyHeader
+	}
+}
+
+// readProxyV1 parses the text header "PROXY TCP4 src dst sport dport\r\n"
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLength {
+			return nil, errors.New("PROXY protocol v1 header is too long")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != strings.TrimSpace(proxyV1Prefix) {
+		return nil, errNoProxyHeader
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol v1 family %q", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, errors.New("malformed PROXY protocol v1 header")
+	}
+
+	ip, err := netip.ParseAddr(fields[2])
+	if err != nil || ip.Is4() != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("invalid PROXY protocol v1 source address %q", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol v1 source port %q", fields[4])
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+}
+
+// readProxyV2 parses the binary header, TLVs after the addresses are skipped
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var header [16]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) {
+		return nil, errNoProxyHeader
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", header[12]>>4)
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	switch command := header[12] & 0x0f; command {
+	case 0:
+		// LOCAL, the balancer speaks for itself
+		return nil, nil
+	case 1:
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol v2 command %d", command)
+	}
+
+	var src netip.Addr
+	var port []byte
+	switch family := header[13] >> 4; family {
+	case 1:
+		if len(body) < 12 {
+			return nil, errors.New("short PROXY protocol v2 IPv4 addresses")
+		}
+		src = netip.AddrFrom4([4]byte(body[:4]))
+		port = body[8:10]
+	case 2:
+		if len(body) < 36 {
+			return nil, errors.New("short PROXY protocol v2 IPv6 addresses")
+		}
+		src = netip.AddrFrom16([16]byte(body[:16])).Unmap()
+		port = body[32:34]
+	default:
+		// unspecified or unix addresses carry nothing useful for us
+		return nil, nil
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, binary.BigEndian.Uint16(port))), nil
+}
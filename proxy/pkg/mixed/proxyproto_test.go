@@ -0,0 +1,103 @@
+package mixed
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// proxyV2 builds a v2 header with the given version and command byte, family
+// and address byte and body
+func proxyV2(versionCommand, family byte, body []byte) string {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, versionCommand, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(body)))
+	return string(append(header, body...))
+}
+
+// counting returns n bytes counting up from start
+func counting(start, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(start + i)
+	}
+	return b
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv4 := append(counting(1, 8), 0x1f, 0x90, 0x00, 0x50)
+	ipv6 := append(counting(1, 32), 0x1f, 0x90, 0x00, 0x50)
+	mapped := append(append(make([]byte, 10), 0xff, 0xff, 192, 0, 2, 1), counting(0, 16)...)
+	mapped = append(mapped, 0x1f, 0x90, 0x00, 0x50)
+
+	tests := []struct {
+		name   string
+		header string
+		want   string
+		err    string
+	}{
+		// v1
+		{name: "v1 tcp4", header: "PROXY TCP4 192.0.2.1 198.51.100.1 8080 80\r\n", want: "192.0.2.1:8080"},
+		{name: "v1 tcp6", header: "PROXY TCP6 2001:db8::1 2001:db8::2 8080 80\r\n", want: "[2001:db8::1]:8080"},
+		{name: "v1 unknown", header: "PROXY UNKNOWN\r\n"},
+		{name: "v1 unknown with addresses", header: "PROXY UNKNOWN 192.0.2.1 198.51.100.1 8080 80\r\n"},
+		{name: "v1 truncated", header: "PROXY TCP4 192.0.2.1", err: "EOF"},
+		{name: "v1 without crlf", header: "PROXY TCP4 192.0.2.1 198.51.100.1 8080 80\n", err: "EOF"},
+		{name: "v1 oversized", header: "PROXY TCP6 " + strings.Repeat("f", proxyV1MaxLength) + "\r\n", err: "PROXY protocol v1 header is too long"},
+		{name: "v1 wrong prefix", header: "PROXI TCP4 192.0.2.1 198.51.100.1 8080 80\r\n", err: "missing PROXY protocol header"},
+		{name: "v1 family", header: "PROXY UDP4 192.0.2.1 198.51.100.1 8080 80\r\n", err: `unsupported PROXY protocol v1 family "UDP4"`},
+		{name: "v1 missing port", header: "PROXY TCP4 192.0.2.1 198.51.100.1 8080\r\n", err: "malformed PROXY protocol v1 header"},
+		{name: "v1 family mismatch", header: "PROXY TCP4 2001:db8::1 2001:db8::2 8080 80\r\n", err: `invalid PROXY protocol v1 source address "2001:db8::1"`},
+		{name: "v1 bad address", header: "PROXY TCP4 192.0.2 198.51.100.1 8080 80\r\n", err: `invalid PROXY protocol v1 source address "192.0.2"`},
+		{name: "v1 bad port", header: "PROXY TCP4 192.0.2.1 198.51.100.1 65536 80\r\n", err: `invalid PROXY protocol v1 source port "65536"`},
+		// v2
+		{name: "v2 tcp4", header: proxyV2(0x21, 0x11, ipv4), want: "1.2.3.4:8080"},
+		{name: "v2 tcp6", header: proxyV2(0x21, 0x21, ipv6), want: "[102:304:506:708:90a:b0c:d0e:f10]:8080"},
+		{name: "v2 v4-mapped", header: proxyV2(0x21, 0x21, mapped), want: "192.0.2.1:8080"},
+		{name: "v2 tlvs", header: proxyV2(0x21, 0x11, append(ipv4, 0x04, 0x00, 0x01, 0x00)), want: "1.2.3.4:8080"},
+		{name: "v2 local", header: proxyV2(0x20, 0x00, nil)},
+		{name: "v2 local with addresses", header: proxyV2(0x20, 0x11, ipv4)},
+		{name: "v2 unspecified", header: proxyV2(0x21, 0x00, nil)},
+		{name: "v2 unix", header: proxyV2(0x21, 0x31, make([]byte, 216))},
+		{name: "v2 truncated header", header: proxyV2(0x21, 0x11, ipv4)[:14], err: "unexpected EOF"},
+		{name: "v2 truncated body", header: proxyV2(0x21, 0x11, ipv4)[:20], err: "unexpected EOF"},
+		{name: "v2 short ipv4", header: proxyV2(0x21, 0x11, ipv4[:8]), err: "short PROXY protocol v2 IPv4 addresses"},
+		{name: "v2 short ipv6", header: proxyV2(0x21, 0x21, ipv4), err: "short PROXY protocol v2 IPv6 addresses"},
+		{name: "v2 bad signature", header: "\r\n\r\n\x00\r\nQUIT!" + proxyV2(0x21, 0x11, ipv4)[12:], err: "missing PROXY protocol header"},
+		{name: "v2 version", header: proxyV2(0x11, 0x11, ipv4), err: "unsupported PROXY protocol version 1"},
+		{name: "v2 command", header: proxyV2(0x22, 0x11, ipv4), err: "unsupported PROXY protocol v2 command 2"},
+		// neither
+		{name: "socks5", header: "\x05\x01\x00", err: "missing PROXY protocol header"},
+		{name: "empty", header: "", err: "EOF"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(test.header + "payload"))
+			if test.err != "" {
+				// cut the stream after the header so truncation is visible
+				r = bufio.NewReader(strings.NewReader(test.header))
+			}
+			addr, err := readProxyHeader(r)
+			if test.err != "" {
+				qt.Assert(t, err, qt.ErrorMatches, test.err)
+				return
+			}
+			qt.Assert(t, err, qt.IsNil)
+			if test.want == "" {
+				qt.Assert(t, addr, qt.IsNil)
+			} else {
+				qt.Assert(t, addr.String(), qt.Equals, test.want)
+			}
+
+			// the header is consumed entirely and nothing more
+			rest, err := io.ReadAll(r)
+			qt.Assert(t, err, qt.IsNil)
+			qt.Assert(t, string(rest), qt.Equals, "payload")
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package shadowsocks
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+)
+
+// address types of the SOCKS5 style target address
+const (
+	ipv4Address = 0x01
+	fqdnAddress = 0x03
+	ipv6Address = 0x04
+)
+
+var errUnrecognizedAddrType = errors.New("unrecognized address type")
+
+// address is the target of a request, either an IP or a host name
+type address struct {
+	Name string
+	IP   netip.Addr
+	Port int
+}
+
+func (a *address) Network() string { return "shadowsocks" }
+
+func (a *address) String() string {
+	if a.Name != "" {
+		return net.JoinHostPort(a.Name, strconv.Itoa(a.Port))
+	}
+	return netip.AddrPortFrom(a.IP, uint16(a.Port)).String()
+}
+
+func (a *address) Host() string {
+	if a.Name != "" {
+		return a.Name
+	}
+	return a.IP.String()
+}
+
+func readAddr(r io.Reader) (*address, error) {
+	var addrType [1]byte
+	if _, err := io.ReadFull(r, addrType[:]); err != nil {
+		return nil, err
+	}
+
+	addr := &address{}
+	switch addrType[0] {
+	case ipv4Address, ipv6Address:
+		size := 4
+		if addrType[0] == ipv6Address {
+			size = 16
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return nil, err
+		}
+		addr.IP, _ = netip.AddrFromSlice(ip)
+	case fqdnAddress:
+		var length [1]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return nil, err
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return nil, err
+		}
+		addr.Name = string(name)
+	default:
+		return nil, errUnrecognizedAddrType
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return nil, err
+	}
+	addr.Port = int(binary.BigEndian.Uint16(port[:]))
+	return addr, nil
+}
+
+// appendAddr encodes a host:port string in the SOCKS5 address format
+func appendAddr(b []byte, hostPort string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	if ip, err := netip.ParseAddr(host); err == nil {
+		ip = ip.Unmap()
+		if ip.Is4() {
+			b = append(b, ipv4Address)
+		} else {
+			b = append(b, ipv6Address)
+		}
+		b = append(b, ip.AsSlice()...)
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name too long: %s", host)
+		}
+		b = append(b, fqdnAddress, byte(len(host)))
+		b = append(b, host...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
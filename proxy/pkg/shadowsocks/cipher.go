@@ -0,0 +1,168 @@
+package shadowsocks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"sort"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"lukechampine.com/blake3"
+)
+
+const (
+	legacySubkeyInfo  = "ss-subkey"
+	sessionKeyContext = "shadowsocks 2022 session subkey"
+)
+
+type cipherSpec struct {
+	keySize int
+	newAEAD func(key []byte) (cipher.AEAD, error)
+	// is2022 selects the SIP022 protocol with a pre-shared key instead of a
+	// password derived one
+	is2022 bool
+}
+
+var ciphers = map[string]cipherSpec{
+	"aes-128-gcm":                   {16, newGCM, false},
+	"aes-192-gcm":                   {24, newGCM, false},
+	"aes-256-gcm":                   {32, newGCM, false},
+	"chacha20-ietf-poly1305":        {32, chacha20poly1305.New, false},
+	"2022-blake3-aes-128-gcm":       {16, newGCM, true},
+	"2022-blake3-aes-256-gcm":       {32, newGCM, true},
+	"2022-blake3-chacha20-poly1305": {32, chacha20poly1305.New, true},
+}
+
+// Methods lists the supported cipher names
+func Methods() []string {
+	methods := make([]string, 0, len(ciphers))
+	for method := range ciphers {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// Cipher holds the key material of one Shadowsocks method
+type Cipher struct {
+	spec cipherSpec
+	key  []byte
+	// block encrypts the separate header of 2022 AES UDP packets
+	block cipher.Block
+	// xaead seals whole 2022 chacha20 UDP packets
+	xaead cipher.AEAD
+}
+
+// NewCipher creates the cipher of method. Legacy AEAD methods derive their
+// key from password, 2022 methods expect a base64 encoded key of the
+// method's key size.
+func NewCipher(method, password string) (*Cipher, error) {
+	spec, ok := ciphers[method]
+	if !ok {
+		return nil, fmt.Errorf("unsupported shadowsocks method %q", method)
+	}
+
+	c := &Cipher{spec: spec}
+	if !spec.is2022 {
+		c.key = kdf(password, spec.keySize)
+		return c, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(password)
+	if err != nil {
+		return nil, fmt.Errorf("invalid shadowsocks 2022 key: %w", err)
+	}
+	if len(key) != spec.keySize {
+		return nil, fmt.Errorf("shadowsocks 2022 key of %s must be %d bytes, got %d", method, spec.keySize, len(key))
+	}
+	c.key = key
+
+	if method == "2022-blake3-chacha20-poly1305" {
+		c.xaead, err = chacha20poly1305.NewX(key)
+	} else {
+		c.block, err = aes.NewCipher(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Cipher) saltSize() int {
+	return c.spec.keySize
+}
+
+// subkey derives the session key for the salt (or 2022 UDP session ID)
+// chosen by the sending side
+func (c *Cipher) subkey(salt []byte) ([]byte, error) {
+	subkey := make([]byte, c.spec.keySize)
+	if c.spec.is2022 {
+		material := make([]byte, 0, len(c.key)+len(salt))
+		material = append(append(material, c.key...), salt...)
+		blake3.DeriveKey(subkey, sessionKeyContext, material)
+		return subkey, nil
+	}
+	r := hkdf.New(sha1.New, c.key, salt, []byte(legacySubkeyInfo))
+	if _, err := io.ReadFull(r, subkey); err != nil {
+		return nil, err
+	}
+	return subkey, nil
+}
+
+// aead returns the session cipher for salt
+func (c *Cipher) aead(salt []byte) (cipher.AEAD, error) {
+	subkey, err := c.subkey(salt)
+	if err != nil {
+		return nil, err
+	}
+	return c.spec.newAEAD(subkey)
+}
+
+// newSalt returns a random salt and the session cipher for it
+func (c *Cipher) newSalt() ([]byte, cipher.AEAD, error) {
+	salt := make([]byte, c.saltSize())
+	if _, err := rand.Read(salt); err != nil {
+		return nil, nil, err
+	}
+	aead, err := c.aead(salt)
+	return salt, aead, err
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// kdf is OpenSSL's EVP_BytesToKey with MD5 and no salt, as used by the
+// original Shadowsocks to turn a password into a key
+func kdf(password string, keySize int) []byte {
+	var key, prev []byte
+	h := md5.New()
+	for len(key) < keySize {
+		h.Reset()
+		h.Write(prev)
+		h.Write([]byte(password))
+		prev = h.Sum(nil)
+		key = append(key, prev...)
+	}
+	return key[:keySize]
+}
+
+// increment advances a little-endian AEAD nonce
+func increment(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package shadowsocks
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// testKey returns a 2022 key of n bytes counting up from 0
+func testKey(n int) string {
+	key := make([]byte, n)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// counting returns n bytes counting up from start
+func counting(start, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(start + i)
+	}
+	return b
+}
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestKDF(t *testing.T) {
+	// EVP_BytesToKey(MD5) of the password, as derived by OpenSSL
+	qt.Assert(t, kdf("foobar", 16), qt.DeepEquals, mustHex("3858f62230ac3c915f300c664312c63f"))
+	qt.Assert(t, kdf("foobar", 32), qt.DeepEquals, mustHex("3858f62230ac3c915f300c664312c63f568378529614d22ddb49237d2f60bfdf"))
+}
+
+func TestSubkey(t *testing.T) {
+	tests := []struct {
+		method   string
+		password string
+		salt     []byte
+		want     string
+	}{
+		// HKDF-SHA1 with info "ss-subkey"
+		{"aes-128-gcm", "foobar", counting(0, 16), "e59e945699e8699144c332b9e641ef65"},
+		{"aes-256-gcm", "foobar", counting(0, 32), "c4f0e9818348b2f30188d82b37a4cddc9f5ea531070ec67225160209faff573c"},
+		{"chacha20-ietf-poly1305", "foobar", counting(0, 32), "c4f0e9818348b2f30188d82b37a4cddc9f5ea531070ec67225160209faff573c"},
+		// BLAKE3 derive_key of key and salt
+		{"2022-blake3-aes-128-gcm", testKey(16), counting(16, 16), "bc32fb8d5205f7b84f9691dfb9f04ff3"},
+		{"2022-blake3-aes-256-gcm", testKey(32), counting(32, 32), "374fca03e4dae7f998fd7e59c1edfcc8e3197f4db1c19ca1671be3b66a92ddda"},
+		{"2022-blake3-chacha20-poly1305", testKey(32), counting(32, 32), "374fca03e4dae7f998fd7e59c1edfcc8e3197f4db1c19ca1671be3b66a92ddda"},
+	}
+	for _, test := range tests {
+		t.Run(test.method, func(t *testing.T) {
+			c, err := NewCipher(test.method, test.password)
+			qt.Assert(t, err, qt.IsNil)
+			subkey, err := c.subkey(test.salt)
+			qt.Assert(t, err, qt.IsNil)
+			qt.Assert(t, hex.EncodeToString(subkey), qt.Equals, test.want)
+		})
+	}
+}
+
+func TestNewCipher(t *testing.T) {
+	for _, method := range Methods() {
+		password := "foobar"
+		if ciphers[method].is2022 {
+			password = testKey(ciphers[method].keySize)
+		}
+		_, err := NewCipher(method, password)
+		qt.Check(t, err, qt.IsNil, qt.Commentf("method %s", method))
+	}
+
+	_, err := NewCipher("rc4-md5", "foobar")
+	qt.Assert(t, err, qt.ErrorMatches, `unsupported shadowsocks method "rc4-md5"`)
+	_, err = NewCipher("2022-blake3-aes-256-gcm", testKey(16))
+	qt.Assert(t, err, qt.ErrorMatches, `shadowsocks 2022 key of 2022-blake3-aes-256-gcm must be 32 bytes, got 16`)
+	_, err = NewCipher("2022-blake3-aes-128-gcm", "not base64!")
+	qt.Assert(t, err, qt.ErrorMatches, `invalid shadowsocks 2022 key: .*`)
+}
+
+func TestIncrement(t *testing.T) {
+	nonce := []byte{0xff, 0xff, 0x00}
+	increment(nonce)
+	qt.Assert(t, nonce, qt.DeepEquals, []byte{0x00, 0x00, 0x01})
+}
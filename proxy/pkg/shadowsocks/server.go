@@ -0,0 +1,222 @@
+package shadowsocks
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+)
+
+const (
+	// handshakeTimeout bounds how long a client may take to send its request
+	handshakeTimeout = 30 * time.Second
+	// maxTimeDifference is the clock skew a 2022 client may have
+	maxTimeDifference = 30 * time.Second
+	// minAcceptDelay and maxAcceptDelay bound the backoff after failed accepts
+	// and packet reads
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+// Server is a Shadowsocks AEAD server accepting TCP and UDP on one port
+type Server struct {
+	// bind is the address to listen on
+	Bind string
+
+	Listener   net.Listener
+	PacketConn net.PacketConn
+
+	// Cipher is the method and key clients must use
+	Cipher *Cipher
+	// ProxyDial specifies the optional proxyDial function for
+	// establishing the transport connection.
+	ProxyDial statute.ProxyDialFunc
+	// ProxyListenPacket specifies the optional proxyListenPacket function for
+	// establishing the transport connection.
+	ProxyListenPacket statute.ProxyListenPacket
+	// UserConnectHandle gives the user control to handle the TCP and UDP requests
+	UserConnectHandle statute.UserConnectHandler
+	// Logger error log
+	Logger *slog.Logger
+	// Context is default context
+	Context context.Context
+	// BytesPool getting and returning temporary bytes for use by io.CopyBuffer
+	BytesPool statute.BytesPool
+
+	salts *saltFilter
+}
+
+func NewServer(options ...ServerOption) *Server {
+	s := &Server{
+		Bind:              statute.DefaultBindAddress,
+		ProxyDial:         statute.DefaultProxyDial(),
+		ProxyListenPacket: statute.DefaultProxyListenPacket(),
+		Logger:            slog.Default(),
+		Context:           statute.DefaultContext(),
+		salts:             newSaltFilter(),
+	}
+
+	for _, option := range options {
+		option(s)
+	}
+
+	return s
+}
+
+type ServerOption func(*Server)
+
+// ListenAndServe serves TCP and UDP clients until either listener fails
+func (s *Server) ListenAndServe() error {
+	if s.Cipher == nil {
+		return errors.New("shadowsocks server needs a cipher")
+	}
+
+	// Create the listeners
+	if s.Listener == nil {
+		ln, err := net.Listen("tcp", s.Bind)
+		if err != nil {
+			return err // Return error if binding was unsuccessful
+		}
+		s.Listener = ln
+	}
+	if s.PacketConn == nil {
+		pc, err := net.ListenPacket("udp", s.Listener.Addr().String())
+		if err != nil {
+			_ = s.Listener.Close()
+			return err
+		}
+		s.PacketConn = pc
+	}
+
+	s.Bind = s.Listener.Addr().String()
+	s.Logger.Debug("started shadowsocks", "address", s.Bind)
+
+	// ensure listeners will be closed
+	defer func() {
+		_ = s.Listener.Close()
+		_ = s.PacketConn.Close()
+	}()
+
+	// Create a cancelable context based on s.Context
+	ctx, cancel := context.WithCancel(s.Context)
+	defer cancel() // Ensure resources are cleaned up
+
+	errs := make(chan error, 2)
+	go func() {
+		errs <- s.servePackets(ctx)
+	}()
+	go func() {
+		errs <- s.serveStreams(ctx)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-errs:
+		return err
+	}
+}
+
+func (s *Server) serveStreams(ctx context.Context) error {
+	var acceptDelay time.Duration
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+			conn, err := s.Listener.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return err
+				}
+
+				// back off so running out of file descriptors does not spin
+				if acceptDelay == 0 {
+					acceptDelay = minAcceptDelay
+				} else {
+					acceptDelay = min(2*acceptDelay, maxAcceptDelay)
+				}
+				s.Logger.Error("failed to accept connection", "error", err, "retry", acceptDelay)
+				select {
+				case <-time.After(acceptDelay):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				continue
+			}
+			acceptDelay = 0
+
+			// Start a new goroutine to handle each connection
+			// This way, the server can handle multiple connections concurrently
+			go func() {
+				err := s.ServeConn(conn)
+				if err != nil {
+					s.Logger.Error(err.Error()) // Log errors from ServeConn
+				}
+			}()
+		}
+	}
+}
+
+func WithLogger(logger *slog.Logger) ServerOption {
+	return func(s *Server) {
+		s.Logger = logger
+	}
+}
+
+func WithBind(bindAddress string) ServerOption {
+	return func(s *Server) {
+		s.Bind = bindAddress
+	}
+}
+
+func WithListener(ln net.Listener) ServerOption {
+	return func(s *Server) {
+		s.Listener = ln
+	}
+}
+
+func WithPacketConn(pc net.PacketConn) ServerOption {
+	return func(s *Server) {
+		s.PacketConn = pc
+	}
+}
+
+func WithCipher(c *Cipher) ServerOption {
+	return func(s *Server) {
+		s.Cipher = c
+	}
+}
+
+func WithConnectHandle(handler statute.UserConnectHandler) ServerOption {
+	return func(s *Server) {
+		s.UserConnectHandle = handler
+	}
+}
+
+func WithProxyDial(proxyDial statute.ProxyDialFunc) ServerOption {
+	return func(s *Server) {
+		s.ProxyDial = proxyDial
+	}
+}
+
+func WithProxyListenPacket(proxyListenPacket statute.ProxyListenPacket) ServerOption {
+	return func(s *Server) {
+		s.ProxyListenPacket = proxyListenPacket
+	}
+}
+
+func WithContext(ctx context.Context) ServerOption {
+	return func(s *Server) {
+		s.Context = ctx
+	}
+}
+
+func WithBytesPool(bytesPool statute.BytesPool) ServerOption {
+	return func(s *Server) {
+		s.BytesPool = bytesPool
+	}
+}
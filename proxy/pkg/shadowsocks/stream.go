@@ -0,0 +1,159 @@
+package shadowsocks
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+)
+
+const (
+	// legacyMaxPayload is the largest chunk of the legacy AEAD protocol
+	legacyMaxPayload = 0x3FFF
+	// maxPayload is the largest chunk of the 2022 protocol
+	maxPayload = 0xFFFF
+	lengthSize = 2
+)
+
+var errChunkTooLarge = errors.New("shadowsocks chunk exceeds the maximum size")
+
+// streamReader decrypts the length prefixed AEAD chunks sent by a client
+type streamReader struct {
+	r          io.Reader
+	aead       cipher.AEAD
+	nonce      []byte
+	maxPayload int
+	buf        []byte
+	leftover   []byte
+}
+
+func newStreamReader(r io.Reader, aead cipher.AEAD, maxPayload int) *streamReader {
+	return &streamReader{
+		r:          r,
+		aead:       aead,
+		nonce:      make([]byte, aead.NonceSize()),
+		maxPayload: maxPayload,
+		buf:        make([]byte, maxPayload+aead.Overhead()),
+	}
+}
+
+// readChunk reads and opens one sealed chunk of n plaintext bytes. The result
+// is only valid until the next call.
+func (r *streamReader) readChunk(n int) ([]byte, error) {
+	if n > r.maxPayload {
+		return nil, errChunkTooLarge
+	}
+	buf := r.buf[:n+r.aead.Overhead()]
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		return nil, err
+	}
+	plain, err := r.aead.Open(buf[:0], r.nonce, buf, nil)
+	increment(r.nonce)
+	return plain, err
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	for len(r.leftover) == 0 {
+		header, err := r.readChunk(lengthSize)
+		if err != nil {
+			return 0, err
+		}
+		if r.leftover, err = r.readChunk(int(binary.BigEndian.Uint16(header))); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.leftover)
+	r.leftover = r.leftover[n:]
+	return n, nil
+}
+
+// streamWriter seals the data sent to a client into AEAD chunks. The salt and,
+// for 2022 methods, the response header go out with the first chunk.
+type streamWriter struct {
+	w          io.Writer
+	aead       cipher.AEAD
+	nonce      []byte
+	maxPayload int
+	salt       []byte
+	// header returns the fixed response header announcing the length of
+	// the first chunk, 2022 methods send it instead of a length chunk
+	header func(length int) []byte
+	buf    []byte
+}
+
+func newStreamWriter(w io.Writer, aead cipher.AEAD, salt []byte, maxPayload int) *streamWriter {
+	return &streamWriter{
+		w:          w,
+		aead:       aead,
+		nonce:      make([]byte, aead.NonceSize()),
+		maxPayload: maxPayload,
+		salt:       salt,
+	}
+}
+
+func (w *streamWriter) seal(dst, plain []byte) []byte {
+	dst = w.aead.Seal(dst, w.nonce, plain, nil)
+	increment(w.nonce)
+	return dst
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > w.maxPayload {
+			chunk = chunk[:w.maxPayload]
+		}
+
+		buf := w.buf[:0]
+		if w.salt != nil {
+			buf = append(buf, w.salt...)
+			w.salt = nil
+		}
+		if w.header != nil {
+			buf = w.seal(buf, w.header(len(chunk)))
+			w.header = nil
+		} else {
+			buf = w.seal(buf, binary.BigEndian.AppendUint16(nil, uint16(len(chunk))))
+		}
+		buf = w.seal(buf, chunk)
+		w.buf = buf
+
+		if _, err := w.w.Write(buf); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// streamConn is the decrypted view of a client connection
+type streamConn struct {
+	net.Conn
+	reader *streamReader
+	writer *streamWriter
+	wmu    sync.Mutex
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *streamConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.writer.Write(p)
+}
+
+// CloseWrite half-closes the underlying connection once pending writes are
+// done, every chunk is sealed on its own so nothing needs flushing
+func (c *streamConn) CloseWrite() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return statute.CloseWrite(c.Conn)
+}
@@ -0,0 +1,223 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+)
+
+// header types of the 2022 protocol
+const (
+	headerTypeClient = 0
+	headerTypeServer = 1
+)
+
+var (
+	errReplayedSalt = errors.New("shadowsocks salt was replayed")
+	errBadHeader    = errors.New("invalid shadowsocks request header")
+	errBadTimestamp = errors.New("shadowsocks request timestamp out of range")
+)
+
+// ServeConn decrypts the request of a TCP client and relays it to the target
+func (s *Server) ServeConn(conn net.Conn) error {
+	_ = conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	sc, target, err := s.handshake(conn)
+	if err != nil {
+		// a failed handshake looks the same as a slow client so the server
+		// can not be told apart by probing
+		_, _ = io.Copy(io.Discard, conn)
+		_ = conn.Close()
+		return fmt.Errorf("shadowsocks handshake from %s: %w", conn.RemoteAddr(), err)
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	// the context of the connection ends with ServeConn
+	ctx, cancel := context.WithCancel(s.Context)
+	defer cancel()
+
+	if s.UserConnectHandle == nil {
+		return s.embedHandleConnect(ctx, sc, target)
+	}
+
+	proxyReq := &statute.ProxyRequest{
+		Conn:        sc,
+		Reader:      io.Reader(sc),
+		Writer:      io.Writer(sc),
+		Network:     "tcp",
+		Destination: target.String(),
+		DestHost:    target.Host(),
+		DestPort:    int32(target.Port),
+
+		DestIsDomain: target.Name != "",
+		Protocol:     statute.ProtocolShadowsocks,
+		Source:       statute.SourceAddr(conn.RemoteAddr()),
+		Context:      ctx,
+	}
+	return s.UserConnectHandle(proxyReq)
+}
+
+func (s *Server) embedHandleConnect(ctx context.Context, conn net.Conn, target *address) error {
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	targetConn, err := s.ProxyDial(ctx, "tcp", target.String())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = targetConn.Close()
+	}()
+
+	var buf1, buf2 []byte
+	if s.BytesPool != nil {
+		buf1 = s.BytesPool.Get()
+		buf2 = s.BytesPool.Get()
+		defer func() {
+			s.BytesPool.Put(buf1)
+			s.BytesPool.Put(buf2)
+		}()
+	} else {
+		buf1 = make([]byte, 32*1024)
+		buf2 = make([]byte, 32*1024)
+	}
+	return statute.Tunnel(ctx, targetConn, conn, buf1, buf2)
+}
+
+// handshake reads the salt and request header of a client and returns the
+// decrypted connection and its target
+func (s *Server) handshake(conn net.Conn) (*streamConn, *address, error) {
+	salt := make([]byte, s.Cipher.saltSize())
+	if _, err := io.ReadFull(conn, salt); err != nil {
+		return nil, nil, err
+	}
+	aead, err := s.Cipher.aead(salt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	respSalt, respAEAD, err := s.Cipher.newSalt()
+	if err != nil {
+		return nil, nil, err
+	}
+	// the salts we send can never be accepted from a client
+	s.salts.add(respSalt)
+
+	if !s.Cipher.spec.is2022 {
+		reader := newStreamReader(conn, aead, legacyMaxPayload)
+		target, err := readAddr(reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !s.salts.add(salt) {
+			return nil, nil, errReplayedSalt
+		}
+		return &streamConn{
+			Conn:   conn,
+			reader: reader,
+			writer: newStreamWriter(conn, respAEAD, respSalt, legacyMaxPayload),
+		}, target, nil
+	}
+
+	reader := newStreamReader(conn, aead, maxPayload)
+	fixed, err := reader.readChunk(1 + 8 + lengthSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	if fixed[0] != headerTypeClient {
+		return nil, nil, errBadHeader
+	}
+	if err := checkTimestamp(binary.BigEndian.Uint64(fixed[1:9])); err != nil {
+		return nil, nil, err
+	}
+	if !s.salts.add(salt) {
+		return nil, nil, errReplayedSalt
+	}
+	variable, err := reader.readChunk(int(binary.BigEndian.Uint16(fixed[9:])))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	buf := bytes.NewReader(variable)
+	target, err := readAddr(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	var padding uint16
+	if err := binary.Read(buf, binary.BigEndian, &padding); err != nil {
+		return nil, nil, err
+	}
+	if int(padding) > buf.Len() {
+		return nil, nil, errBadHeader
+	}
+	_, _ = buf.Seek(int64(padding), io.SeekCurrent)
+	initial := make([]byte, buf.Len())
+	_, _ = buf.Read(initial)
+	if len(initial) == 0 && padding == 0 {
+		return nil, nil, errBadHeader
+	}
+	reader.leftover = initial
+
+	writer := newStreamWriter(conn, respAEAD, respSalt, maxPayload)
+	writer.header = func(length int) []byte {
+		header := make([]byte, 0, 1+8+len(salt)+lengthSize)
+		header = append(header, headerTypeServer)
+		header = binary.BigEndian.AppendUint64(header, uint64(time.Now().Unix()))
+		header = append(header, salt...)
+		return binary.BigEndian.AppendUint16(header, uint16(length))
+	}
+	return &streamConn{Conn: conn, reader: reader, writer: writer}, target, nil
+}
+
+func checkTimestamp(ts uint64) error {
+	diff := time.Since(time.Unix(int64(ts), 0))
+	if diff > maxTimeDifference || diff < -maxTimeDifference {
+		return errBadTimestamp
+	}
+	return nil
+}
+
+// saltFilter remembers recently seen salts to reject replayed requests. A
+// salt only has to be kept for twice the allowed clock skew since older 2022
+// requests fail the timestamp check anyway. Legacy requests carry no
+// timestamp, for them the filter only stops quick replays.
+type saltFilter struct {
+	mu     sync.Mutex
+	seen   map[string]time.Time
+	purged time.Time
+}
+
+func newSaltFilter() *saltFilter {
+	return &saltFilter{seen: make(map[string]time.Time), purged: time.Now()}
+}
+
+// add records salt and reports whether it was new
+func (f *saltFilter) add(salt []byte) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(f.purged) > maxTimeDifference {
+		for key, added := range f.seen {
+			if now.Sub(added) > 2*maxTimeDifference {
+				delete(f.seen, key)
+			}
+		}
+		f.purged = now
+	}
+
+	key := string(salt)
+	if _, ok := f.seen[key]; ok {
+		return false
+	}
+	f.seen[key] = now
+	return true
+}
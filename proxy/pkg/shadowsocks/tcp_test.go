@@ -0,0 +1,228 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+)
+
+var testMethods = []string{
+	"aes-128-gcm",
+	"chacha20-ietf-poly1305",
+	"2022-blake3-aes-128-gcm",
+	"2022-blake3-aes-256-gcm",
+	"2022-blake3-chacha20-poly1305",
+}
+
+func newTestCipher(t *testing.T, method string) *Cipher {
+	password := "foobar"
+	if ciphers[method].is2022 {
+		password = testKey(ciphers[method].keySize)
+	}
+	c, err := NewCipher(method, password)
+	qt.Assert(t, err, qt.IsNil)
+	return c
+}
+
+func payloadSize(c *Cipher) int {
+	if c.spec.is2022 {
+		return maxPayload
+	}
+	return legacyMaxPayload
+}
+
+// sealRequest seals the request a client sends to target with payload as its
+// first data, sent at ts. It returns the salt and the bytes on the wire.
+func sealRequest(t *testing.T, c *Cipher, target string, payload []byte, ts time.Time) ([]byte, []byte) {
+	salt, aead, err := c.newSalt()
+	qt.Assert(t, err, qt.IsNil)
+
+	var wire bytes.Buffer
+	w := newStreamWriter(&wire, aead, salt, payloadSize(c))
+	header, err := appendAddr(nil, target)
+	qt.Assert(t, err, qt.IsNil)
+	if c.spec.is2022 {
+		header = binary.BigEndian.AppendUint16(header, 0) // no padding
+		w.header = func(length int) []byte {
+			fixed := []byte{headerTypeClient}
+			fixed = binary.BigEndian.AppendUint64(fixed, uint64(ts.Unix()))
+			return binary.BigEndian.AppendUint16(fixed, uint16(length))
+		}
+	}
+	_, err = w.Write(append(header, payload...))
+	qt.Assert(t, err, qt.IsNil)
+	return salt, wire.Bytes()
+}
+
+// openResponse reads the response stream of a request with salt and returns
+// its first n bytes
+func openResponse(t *testing.T, c *Cipher, conn io.Reader, salt []byte, n int) []byte {
+	respSalt := make([]byte, c.saltSize())
+	_, err := io.ReadFull(conn, respSalt)
+	qt.Assert(t, err, qt.IsNil)
+	aead, err := c.aead(respSalt)
+	qt.Assert(t, err, qt.IsNil)
+
+	r := newStreamReader(conn, aead, payloadSize(c))
+	if c.spec.is2022 {
+		fixed, err := r.readChunk(1 + 8 + len(salt) + lengthSize)
+		qt.Assert(t, err, qt.IsNil)
+		qt.Assert(t, fixed[0], qt.Equals, byte(headerTypeServer))
+		qt.Assert(t, checkTimestamp(binary.BigEndian.Uint64(fixed[1:9])), qt.IsNil)
+		qt.Assert(t, fixed[9:9+len(salt)], qt.DeepEquals, salt)
+		length := int(binary.BigEndian.Uint16(fixed[9+len(salt):]))
+		first, err := r.readChunk(length)
+		qt.Assert(t, err, qt.IsNil)
+		r.leftover = append([]byte{}, first...)
+	}
+
+	buf := make([]byte, n)
+	_, err = io.ReadFull(r, buf)
+	qt.Assert(t, err, qt.IsNil)
+	return buf
+}
+
+// newEchoServer returns a server answering every TCP request with its first
+// five bytes, the requests are sent to requests
+func newEchoServer(c *Cipher, requests chan<- *statute.ProxyRequest) *Server {
+	return NewServer(WithCipher(c), WithConnectHandle(func(req *statute.ProxyRequest) error {
+		defer req.Conn.Close()
+		requests <- req
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(req.Conn, buf); err != nil {
+			return err
+		}
+		_, err := req.Conn.Write(buf)
+		return err
+	}))
+}
+
+// serve runs s.ServeConn on one end of a pipe and returns the other end and
+// the result of ServeConn
+func serve(s *Server) (net.Conn, <-chan error) {
+	client, server := net.Pipe()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.ServeConn(server)
+	}()
+	return client, errs
+}
+
+func TestTCPRoundTrip(t *testing.T) {
+	for _, method := range testMethods {
+		t.Run(method, func(t *testing.T) {
+			c := newTestCipher(t, method)
+			requests := make(chan *statute.ProxyRequest, 1)
+			s := newEchoServer(c, requests)
+
+			conn, errs := serve(s)
+			defer conn.Close()
+			salt, wire := sealRequest(t, c, "example.com:443", []byte("hello"), time.Now())
+			go func() { _, _ = conn.Write(wire) }()
+
+			req := <-requests
+			qt.Assert(t, req.Destination, qt.Equals, "example.com:443")
+			qt.Assert(t, req.DestIsDomain, qt.IsTrue)
+			qt.Assert(t, req.Protocol, qt.Equals, statute.ProtocolShadowsocks)
+			qt.Assert(t, openResponse(t, c, conn, salt, 5), qt.DeepEquals, []byte("hello"))
+			qt.Assert(t, <-errs, qt.IsNil)
+		})
+	}
+}
+
+// handshakeError sends wire to s and returns the error of ServeConn
+func handshakeError(s *Server, wire []byte) error {
+	conn, errs := serve(s)
+	go func() {
+		_, _ = conn.Write(wire)
+		// the server drains failed clients until they hang up
+		_ = conn.Close()
+	}()
+	return <-errs
+}
+
+func TestTCPReplayedSalt(t *testing.T) {
+	for _, method := range testMethods {
+		t.Run(method, func(t *testing.T) {
+			c := newTestCipher(t, method)
+			requests := make(chan *statute.ProxyRequest, 2)
+			s := newEchoServer(c, requests)
+
+			salt, wire := sealRequest(t, c, "192.0.2.1:80", []byte("hello"), time.Now())
+			conn, errs := serve(s)
+			go func() { _, _ = conn.Write(wire) }()
+			qt.Assert(t, openResponse(t, c, conn, salt, 5), qt.DeepEquals, []byte("hello"))
+			qt.Assert(t, <-errs, qt.IsNil)
+			_ = conn.Close()
+
+			err := handshakeError(s, wire)
+			qt.Assert(t, errors.Is(err, errReplayedSalt), qt.IsTrue, qt.Commentf("error %v", err))
+			qt.Assert(t, requests, qt.HasLen, 1)
+		})
+	}
+}
+
+func TestTCPStaleTimestamp(t *testing.T) {
+	c := newTestCipher(t, "2022-blake3-aes-128-gcm")
+	requests := make(chan *statute.ProxyRequest, 1)
+	s := newEchoServer(c, requests)
+
+	for _, ts := range []time.Time{
+		time.Now().Add(-2 * maxTimeDifference),
+		time.Now().Add(2 * maxTimeDifference),
+	} {
+		_, wire := sealRequest(t, c, "192.0.2.1:80", []byte("hello"), ts)
+		err := handshakeError(s, wire)
+		qt.Assert(t, errors.Is(err, errBadTimestamp), qt.IsTrue, qt.Commentf("error %v", err))
+	}
+	qt.Assert(t, requests, qt.HasLen, 0)
+}
+
+func TestTCPWrongKey(t *testing.T) {
+	c := newTestCipher(t, "aes-128-gcm")
+	other, err := NewCipher("aes-128-gcm", "barfoo")
+	qt.Assert(t, err, qt.IsNil)
+	requests := make(chan *statute.ProxyRequest, 1)
+	s := newEchoServer(c, requests)
+
+	_, wire := sealRequest(t, other, "192.0.2.1:80", []byte("hello"), time.Now())
+	qt.Assert(t, handshakeError(s, wire), qt.ErrorMatches, ".*message authentication failed")
+	qt.Assert(t, requests, qt.HasLen, 0)
+}
+
+func TestSaltFilter(t *testing.T) {
+	f := newSaltFilter()
+	qt.Assert(t, f.add([]byte("salt")), qt.IsTrue)
+	qt.Assert(t, f.add([]byte("salt")), qt.IsFalse)
+	qt.Assert(t, f.add([]byte("other")), qt.IsTrue)
+
+	// salts older than twice the clock skew are forgotten
+	f.seen["salt"] = time.Now().Add(-3 * maxTimeDifference)
+	f.purged = time.Now().Add(-2 * maxTimeDifference)
+	qt.Assert(t, f.add([]byte("new")), qt.IsTrue)
+	_, found := f.seen["salt"]
+	qt.Assert(t, found, qt.IsFalse)
+}
+
+func TestAddress(t *testing.T) {
+	for _, target := range []string{"192.0.2.1:80", "[2001:db8::1]:443", "example.com:8080"} {
+		b, err := appendAddr(nil, target)
+		qt.Assert(t, err, qt.IsNil)
+		addr, err := readAddr(bytes.NewReader(b))
+		qt.Assert(t, err, qt.IsNil)
+		qt.Assert(t, addr.String(), qt.Equals, target)
+	}
+
+	_, err := readAddr(bytes.NewReader([]byte{0x02, 1, 2, 3, 4, 0, 80}))
+	qt.Assert(t, err, qt.Equals, errUnrecognizedAddrType)
+	_, err = readAddr(bytes.NewReader([]byte{ipv4Address, 1, 2}))
+	qt.Assert(t, err, qt.Equals, io.ErrUnexpectedEOF)
+}
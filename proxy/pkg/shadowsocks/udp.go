@@ -0,0 +1,519 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+)
+
+const (
+	maxPacketSize = 64 * 1024
+	// separateHeaderSize is the session and packet ID of a 2022 packet
+	separateHeaderSize = 16
+	// sessionQueueSize is the number of datagrams buffered per session
+	sessionQueueSize = 64
+)
+
+var (
+	errShortPacket    = errors.New("shadowsocks packet too short")
+	errReplayedPacket = errors.New("shadowsocks packet was replayed")
+)
+
+// packet is a decrypted client datagram
+type packet struct {
+	sessionID []byte
+	packetID  uint64
+	target    *address
+	payload   []byte
+}
+
+// servePackets decrypts client datagrams and hands them to the session of
+// their sender. Legacy sessions are keyed by client address, 2022 sessions
+// by the session ID so clients may roam between addresses.
+func (s *Server) servePackets(ctx context.Context) error {
+	sessions := &udpSessions{server: s, sessions: make(map[string]*udpSession)}
+	defer sessions.closeAll()
+	go sessions.expire(ctx)
+
+	var readDelay time.Duration
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := s.PacketConn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) || ctx.Err() != nil {
+				return err
+			}
+
+			// back off like serveStreams so a failing socket does not spin
+			if readDelay == 0 {
+				readDelay = minAcceptDelay
+			} else {
+				readDelay = min(2*readDelay, maxAcceptDelay)
+			}
+			s.Logger.Error("failed to read packet", "error", err, "retry", readDelay)
+			select {
+			case <-time.After(readDelay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			continue
+		}
+		readDelay = 0
+
+		pkt, session, err := sessions.decode(buf[:n], addr)
+		if err != nil {
+			s.Logger.Debug("dropping shadowsocks packet", "source", addr, "error", err)
+			continue
+		}
+		session.deliver(addr, pkt)
+	}
+}
+
+type udpSessions struct {
+	server   *Server
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+}
+
+// decode opens a client datagram and returns it with its session, a new
+// session is only created for packets that authenticate
+func (u *udpSessions) decode(b []byte, addr net.Addr) (*packet, *udpSession, error) {
+	c := u.server.Cipher
+	if !c.spec.is2022 {
+		if len(b) < c.saltSize() {
+			return nil, nil, errShortPacket
+		}
+		aead, err := c.aead(b[:c.saltSize()])
+		if err != nil {
+			return nil, nil, err
+		}
+		plain, err := aead.Open(nil, make([]byte, aead.NonceSize()), b[c.saltSize():], nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		r := bytes.NewReader(plain)
+		target, err := readAddr(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		pkt := &packet{target: target, payload: plain[len(plain)-r.Len():]}
+		return pkt, u.session(addr.String(), nil, pkt, addr), nil
+	}
+
+	var header, body []byte
+	var aead cipher.AEAD
+	if c.xaead != nil {
+		nonceSize := c.xaead.NonceSize()
+		if len(b) < nonceSize+separateHeaderSize {
+			return nil, nil, errShortPacket
+		}
+		plain, err := c.xaead.Open(nil, b[:nonceSize], b[nonceSize:], nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(plain) < separateHeaderSize {
+			return nil, nil, errShortPacket
+		}
+		header, body = plain[:separateHeaderSize], plain[separateHeaderSize:]
+	} else {
+		if len(b) < separateHeaderSize {
+			return nil, nil, errShortPacket
+		}
+		header = make([]byte, separateHeaderSize)
+		c.block.Decrypt(header, b[:separateHeaderSize])
+
+		u.mu.Lock()
+		session := u.sessions[string(header[:8])]
+		u.mu.Unlock()
+		if session != nil {
+			aead = session.clientAEAD
+		} else {
+			var err error
+			if aead, err = c.aead(header[:8]); err != nil {
+				return nil, nil, err
+			}
+		}
+		var err error
+		body, err = aead.Open(nil, header[4:separateHeaderSize], b[separateHeaderSize:], nil)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	pkt, err := parseClientBody(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	pkt.sessionID = header[:8]
+	pkt.packetID = binary.BigEndian.Uint64(header[8:])
+
+	session := u.session(string(pkt.sessionID), aead, pkt, addr)
+	if !session.window.check(pkt.packetID) {
+		return nil, nil, errReplayedPacket
+	}
+	return pkt, session, nil
+}
+
+// parseClientBody reads the main header of a 2022 client packet
+func parseClientBody(body []byte) (*packet, error) {
+	if len(body) < 1+8+2 {
+		return nil, errShortPacket
+	}
+	if body[0] != headerTypeClient {
+		return nil, errBadHeader
+	}
+	if err := checkTimestamp(binary.BigEndian.Uint64(body[1:9])); err != nil {
+		return nil, err
+	}
+	padding := int(binary.BigEndian.Uint16(body[9:11]))
+	if len(body) < 11+padding {
+		return nil, errShortPacket
+	}
+
+	r := bytes.NewReader(body[11+padding:])
+	target, err := readAddr(r)
+	if err != nil {
+		return nil, err
+	}
+	return &packet{target: target, payload: body[len(body)-r.Len():]}, nil
+}
+
+// session returns the session under key, starting it for pkt from the client
+// at from when it is new
+func (u *udpSessions) session(key string, clientAEAD cipher.AEAD, pkt *packet, from net.Addr) *udpSession {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if session, ok := u.sessions[key]; ok {
+		return session
+	}
+
+	session := &udpSession{
+		server:     u.server,
+		key:        key,
+		clientID:   pkt.sessionID,
+		clientAEAD: clientAEAD,
+		target:     pkt.target,
+		clientAddr: from,
+		queue:      make(chan *packet, sessionQueueSize),
+		closed:     make(chan struct{}),
+	}
+	if u.server.Cipher.spec.is2022 {
+		session.serverID = make([]byte, 8)
+		_, _ = rand.Read(session.serverID)
+		if u.server.Cipher.xaead == nil {
+			session.serverAEAD, _ = u.server.Cipher.aead(session.serverID)
+		}
+	}
+	session.touch()
+	u.sessions[key] = session
+
+	go func() {
+		if err := u.server.handleAssociate(session); err != nil {
+			u.server.Logger.Error(err.Error())
+		}
+		u.remove(session)
+	}()
+	return session
+}
+
+func (u *udpSessions) remove(session *udpSession) {
+	_ = session.Close()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.sessions[session.key] == session {
+		delete(u.sessions, session.key)
+	}
+}
+
+// expire closes sessions without client traffic for statute.DefaultUDPIdleTimeout
+func (u *udpSessions) expire(ctx context.Context) {
+	ticker := time.NewTicker(statute.DefaultUDPIdleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			u.mu.Lock()
+			var idle []*udpSession
+			for _, session := range u.sessions {
+				if session.idle() > statute.DefaultUDPIdleTimeout {
+					idle = append(idle, session)
+				}
+			}
+			u.mu.Unlock()
+			for _, session := range idle {
+				u.remove(session)
+			}
+		}
+	}
+}
+
+func (u *udpSessions) closeAll() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, session := range u.sessions {
+		_ = session.Close()
+	}
+}
+
+// handleAssociate serves the datagrams of one client session
+func (s *Server) handleAssociate(session *udpSession) error {
+	// the context of the session ends when the session is closed
+	ctx, cancel := context.WithCancel(s.Context)
+	defer cancel()
+	go func() {
+		select {
+		case <-session.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if s.UserConnectHandle == nil {
+		relay := &statute.UDPRelay{
+			Client: session,
+			ListenPacket: func(network string) (net.PacketConn, error) {
+				return s.ProxyListenPacket(ctx, network, "")
+			},
+			Resolve: func(ctx context.Context, host string) (netip.Addr, error) {
+				addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+				if err != nil {
+					return netip.Addr{}, err
+				}
+				return addrs[0], nil
+			},
+			Logger: s.Logger,
+		}
+		return relay.Serve(ctx)
+	}
+
+	proxyReq := &statute.ProxyRequest{
+		Conn:        session,
+		Reader:      session,
+		Writer:      session,
+		Network:     "udp",
+		Destination: session.target.String(),
+		DestHost:    session.target.Host(),
+		DestPort:    int32(session.target.Port),
+
+		DestIsDomain: session.target.Name != "",
+		Protocol:     statute.ProtocolShadowsocks,
+		Source:       statute.SourceAddr(session.RemoteAddr()),
+		Context:      ctx,
+	}
+	return s.UserConnectHandle(proxyReq)
+}
+
+// udpSession is the client side of a Shadowsocks UDP session. ReadFrom and
+// WriteTo carry the destination of every datagram, while Read and Write stick
+// to the first destination the client sent to. Deadlines are not supported,
+// idle sessions are closed by the server instead.
+type udpSession struct {
+	server     *Server
+	key        string
+	clientID   []byte
+	clientAEAD cipher.AEAD
+	serverID   []byte
+	serverAEAD cipher.AEAD
+	packetID   atomic.Uint64
+	window     replayWindow
+	target     *address
+
+	mu         sync.Mutex
+	clientAddr net.Addr
+	lastSeen   time.Time
+
+	queue     chan *packet
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *udpSession) touch() {
+	c.mu.Lock()
+	c.lastSeen = time.Now()
+	c.mu.Unlock()
+}
+
+func (c *udpSession) idle() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Since(c.lastSeen)
+}
+
+func (c *udpSession) deliver(from net.Addr, pkt *packet) {
+	c.mu.Lock()
+	c.clientAddr = from
+	c.lastSeen = time.Now()
+	c.mu.Unlock()
+
+	select {
+	case <-c.closed:
+	case c.queue <- pkt:
+	default:
+		// the handler is not keeping up, drop like a congested link would
+	}
+}
+
+func (c *udpSession) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	case pkt := <-c.queue:
+		return copy(b, pkt.payload), pkt.target, nil
+	}
+}
+
+func (c *udpSession) Read(b []byte) (int, error) {
+	for {
+		n, addr, err := c.ReadFrom(b)
+		if err != nil {
+			return 0, err
+		}
+		if addr.String() == c.target.String() {
+			return n, nil
+		}
+	}
+}
+
+func (c *udpSession) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	out, err := c.seal(b, addr.String())
+	if err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	clientAddr := c.clientAddr
+	c.mu.Unlock()
+	if _, err := c.server.PacketConn.WriteTo(out, clientAddr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *udpSession) Write(b []byte) (int, error) {
+	return c.WriteTo(b, c.target)
+}
+
+// seal encrypts a reply from source for the client
+func (c *udpSession) seal(b []byte, source string) ([]byte, error) {
+	cph := c.server.Cipher
+	if !cph.spec.is2022 {
+		plain, err := appendAddr(make([]byte, 0, 1+255+2+len(b)), source)
+		if err != nil {
+			return nil, err
+		}
+		plain = append(plain, b...)
+		salt, aead, err := cph.newSalt()
+		if err != nil {
+			return nil, err
+		}
+		return aead.Seal(salt, make([]byte, aead.NonceSize()), plain, nil), nil
+	}
+
+	header := make([]byte, 0, separateHeaderSize)
+	header = append(header, c.serverID...)
+	header = binary.BigEndian.AppendUint64(header, c.packetID.Add(1)-1)
+
+	body := make([]byte, 0, 1+8+8+2+1+255+2+len(b))
+	body = append(body, headerTypeServer)
+	body = binary.BigEndian.AppendUint64(body, uint64(time.Now().Unix()))
+	body = append(body, c.clientID...)
+	body = binary.BigEndian.AppendUint16(body, 0) // no padding
+	body, err := appendAddr(body, source)
+	if err != nil {
+		return nil, err
+	}
+	body = append(body, b...)
+
+	if cph.xaead != nil {
+		nonce := make([]byte, cph.xaead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		return cph.xaead.Seal(nonce, nonce, append(header, body...), nil), nil
+	}
+
+	out := make([]byte, separateHeaderSize, separateHeaderSize+len(body)+c.serverAEAD.Overhead())
+	cph.block.Encrypt(out, header)
+	return c.serverAEAD.Seal(out, header[4:], body, nil), nil
+}
+
+func (c *udpSession) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+func (c *udpSession) LocalAddr() net.Addr {
+	return c.server.PacketConn.LocalAddr()
+}
+
+func (c *udpSession) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.clientAddr
+}
+
+func (c *udpSession) SetDeadline(time.Time) error      { return nil }
+func (c *udpSession) SetReadDeadline(time.Time) error  { return nil }
+func (c *udpSession) SetWriteDeadline(time.Time) error { return nil }
+
+// replayWindow is a sliding window over the packet IDs of a session
+type replayWindow struct {
+	mu      sync.Mutex
+	highest uint64
+	seen    uint64
+	started bool
+}
+
+const replayWindowSize = 64
+
+// check records id and reports whether it was not seen before
+func (w *replayWindow) check(id uint64) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	switch {
+	case !w.started:
+		w.started = true
+		w.highest, w.seen = id, 1
+		return true
+	case id > w.highest:
+		shift := id - w.highest
+		if shift >= replayWindowSize {
+			w.seen = 0
+		} else {
+			w.seen <<= shift
+		}
+		w.seen |= 1
+		w.highest = id
+		return true
+	case w.highest-id >= replayWindowSize:
+		return false
+	default:
+		bit := uint64(1) << (w.highest - id)
+		if w.seen&bit != 0 {
+			return false
+		}
+		w.seen |= bit
+		return true
+	}
+}
@@ -0,0 +1,259 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+)
+
+// sealPacket seals a client datagram for target. sessionID and packetID are
+// only used by 2022 methods.
+func sealPacket(t *testing.T, c *Cipher, sessionID []byte, packetID uint64, ts time.Time, target string, payload []byte) []byte {
+	addr, err := appendAddr(nil, target)
+	qt.Assert(t, err, qt.IsNil)
+
+	if !c.spec.is2022 {
+		salt, aead, err := c.newSalt()
+		qt.Assert(t, err, qt.IsNil)
+		return aead.Seal(salt, make([]byte, aead.NonceSize()), append(addr, payload...), nil)
+	}
+
+	header := binary.BigEndian.AppendUint64(append([]byte{}, sessionID...), packetID)
+	body := []byte{headerTypeClient}
+	body = binary.BigEndian.AppendUint64(body, uint64(ts.Unix()))
+	body = binary.BigEndian.AppendUint16(body, 0) // no padding
+	body = append(append(body, addr...), payload...)
+
+	if c.xaead != nil {
+		nonce := make([]byte, c.xaead.NonceSize())
+		_, _ = rand.Read(nonce)
+		return c.xaead.Seal(nonce, nonce, append(header, body...), nil)
+	}
+	aead, err := c.aead(sessionID)
+	qt.Assert(t, err, qt.IsNil)
+	out := make([]byte, separateHeaderSize)
+	c.block.Encrypt(out, header)
+	return aead.Seal(out, header[4:], body, nil)
+}
+
+// openPacket opens a server datagram and returns its source and payload. For
+// 2022 methods it checks that the reply belongs to sessionID.
+func openPacket(t *testing.T, c *Cipher, sessionID []byte, b []byte) (string, []byte) {
+	var body []byte
+	switch {
+	case !c.spec.is2022:
+		aead, err := c.aead(b[:c.saltSize()])
+		qt.Assert(t, err, qt.IsNil)
+		plain, err := aead.Open(nil, make([]byte, aead.NonceSize()), b[c.saltSize():], nil)
+		qt.Assert(t, err, qt.IsNil)
+		r := bytes.NewReader(plain)
+		source, err := readAddr(r)
+		qt.Assert(t, err, qt.IsNil)
+		payload, _ := io.ReadAll(r)
+		return source.String(), payload
+	case c.xaead != nil:
+		nonceSize := c.xaead.NonceSize()
+		plain, err := c.xaead.Open(nil, b[:nonceSize], b[nonceSize:], nil)
+		qt.Assert(t, err, qt.IsNil)
+		body = plain[separateHeaderSize:]
+	default:
+		header := make([]byte, separateHeaderSize)
+		c.block.Decrypt(header, b[:separateHeaderSize])
+		aead, err := c.aead(header[:8])
+		qt.Assert(t, err, qt.IsNil)
+		body, err = aead.Open(nil, header[4:], b[separateHeaderSize:], nil)
+		qt.Assert(t, err, qt.IsNil)
+	}
+
+	qt.Assert(t, body[0], qt.Equals, byte(headerTypeServer))
+	qt.Assert(t, checkTimestamp(binary.BigEndian.Uint64(body[1:9])), qt.IsNil)
+	qt.Assert(t, body[9:17], qt.DeepEquals, sessionID)
+	padding := int(binary.BigEndian.Uint16(body[17:19]))
+	r := bytes.NewReader(body[19+padding:])
+	source, err := readAddr(r)
+	qt.Assert(t, err, qt.IsNil)
+	payload, _ := io.ReadAll(r)
+	return source.String(), payload
+}
+
+// udpEcho answers every datagram of a session with itself until the session
+// is closed
+func udpEcho(req *statute.ProxyRequest) error {
+	pc := req.Conn.(net.PacketConn)
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return nil
+		}
+		if _, err := pc.WriteTo(buf[:n], addr); err != nil {
+			return err
+		}
+	}
+}
+
+func TestUDPRoundTrip(t *testing.T) {
+	for _, method := range testMethods {
+		t.Run(method, func(t *testing.T) {
+			c := newTestCipher(t, method)
+			pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+			qt.Assert(t, err, qt.IsNil)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			s := NewServer(WithCipher(c), WithPacketConn(pc), WithContext(ctx), WithConnectHandle(udpEcho))
+			go func() { _ = s.servePackets(ctx) }()
+			defer pc.Close()
+
+			client, err := net.Dial("udp", pc.LocalAddr().String())
+			qt.Assert(t, err, qt.IsNil)
+			defer client.Close()
+			_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+
+			sessionID := []byte("session1")
+			buf := make([]byte, maxPacketSize)
+			for i, payload := range []string{"first", "second"} {
+				_, err := client.Write(sealPacket(t, c, sessionID, uint64(i), time.Now(), "192.0.2.1:53", []byte(payload)))
+				qt.Assert(t, err, qt.IsNil)
+				n, err := client.Read(buf)
+				qt.Assert(t, err, qt.IsNil)
+				source, reply := openPacket(t, c, sessionID, buf[:n])
+				qt.Assert(t, source, qt.Equals, "192.0.2.1:53")
+				qt.Assert(t, string(reply), qt.Equals, payload)
+			}
+		})
+	}
+}
+
+// newDecoder returns the session table of a server whose sessions stay open
+// until the test ends
+func newDecoder(t *testing.T, c *Cipher) *udpSessions {
+	s := NewServer(WithCipher(c), WithConnectHandle(func(req *statute.ProxyRequest) error {
+		_, _ = io.Copy(io.Discard, req.Conn)
+		return nil
+	}))
+	sessions := &udpSessions{server: s, sessions: make(map[string]*udpSession)}
+	t.Cleanup(sessions.closeAll)
+	return sessions
+}
+
+func TestUDPReplayedPacket(t *testing.T) {
+	for _, method := range []string{"2022-blake3-aes-128-gcm", "2022-blake3-chacha20-poly1305"} {
+		t.Run(method, func(t *testing.T) {
+			c := newTestCipher(t, method)
+			sessions := newDecoder(t, c)
+			from := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+			sessionID := []byte("session1")
+
+			replayed := sealPacket(t, c, sessionID, 7, time.Now(), "192.0.2.1:53", []byte("query"))
+			pkt, _, err := sessions.decode(replayed, from)
+			qt.Assert(t, err, qt.IsNil)
+			qt.Assert(t, pkt.packetID, qt.Equals, uint64(7))
+			qt.Assert(t, string(pkt.payload), qt.Equals, "query")
+
+			_, _, err = sessions.decode(replayed, from)
+			qt.Assert(t, err, qt.Equals, errReplayedPacket)
+
+			// the same packet ID sealed again is a replay as well
+			again := sealPacket(t, c, sessionID, 7, time.Now(), "192.0.2.1:53", []byte("query"))
+			_, _, err = sessions.decode(again, from)
+			qt.Assert(t, err, qt.Equals, errReplayedPacket)
+
+			// packets may arrive out of order
+			late := sealPacket(t, c, sessionID, 5, time.Now(), "192.0.2.1:53", []byte("query"))
+			_, _, err = sessions.decode(late, from)
+			qt.Assert(t, err, qt.IsNil)
+		})
+	}
+}
+
+func TestUDPStaleTimestamp(t *testing.T) {
+	for _, method := range []string{"2022-blake3-aes-256-gcm", "2022-blake3-chacha20-poly1305"} {
+		t.Run(method, func(t *testing.T) {
+			c := newTestCipher(t, method)
+			sessions := newDecoder(t, c)
+			from := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+
+			for _, ts := range []time.Time{
+				time.Now().Add(-2 * maxTimeDifference),
+				time.Now().Add(2 * maxTimeDifference),
+			} {
+				b := sealPacket(t, c, []byte("session1"), 0, ts, "192.0.2.1:53", []byte("query"))
+				_, _, err := sessions.decode(b, from)
+				qt.Assert(t, err, qt.Equals, errBadTimestamp)
+			}
+			qt.Assert(t, sessions.sessions, qt.HasLen, 0)
+		})
+	}
+}
+
+func TestUDPShortPacket(t *testing.T) {
+	for _, method := range testMethods {
+		c := newTestCipher(t, method)
+		sessions := newDecoder(t, c)
+		from := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+
+		_, _, err := sessions.decode(make([]byte, 8), from)
+		qt.Check(t, errors.Is(err, errShortPacket), qt.IsTrue, qt.Commentf("method %s: %v", method, err))
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+	for _, step := range []struct {
+		id   uint64
+		want bool
+	}{
+		{0, true},
+		{0, false},
+		{1, true},
+		{5, true},
+		{3, true},
+		{3, false},
+		{100, true},
+		// older than the window
+		{36, false},
+		{37, true},
+		{37, false},
+		{5, false},
+		{101, true},
+		{100, false},
+	} {
+		qt.Assert(t, w.check(step.id), qt.Equals, step.want, qt.Commentf("packet %d", step.id))
+	}
+}
+
+// failingPacketConn fails every read with a temporary error
+type failingPacketConn struct {
+	net.PacketConn
+	reads atomic.Int32
+}
+
+func (c *failingPacketConn) ReadFrom([]byte) (int, net.Addr, error) {
+	c.reads.Add(1)
+	return 0, nil, errors.New("no buffer space available")
+}
+
+func TestUDPReadErrorBackoff(t *testing.T) {
+	pc := &failingPacketConn{}
+	s := NewServer(WithCipher(newTestCipher(t, testMethods[0])), WithPacketConn(pc), WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	err := s.servePackets(ctx)
+	qt.Assert(t, err, qt.ErrorIs, context.DeadlineExceeded)
+	// 5, 10, 20 and 40ms pass before the fifth read, a spinning loop would
+	// read millions of times
+	qt.Assert(t, pc.reads.Load() <= 6, qt.IsTrue, qt.Commentf("%d reads", pc.reads.Load()))
+}
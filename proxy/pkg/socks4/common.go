@@ -3,6 +3,7 @@ package socks4
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"io"
 	"net"
 	"strconv"
@@ -13,6 +14,8 @@ var (
 	isNone    = []byte{0, 0, 0, 0}
 )
 
+var errAuthRequired = errors.New("authentication required, SOCKS4 cannot provide a password")
+
 const (
 	socks4Version = 0x04
 )
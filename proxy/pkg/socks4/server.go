@@ -22,12 +22,17 @@ type Server struct {
 	ProxyDial statute.ProxyDialFunc
 	// UserConnectHandle gives the user control to handle the TCP CONNECT requests
 	UserConnectHandle statute.UserConnectHandler
+	// ConnectCheck may refuse a request before it is confirmed to the client
+	ConnectCheck statute.ConnectCheck
 	// Logger error log
 	Logger *slog.Logger
 	// Context is default context
 	Context context.Context
 	// BytesPool getting and returning temporary bytes for use by io.CopyBuffer
 	BytesPool statute.BytesPool
+	// Credentials marks the proxy as password protected. SOCKS4 has no way to
+	// carry a password, so every request is rejected when it is set.
+	Credentials statute.CredentialStore
 }
 
 func NewServer(options ...ServerOption) *Server {
@@ -110,6 +115,12 @@ func WithConnectHandle(handler statute.UserConnectHandler) ServerOption {
 	}
 }
 
+func WithConnectCheck(check statute.ConnectCheck) ServerOption {
+	return func(s *Server) {
+		s.ConnectCheck = check
+	}
+}
+
 func WithProxyDial(proxyDial statute.ProxyDialFunc) ServerOption {
 	return func(s *Server) {
 		s.ProxyDial = proxyDial
@@ -128,6 +139,12 @@ func WithBytesPool(bytesPool statute.BytesPool) ServerOption {
 	}
 }
 
+func WithCredentials(credentials statute.CredentialStore) ServerOption {
+	return func(s *Server) {
+		s.Credentials = credentials
+	}
+}
+
 func (s *Server) ServeConn(conn net.Conn) error {
 	version, err := readByte(conn)
 	if err != nil {
@@ -136,9 +153,13 @@ func (s *Server) ServeConn(conn net.Conn) error {
 	if version != socks4Version {
 		return fmt.Errorf("unsupported SOCKS version: %d", version)
 	}
+	// the context of the connection ends with ServeConn
+	ctx, cancel := context.WithCancel(s.Context)
+	defer cancel()
 	req := &request{
 		Version: socks4Version,
 		Conn:    conn,
+		Context: ctx,
 	}
 
 	cmd, err := readByte(conn)
@@ -156,6 +177,13 @@ func (s *Server) ServeConn(conn net.Conn) error {
 	}
 	req.DestinationAddr = &addr.address
 	req.Username = addr.Username
+
+	if s.Credentials != nil {
+		if err := sendReply(req.Conn, invalidUserReply, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %v", err)
+		}
+		return errAuthRequired
+	}
 	return s.handle(req)
 }
 
@@ -176,9 +204,6 @@ func (s *Server) handleConnect(req *request) error {
 		return s.embedHandleConnect(req)
 	}
 
-	if err := sendReply(req.Conn, grantedReply, nil); err != nil {
-		return fmt.Errorf("failed to send reply: %v", err)
-	}
 	host := req.DestinationAddr.IP.String()
 	if req.DestinationAddr.Name != "" {
 		host = req.DestinationAddr.Name
@@ -192,6 +217,23 @@ func (s *Server) handleConnect(req *request) error {
 		Destination: req.DestinationAddr.String(),
 		DestHost:    host,
 		DestPort:    int32(req.DestinationAddr.Port),
+
+		DestIsDomain: req.DestinationAddr.Name != "",
+		Protocol:     statute.ProtocolSOCKS4,
+		Source:       statute.SourceAddr(req.Conn.RemoteAddr()),
+		Context:      req.Context,
+	}
+
+	if s.ConnectCheck != nil {
+		if err := s.ConnectCheck(proxyReq); err != nil {
+			if err := sendReply(req.Conn, rejectedReply, nil); err != nil {
+				return fmt.Errorf("failed to send reply: %v", err)
+			}
+			return fmt.Errorf("connect to %v failed: %w", req.DestinationAddr, err)
+		}
+	}
+	if err := sendReply(req.Conn, grantedReply, nil); err != nil {
+		return fmt.Errorf("failed to send reply: %v", err)
 	}
 
 	return s.UserConnectHandle(proxyReq)
@@ -201,7 +243,7 @@ func (s *Server) embedHandleConnect(req *request) error {
 	defer func() {
 		_ = req.Conn.Close()
 	}()
-	target, err := s.ProxyDial(s.Context, "tcp", req.DestinationAddr.Address())
+	target, err := s.ProxyDial(req.Context, "tcp", req.DestinationAddr.Address())
 	if err != nil {
 		if err := sendReply(req.Conn, rejectedReply, nil); err != nil {
 			return fmt.Errorf("failed to send reply: %v", err)
@@ -229,7 +271,26 @@ func (s *Server) embedHandleConnect(req *request) error {
 		buf1 = make([]byte, 32*1024)
 		buf2 = make([]byte, 32*1024)
 	}
-	return statute.Tunnel(s.Context, target, req.Conn, buf1, buf2)
+	return statute.Tunnel(req.Context, target, req.Conn, buf1, buf2)
+}
+
+// RejectConn reads the request of a client that may not use the proxy and
+// answers it with "request rejected"
+func RejectConn(conn net.Conn) error {
+	version, err := readByte(conn)
+	if err != nil {
+		return err
+	}
+	if version != socks4Version {
+		return fmt.Errorf("unsupported SOCKS version: %d", version)
+	}
+	if _, err := readByte(conn); err != nil {
+		return err
+	}
+	if _, err := readAddrAndUser(conn); err != nil {
+		return err
+	}
+	return sendReply(conn, rejectedReply, nil)
 }
 
 func sendReply(w io.Writer, resp reply, addr *address) error {
@@ -247,4 +308,6 @@ type request struct {
 	DestinationAddr *address
 	Username        string
 	Conn            net.Conn
+	// Context is canceled once the connection is served
+	Context context.Context
 }
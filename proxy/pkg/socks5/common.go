@@ -4,22 +4,26 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"io"
 	"net"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 )
 
 var (
 	errStringTooLong        = errors.New("string too long")
 	errNoSupportedAuth      = errors.New("no supported authentication mechanism")
 	errUnrecognizedAddrType = errors.New("unrecognized address type")
+	errAuthFailed           = errors.New("authentication failed")
 )
 
 const (
 	maxUdpPacket = 2048
+	// bindAcceptTimeout bounds how long a BIND request waits for the inbound connection
+	bindAcceptTimeout = 2 * time.Minute
 )
 
 const (
@@ -28,6 +32,7 @@ const (
 
 const (
 	ConnectCommand   Command = 0x01
+	BindCommand      Command = 0x02
 	AssociateCommand Command = 0x03
 )
 
@@ -38,6 +43,8 @@ func (cmd Command) String() string {
 	switch cmd {
 	case ConnectCommand:
 		return "socks connect"
+	case BindCommand:
+		return "socks bind"
 	case AssociateCommand:
 		return "socks associate"
 	default:
@@ -65,7 +72,7 @@ func errToReply(err error) reply {
 	resp := hostUnreachable
 	if strings.Contains(msg, "refused") {
 		resp = connectionRefused
-	} else if strings.Contains(msg, "network is unreachable") {
+	} else if strings.Contains(msg, "network is unreachable") || errors.Is(err, syscall.ENETUNREACH) {
 		resp = networkUnreachable
 	}
 	return resp
@@ -137,9 +144,16 @@ type authMethod byte
 
 const (
 	noAuth       authMethod = 0x00 // no authentication required
+	userPassAuth authMethod = 0x02 // username/password
 	noAcceptable authMethod = 0xff // no acceptable authentication methods
 )
 
+const (
+	userPassVersion = 0x01
+	authSuccess     = 0x00
+	authFailure     = 0x01
+)
+
 func readBytes(r io.Reader) ([]byte, error) {
 	var buf [1]byte
 	_, err := r.Read(buf[:])
@@ -299,110 +313,143 @@ func splitHostPort(address string) (string, int, error) {
 
 type readStruct struct {
 	data []byte
-	err  error
+	addr *address
 }
 
+// udpCustomConn is the client side of a UDP association. ReadFrom and WriteTo
+// carry the destination of every datagram, while Read and Write stick to the
+// first destination the client sent to.
 type udpCustomConn struct {
 	net.PacketConn
 	assocTCPConn net.Conn
 	lock         sync.Mutex
 	sourceAddr   net.Addr
-	targetAddr   net.Addr
-	replyPrefix  []byte
+	targetAddr   *address
 	firstRead    sync.Once
 	frc          chan bool
 	packetQueue  chan *readStruct
+	readErr      error
+	// done is closed by Close so that a pending packet no longer waits for
+	// a reader
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newUDPCustomConn(packetConn net.PacketConn, assocTCPConn net.Conn) *udpCustomConn {
+	return &udpCustomConn{
+		PacketConn:   packetConn,
+		assocTCPConn: assocTCPConn,
+		frc:          make(chan bool),
+		packetQueue:  make(chan *readStruct),
+		done:         make(chan struct{}),
+	}
 }
 
 func (cc *udpCustomConn) RemoteAddr() net.Addr {
 	return cc.targetAddr
 }
 
+// asyncReadPackets decodes the datagrams of the client and queues them. frc is
+// closed once the first one arrived, or when reading failed before that.
 func (cc *udpCustomConn) asyncReadPackets() {
 	go func() {
-		tempBuf := make([]byte, maxUdpPacket)
+		defer cc.firstRead.Do(func() {
+			close(cc.frc)
+		})
 		for {
-			n, addr, err := cc.ReadFrom(tempBuf)
+			buf := make([]byte, maxUdpPacket)
+			n, addr, err := cc.PacketConn.ReadFrom(buf)
 			if err != nil {
-				cc.packetQueue <- &readStruct{
-					data: nil,
-					err:  err,
-				}
-				break
-			}
-			if n < 3 {
-				cc.packetQueue <- &readStruct{
-					data: nil,
-					err:  err,
-				}
-				break
+				cc.readErr = err
+				close(cc.packetQueue)
+				return
 			}
 			if cc.sourceAddr == nil {
 				cc.sourceAddr = addr
+			} else if addr.String() != cc.sourceAddr.String() {
+				// only the client that owns the association may use it
+				continue
+			}
+			// fragmented datagrams are not supported
+			if n < 3 || buf[2] != 0 {
+				continue
 			}
 
-			reader := bytes.NewBuffer(tempBuf[3:n])
+			reader := bytes.NewBuffer(buf[3:n])
 			targetAddr, err := readAddr(reader)
-
 			if err != nil {
-				cc.packetQueue <- &readStruct{
-					data: nil,
-					err:  err,
-				}
-				break
+				continue
 			}
 			if cc.targetAddr == nil {
-				cc.targetAddr = &net.UDPAddr{
-					IP:   targetAddr.IP,
-					Port: targetAddr.Port,
-				}
-			}
-			if targetAddr.String() != cc.targetAddr.String() {
-				cc.packetQueue <- &readStruct{
-					data: nil,
-					err:  fmt.Errorf("ignore non-target addresses %s", targetAddr.String()),
-				}
-				break
+				cc.targetAddr = targetAddr
 			}
 			cc.firstRead.Do(func() {
 				// ok we have source and destination address now user can handle new ProxyReq
-				cc.frc <- true
+				close(cc.frc)
 			})
-			cc.packetQueue <- &readStruct{
+			select {
+			case cc.packetQueue <- &readStruct{
 				data: reader.Bytes(),
-				err:  nil,
+				addr: targetAddr,
+			}:
+			case <-cc.done:
+				cc.readErr = net.ErrClosed
+				close(cc.packetQueue)
+				return
 			}
 		}
 	}()
 }
 
-func (cc *udpCustomConn) Read(b []byte) (int, error) {
+func (cc *udpCustomConn) ReadFrom(b []byte) (int, net.Addr, error) {
 	// wait for packet data
-	read := <-cc.packetQueue
-	if read.err != nil {
-		return 0, read.err
+	read, ok := <-cc.packetQueue
+	if !ok {
+		return 0, nil, cc.readErr
 	}
-	copy(b, read.data)
-	return len(read.data), nil
+	n := copy(b, read.data)
+	return n, read.addr, nil
 }
 
-func (cc *udpCustomConn) Write(b []byte) (int, error) {
-	cc.lock.Lock()
-	defer cc.lock.Unlock()
-	if cc.replyPrefix == nil {
-		prefix := bytes.NewBuffer(make([]byte, 3, 16))
-		err := writeAddrWithStr(prefix, cc.targetAddr.String())
+func (cc *udpCustomConn) Read(b []byte) (int, error) {
+	for {
+		n, addr, err := cc.ReadFrom(b)
 		if err != nil {
 			return 0, err
 		}
-		cc.replyPrefix = prefix.Bytes()
+		if addr.String() == cc.targetAddr.String() {
+			return n, nil
+		}
+	}
+}
+
+func (cc *udpCustomConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	buf := bytes.NewBuffer(make([]byte, 3, 3+1+255+2+len(b)))
+	var err error
+	if socksAddr, ok := addr.(*address); ok {
+		err = writeAddr(buf, socksAddr)
+	} else {
+		err = writeAddrWithStr(buf, addr.String())
+	}
+	if err != nil {
+		return 0, err
 	}
-	buff := append(cc.replyPrefix, b...)
-	_, err := cc.WriteTo(buff[:len(cc.replyPrefix)+len(b)], cc.sourceAddr)
+	buf.Write(b)
+
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	_, err = cc.PacketConn.WriteTo(buf.Bytes(), cc.sourceAddr)
 	return len(b), err
 }
 
+func (cc *udpCustomConn) Write(b []byte) (int, error) {
+	return cc.WriteTo(b, cc.targetAddr)
+}
+
 func (cc *udpCustomConn) Close() error {
+	cc.closeOnce.Do(func() {
+		close(cc.done)
+	})
 	cc.lock.Lock()
 	defer cc.lock.Unlock()
 	udpErr := cc.PacketConn.Close()
@@ -7,6 +7,7 @@ import (
 	"io"
 	"log/slog"
 	"net"
+	"net/netip"
 
 	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
 )
@@ -24,18 +25,27 @@ type Server struct {
 	// ProxyListenPacket specifies the optional proxyListenPacket function for
 	// establishing the transport connection.
 	ProxyListenPacket statute.ProxyListenPacket
+	// ProxyListen specifies the optional listen function used to accept the
+	// inbound connection of BIND requests.
+	ProxyListen statute.ProxyListenFunc
 	// PacketForwardAddress specifies the packet forwarding address
 	PacketForwardAddress statute.PacketForwardAddress
 	// UserConnectHandle gives the user control to handle the TCP CONNECT requests
 	UserConnectHandle statute.UserConnectHandler
+	// ConnectCheck may refuse a request before it is confirmed to the client
+	ConnectCheck statute.ConnectCheck
 	// UserAssociateHandle gives the user control to handle the UDP ASSOCIATE requests
 	UserAssociateHandle statute.UserAssociateHandler
+	// UserBindHandle gives the user control to handle the TCP BIND requests
+	UserBindHandle statute.UserBindHandler
 	// Logger error log
 	Logger *slog.Logger
 	// Context is default context
 	Context context.Context
 	// BytesPool getting and returning temporary bytes for use by io.CopyBuffer
 	BytesPool statute.BytesPool
+	// Credentials enables username/password authentication when set
+	Credentials statute.CredentialStore
 }
 
 func NewServer(options ...ServerOption) *Server {
@@ -43,6 +53,7 @@ func NewServer(options ...ServerOption) *Server {
 		Bind:                 statute.DefaultBindAddress,
 		ProxyDial:            statute.DefaultProxyDial(),
 		ProxyListenPacket:    statute.DefaultProxyListenPacket(),
+		ProxyListen:          statute.DefaultProxyListen(),
 		PacketForwardAddress: defaultReplyPacketForwardAddress,
 		Logger:               slog.Default(),
 		Context:              statute.DefaultContext(),
@@ -121,12 +132,24 @@ func WithConnectHandle(handler statute.UserConnectHandler) ServerOption {
 	}
 }
 
+func WithConnectCheck(check statute.ConnectCheck) ServerOption {
+	return func(s *Server) {
+		s.ConnectCheck = check
+	}
+}
+
 func WithAssociateHandle(handler statute.UserAssociateHandler) ServerOption {
 	return func(s *Server) {
 		s.UserAssociateHandle = handler
 	}
 }
 
+func WithBindHandle(handler statute.UserBindHandler) ServerOption {
+	return func(s *Server) {
+		s.UserBindHandle = handler
+	}
+}
+
 func WithProxyDial(proxyDial statute.ProxyDialFunc) ServerOption {
 	return func(s *Server) {
 		s.ProxyDial = proxyDial
@@ -139,6 +162,12 @@ func WithProxyListenPacket(proxyListenPacket statute.ProxyListenPacket) ServerOp
 	}
 }
 
+func WithProxyListen(proxyListen statute.ProxyListenFunc) ServerOption {
+	return func(s *Server) {
+		s.ProxyListen = proxyListen
+	}
+}
+
 func WithPacketForwardAddress(packetForwardAddress statute.PacketForwardAddress) ServerOption {
 	return func(s *Server) {
 		s.PacketForwardAddress = packetForwardAddress
@@ -157,6 +186,12 @@ func WithBytesPool(bytesPool statute.BytesPool) ServerOption {
 	}
 }
 
+func WithCredentials(credentials statute.CredentialStore) ServerOption {
+	return func(s *Server) {
+		s.Credentials = credentials
+	}
+}
+
 func (s *Server) ServeConn(conn net.Conn) error {
 	version, err := readByte(conn)
 	if err != nil {
@@ -166,9 +201,13 @@ func (s *Server) ServeConn(conn net.Conn) error {
 		return fmt.Errorf("unsupported SOCKS version: %d", version)
 	}
 
+	// the context of the connection ends with ServeConn
+	ctx, cancel := context.WithCancel(s.Context)
+	defer cancel()
 	req := &request{
 		Version: socks5Version,
 		Conn:    conn,
+		Context: ctx,
 	}
 
 	methods, err := readBytes(conn)
@@ -176,12 +215,22 @@ func (s *Server) ServeConn(conn net.Conn) error {
 		return err
 	}
 
-	if bytes.IndexByte(methods, byte(noAuth)) != -1 {
+	switch {
+	case s.Credentials != nil && bytes.IndexByte(methods, byte(userPassAuth)) != -1:
+		_, err := conn.Write([]byte{socks5Version, byte(userPassAuth)})
+		if err != nil {
+			return err
+		}
+		req.Username, req.Password, err = s.authenticate(conn)
+		if err != nil {
+			return err
+		}
+	case s.Credentials == nil && bytes.IndexByte(methods, byte(noAuth)) != -1:
 		_, err := conn.Write([]byte{socks5Version, byte(noAuth)})
 		if err != nil {
 			return err
 		}
-	} else {
+	default:
 		_, err := conn.Write([]byte{socks5Version, byte(noAcceptable)})
 		if err != nil {
 			return err
@@ -220,10 +269,42 @@ func (s *Server) ServeConn(conn net.Conn) error {
 	return nil
 }
 
+// authenticate runs the username/password sub-negotiation described in RFC 1929
+func (s *Server) authenticate(conn net.Conn) (string, string, error) {
+	version, err := readByte(conn)
+	if err != nil {
+		return "", "", err
+	}
+	if version != userPassVersion {
+		return "", "", fmt.Errorf("unsupported auth version: %d", version)
+	}
+	username, err := readBytes(conn)
+	if err != nil {
+		return "", "", err
+	}
+	password, err := readBytes(conn)
+	if err != nil {
+		return "", "", err
+	}
+
+	if !statute.ValidCredentials(s.Credentials, string(username), string(password)) {
+		if _, err := conn.Write([]byte{userPassVersion, authFailure}); err != nil {
+			return "", "", err
+		}
+		return "", "", fmt.Errorf("%w: %q", errAuthFailed, username)
+	}
+	if _, err := conn.Write([]byte{userPassVersion, authSuccess}); err != nil {
+		return "", "", err
+	}
+	return string(username), string(password), nil
+}
+
 func (s *Server) handle(req *request) error {
 	switch req.Command {
 	case ConnectCommand:
 		return s.handleConnect(req)
+	case BindCommand:
+		return s.handleBind(req)
 	case AssociateCommand:
 		return s.handleAssociate(req)
 	default:
@@ -239,9 +320,6 @@ func (s *Server) handleConnect(req *request) error {
 		return s.embedHandleConnect(req)
 	}
 
-	if err := sendReply(req.Conn, successReply, nil); err != nil {
-		return fmt.Errorf("failed to send reply: %v", err)
-	}
 	host := req.DestinationAddr.IP.String()
 	if req.DestinationAddr.Name != "" {
 		host = req.DestinationAddr.Name
@@ -255,6 +333,24 @@ func (s *Server) handleConnect(req *request) error {
 		Destination: req.DestinationAddr.String(),
 		DestHost:    host,
 		DestPort:    int32(req.DestinationAddr.Port),
+
+		DestIsDomain: req.DestinationAddr.Name != "",
+		User:         req.Username,
+		Protocol:     statute.ProtocolSOCKS5,
+		Source:       statute.SourceAddr(req.Conn.RemoteAddr()),
+		Context:      req.Context,
+	}
+
+	if s.ConnectCheck != nil {
+		if err := s.ConnectCheck(proxyReq); err != nil {
+			if err := sendReply(req.Conn, errToReply(err), nil); err != nil {
+				return fmt.Errorf("failed to send reply: %v", err)
+			}
+			return fmt.Errorf("connect to %v failed: %w", req.DestinationAddr, err)
+		}
+	}
+	if err := sendReply(req.Conn, successReply, nil); err != nil {
+		return fmt.Errorf("failed to send reply: %v", err)
 	}
 
 	return s.UserConnectHandle(proxyReq)
@@ -265,7 +361,7 @@ func (s *Server) embedHandleConnect(req *request) error {
 		_ = req.Conn.Close()
 	}()
 
-	target, err := s.ProxyDial(s.Context, "tcp", req.DestinationAddr.Address())
+	target, err := s.ProxyDial(req.Context, "tcp", req.DestinationAddr.Address())
 	if err != nil {
 		if err := sendReply(req.Conn, errToReply(err), nil); err != nil {
 			return fmt.Errorf("failed to send reply: %v", err)
@@ -298,12 +394,137 @@ func (s *Server) embedHandleConnect(req *request) error {
 		buf1 = make([]byte, 32*1024)
 		buf2 = make([]byte, 32*1024)
 	}
-	return statute.Tunnel(s.Context, target, req.Conn, buf1, buf2)
+	return statute.Tunnel(req.Context, target, req.Conn, buf1, buf2)
+}
+
+func (s *Server) handleBind(req *request) error {
+	defer func() {
+		_ = req.Conn.Close()
+	}()
+
+	listenAddr := "0.0.0.0:0"
+	if req.DestinationAddr.IP != nil && req.DestinationAddr.IP.To4() == nil {
+		listenAddr = "[::]:0"
+	}
+	ln, err := s.ProxyListen(req.Context, "tcp", listenAddr)
+	if err != nil {
+		if err := sendReply(req.Conn, errToReply(err), nil); err != nil {
+			return fmt.Errorf("failed to send reply: %v", err)
+		}
+		return fmt.Errorf("bind for %v failed: %w", req.DestinationAddr, err)
+	}
+	defer func() {
+		_ = ln.Close()
+	}()
+
+	bind, err := bindAddress(ln.Addr(), req.Conn)
+	if err != nil {
+		return err
+	}
+	if err := sendReply(req.Conn, successReply, bind); err != nil {
+		return fmt.Errorf("failed to send reply: %v", err)
+	}
+
+	inbound, err := s.acceptBind(req.Context, ln, req.DestinationAddr)
+	if err != nil {
+		if err := sendReply(req.Conn, ttlExpired, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %v", err)
+		}
+		return fmt.Errorf("bind for %v failed: %w", req.DestinationAddr, err)
+	}
+	defer func() {
+		_ = inbound.Close()
+	}()
+
+	peer, err := bindAddress(inbound.RemoteAddr(), req.Conn)
+	if err != nil {
+		return err
+	}
+	if err := sendReply(req.Conn, successReply, peer); err != nil {
+		return fmt.Errorf("failed to send reply: %v", err)
+	}
+
+	if s.UserBindHandle != nil {
+		proxyReq := &statute.ProxyRequest{
+			Conn:        req.Conn,
+			Reader:      io.Reader(req.Conn),
+			Writer:      io.Writer(req.Conn),
+			Network:     "tcp",
+			Destination: peer.String(),
+			DestHost:    peer.IP.String(),
+			DestPort:    int32(peer.Port),
+
+			User:     req.Username,
+			Protocol: statute.ProtocolSOCKS5,
+			Source:   statute.SourceAddr(req.Conn.RemoteAddr()),
+			Context:  req.Context,
+		}
+		return s.UserBindHandle(proxyReq, inbound)
+	}
+
+	var buf1, buf2 []byte
+	if s.BytesPool != nil {
+		buf1 = s.BytesPool.Get()
+		buf2 = s.BytesPool.Get()
+		defer func() {
+			s.BytesPool.Put(buf1)
+			s.BytesPool.Put(buf2)
+		}()
+	} else {
+		buf1 = make([]byte, 32*1024)
+		buf2 = make([]byte, 32*1024)
+	}
+	return statute.Tunnel(req.Context, inbound, req.Conn, buf1, buf2)
+}
+
+// acceptBind waits for the inbound connection of a BIND request. When the
+// client named the peer it expects, connections from other hosts are dropped.
+func (s *Server) acceptBind(ctx context.Context, ln net.Listener, want *address) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, bindAcceptTimeout)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		_ = ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		if want.IP == nil || want.IP.IsUnspecified() {
+			return conn, nil
+		}
+		if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && tcpAddr.IP.Equal(want.IP) {
+			return conn, nil
+		}
+		s.Logger.Debug("ignore unexpected bind peer", "address", conn.RemoteAddr(), "want", want)
+		_ = conn.Close()
+	}
+}
+
+// bindAddress converts a listener or peer address to a reply address. An
+// unspecified IP is replaced by the address the client reached us on.
+func bindAddress(addr net.Addr, conn net.Conn) (*address, error) {
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return nil, fmt.Errorf("unexpected bind address %s://%s", addr.Network(), addr.String())
+	}
+	ip := net.IP(addrPort.Addr().Unmap().AsSlice())
+	if ip.IsUnspecified() {
+		if local, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+			ip = local.IP
+		}
+	}
+	return &address{IP: ip, Port: int(addrPort.Port())}, nil
 }
 
 func (s *Server) handleAssociate(req *request) error {
 	destinationAddr := req.DestinationAddr.String()
-	udpConn, err := s.ProxyListenPacket(s.Context, "udp", "127.0.0.1:0")
+	udpConn, err := s.ProxyListenPacket(req.Context, "udp", "127.0.0.1:0")
 	//udpConn, err := s.ListenPacket(s.Context, "udp", destinationAddr)
 	if err != nil {
 		if err := sendReply(req.Conn, errToReply(err), nil); err != nil {
@@ -312,7 +533,7 @@ func (s *Server) handleAssociate(req *request) error {
 		return fmt.Errorf("connect to %v failed: %w", req.DestinationAddr, err)
 	}
 
-	ip, port, err := s.PacketForwardAddress(s.Context, destinationAddr, udpConn, req.Conn)
+	ip, port, err := s.PacketForwardAddress(req.Context, destinationAddr, udpConn, req.Conn)
 	if err != nil {
 		return err
 	}
@@ -321,113 +542,101 @@ func (s *Server) handleAssociate(req *request) error {
 		return fmt.Errorf("failed to send reply: %v", err)
 	}
 
-	if s.UserAssociateHandle == nil {
-		return s.embedHandleAssociate(req, udpConn)
-	}
+	cConn := newUDPCustomConn(udpConn, req.Conn)
+	// the association lives as long as its control connection
+	ctx, cancel := context.WithCancel(req.Context)
+	defer cancel()
+	req.Context = ctx
+	go func() {
+		_, _ = io.Copy(io.Discard, req.Conn)
+		_ = cConn.Close()
+		cancel()
+	}()
+	cConn.asyncReadPackets()
 
-	cConn := &udpCustomConn{
-		PacketConn:   udpConn,
-		assocTCPConn: req.Conn,
-		frc:          make(chan bool),
-		packetQueue:  make(chan *readStruct),
+	if s.UserAssociateHandle == nil {
+		return s.embedHandleAssociate(req.Context, cConn)
 	}
 
-	cConn.asyncReadPackets()
-
 	// wait for first packet so that target sender and receiver get known
 	<-cConn.frc
+	if cConn.targetAddr == nil {
+		return fmt.Errorf("udp association closed before any packet: %w", cConn.readErr)
+	}
+
+	host := cConn.targetAddr.IP.String()
+	if cConn.targetAddr.Name != "" {
+		host = cConn.targetAddr.Name
+	}
 
 	proxyReq := &statute.ProxyRequest{
 		Conn:        cConn,
 		Reader:      cConn,
 		Writer:      cConn,
 		Network:     "udp",
-		Destination: req.DestinationAddr.String(),
-		DestHost:    req.DestinationAddr.IP.String(),
-		DestPort:    int32(req.DestinationAddr.Port),
-		}
+		Destination: cConn.targetAddr.String(),
+		DestHost:    host,
+		DestPort:    int32(cConn.targetAddr.Port),
+
+		DestIsDomain: cConn.targetAddr.Name != "",
+		User:         req.Username,
+		Protocol:     statute.ProtocolSOCKS5,
+		Source:       statute.SourceAddr(req.Conn.RemoteAddr()),
+		Context:      req.Context,
+	}
 	return s.UserAssociateHandle(proxyReq)
 }
 
-func (s *Server) embedHandleAssociate(req *request, udpConn net.PacketConn) error {
-	defer func() {
-		_ = udpConn.Close()
-	}()
-
-	go func() {
-		var buf [1]byte
-		for {
-			_, err := req.Conn.Read(buf[:])
+// embedHandleAssociate relays the association as a full-cone NAT using a
+// single outbound socket per address family
+func (s *Server) embedHandleAssociate(ctx context.Context, cConn *udpCustomConn) error {
+	relay := &statute.UDPRelay{
+		Client: cConn,
+		ListenPacket: func(network string) (net.PacketConn, error) {
+			return s.ProxyListenPacket(ctx, network, "")
+		},
+		Resolve: func(ctx context.Context, host string) (netip.Addr, error) {
+			addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
 			if err != nil {
-				_ = udpConn.Close()
-				break
+				return netip.Addr{}, err
 			}
-		}
-	}()
-
-	var (
-		sourceAddr  net.Addr
-		wantSource  string
-		targetAddr  net.Addr
-		wantTarget  string
-		replyPrefix []byte
-		buf         [maxUdpPacket]byte
-	)
-
-	for {
-		n, addr, err := udpConn.ReadFrom(buf[:])
-		if err != nil {
-			return err
-		}
+			return addrs[0], nil
+		},
+		Logger: s.Logger,
+	}
+	return relay.Serve(ctx)
+}
 
-		if sourceAddr == nil {
-			sourceAddr = addr
-			wantSource = sourceAddr.String()
-		}
+// RejectConn completes the handshake of a client that may not use the proxy
+// and answers its request with "connection not allowed by ruleset"
+func RejectConn(conn net.Conn) error {
+	version, err := readByte(conn)
+	if err != nil {
+		return err
+	}
+	if version != socks5Version {
+		return fmt.Errorf("unsupported SOCKS version: %d", version)
+	}
+	methods, err := readBytes(conn)
+	if err != nil {
+		return err
+	}
+	if bytes.IndexByte(methods, byte(noAuth)) == -1 {
+		_, err := conn.Write([]byte{socks5Version, byte(noAcceptable)})
+		return err
+	}
+	if _, err := conn.Write([]byte{socks5Version, byte(noAuth)}); err != nil {
+		return err
+	}
 
-		gotAddr := addr.String()
-		if wantSource == gotAddr {
-			if n < 3 {
-				continue
-			}
-			reader := bytes.NewBuffer(buf[3:n])
-			addr, err := readAddr(reader)
-			if err != nil {
-				s.Logger.Debug(err.Error())
-				continue
-			}
-			if targetAddr == nil {
-				targetAddr = &net.UDPAddr{
-					IP:   addr.IP,
-					Port: addr.Port,
-				}
-				wantTarget = targetAddr.String()
-			}
-			if addr.String() != wantTarget {
-				s.Logger.Debug("ignore non-target addresses", "address", addr)
-				continue
-			}
-			_, err = udpConn.WriteTo(reader.Bytes(), targetAddr)
-			if err != nil {
-				return err
-			}
-		} else if targetAddr != nil && wantTarget == gotAddr {
-			if replyPrefix == nil {
-				b := bytes.NewBuffer(make([]byte, 3, 16))
-				err = writeAddrWithStr(b, wantTarget)
-				if err != nil {
-					return err
-				}
-				replyPrefix = b.Bytes()
-			}
-			copy(buf[len(replyPrefix):len(replyPrefix)+n], buf[:n])
-			copy(buf[:len(replyPrefix)], replyPrefix)
-			_, err = udpConn.WriteTo(buf[:len(replyPrefix)+n], sourceAddr)
-			if err != nil {
-				return err
-			}
-		}
+	var header [3]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return err
 	}
+	if _, err := readAddr(conn); err != nil {
+		return err
+	}
+	return sendReply(conn, ruleFailure, nil)
 }
 
 func sendReply(w io.Writer, resp reply, addr *address) error {
@@ -446,6 +655,8 @@ type request struct {
 	Username        string
 	Password        string
 	Conn            net.Conn
+	// Context is canceled once the connection is served
+	Context context.Context
 }
 
 func defaultReplyPacketForwardAddress(_ context.Context, destinationAddr string, packet net.PacketConn, conn net.Conn) (net.IP, int, error) {
@@ -456,9 +667,13 @@ func defaultReplyPacketForwardAddress(_ context.Context, destinationAddr string,
 	}
 
 	tcpLocal := conn.LocalAddr()
-	tcpLocalAddr, ok := tcpLocal.(*net.TCPAddr)
-	if !ok {
+	switch tcpLocalAddr := tcpLocal.(type) {
+	case *net.TCPAddr:
+		return tcpLocalAddr.IP, udpLocalAddr.Port, nil
+	case *net.UnixAddr:
+		// unix clients are local, they reach the relay where it listens
+		return udpLocalAddr.IP, udpLocalAddr.Port, nil
+	default:
 		return nil, 0, fmt.Errorf("connect to %v failed: local address is %s://%s", destinationAddr, tcpLocal.Network(), tcpLocal.String())
 	}
-	return tcpLocalAddr.IP, udpLocalAddr.Port, nil
 }
@@ -0,0 +1,86 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// serveOne starts a server for a single client connection and returns the
+// client side
+func serveOne(t *testing.T, s *Server) net.Conn {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	qt.Assert(t, err, qt.IsNil)
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		_ = s.ServeConn(conn)
+	}()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	qt.Assert(t, err, qt.IsNil)
+	t.Cleanup(func() { _ = client.Close() })
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	return client
+}
+
+// readReply reads a reply and returns its code and address
+func readReply(t *testing.T, r io.Reader) (reply, *address) {
+	var header [3]byte
+	_, err := io.ReadFull(r, header[:])
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, header[0], qt.Equals, byte(socks5Version))
+	addr, err := readAddr(r)
+	qt.Assert(t, err, qt.IsNil)
+	return reply(header[1]), addr
+}
+
+func TestBind(t *testing.T) {
+	client := serveOne(t, NewServer())
+
+	_, err := client.Write([]byte{socks5Version, 1, byte(noAuth)})
+	qt.Assert(t, err, qt.IsNil)
+	var method [2]byte
+	_, err = io.ReadFull(client, method[:])
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, method, qt.Equals, [2]byte{socks5Version, byte(noAuth)})
+
+	// the peer is expected from 127.0.0.1
+	_, err = client.Write([]byte{socks5Version, byte(BindCommand), 0, ipv4Address, 127, 0, 0, 1, 0, 0})
+	qt.Assert(t, err, qt.IsNil)
+
+	code, bound := readReply(t, client)
+	qt.Assert(t, code, qt.Equals, successReply)
+	// the listener is reported on the address the client reached the server on
+	qt.Assert(t, bound.IP.Equal(net.IPv4(127, 0, 0, 1)), qt.IsTrue, qt.Commentf("bound to %s", bound))
+	qt.Assert(t, bound.Port, qt.Not(qt.Equals), 0)
+
+	peer, err := net.Dial("tcp", bound.Address())
+	qt.Assert(t, err, qt.IsNil)
+	defer peer.Close()
+	_ = peer.SetDeadline(time.Now().Add(5 * time.Second))
+
+	code, from := readReply(t, client)
+	qt.Assert(t, code, qt.Equals, successReply)
+	qt.Assert(t, from.Address(), qt.Equals, peer.LocalAddr().String())
+
+	_, err = peer.Write([]byte("ping"))
+	qt.Assert(t, err, qt.IsNil)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(client, buf)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, string(buf), qt.Equals, "ping")
+
+	_, err = client.Write([]byte("pong"))
+	qt.Assert(t, err, qt.IsNil)
+	_, err = io.ReadFull(peer, buf)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, string(buf), qt.Equals, "pong")
+}
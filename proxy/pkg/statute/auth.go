@@ -0,0 +1,28 @@
+package statute
+
+import "crypto/subtle"
+
+// CredentialStore gives the servers access to user credentials. The same store
+// is shared by socks5 and http so one set of accounts protects every protocol.
+type CredentialStore interface {
+	// Password returns the password of user and whether the user exists
+	Password(user string) (string, bool)
+}
+
+// StaticCredentials is a CredentialStore backed by a fixed user to password map
+type StaticCredentials map[string]string
+
+// Password implements CredentialStore
+func (c StaticCredentials) Password(user string) (string, bool) {
+	password, ok := c[user]
+	return password, ok
+}
+
+// ValidCredentials reports whether user exists in store with the given password
+func ValidCredentials(store CredentialStore, user, password string) bool {
+	want, ok := store.Password(user)
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(want), []byte(password)) == 1
+}
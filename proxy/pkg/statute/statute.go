@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/netip"
 )
 
 type Logger interface {
@@ -22,6 +23,14 @@ func (l DefaultLogger) Error(v ...interface{}) {
 	fmt.Println(v...)
 }
 
+// protocols a ProxyRequest can arrive with
+const (
+	ProtocolSOCKS5      = "socks5"
+	ProtocolSOCKS4      = "socks4"
+	ProtocolHTTP        = "http"
+	ProtocolShadowsocks = "shadowsocks"
+)
+
 type ProxyRequest struct {
 	Conn        net.Conn
 	Reader      io.Reader
@@ -30,14 +39,55 @@ type ProxyRequest struct {
 	Destination string
 	DestHost    string
 	DestPort    int32
+	// DestIsDomain reports whether the client named the destination by a
+	// domain, DestHost is an IP literal otherwise
+	DestIsDomain bool
+	// User is the name the client authenticated with, empty when the proxy
+	// does not require authentication
+	User string
+	// Protocol is the proxy protocol the client spoke, one of the Protocol
+	// constants
+	Protocol string
+	// Source is the address of the client
+	Source netip.AddrPort
+	// Context is canceled when the client connection is done or the server
+	// shuts down
+	Context context.Context
+}
+
+// SourceAddr converts the remote address of a client connection to a
+// netip.AddrPort, v4-mapped addresses are unmapped
+func SourceAddr(addr net.Addr) netip.AddrPort {
+	var addrPort netip.AddrPort
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		addrPort = a.AddrPort()
+	case *net.UDPAddr:
+		addrPort = a.AddrPort()
+	default:
+		var err error
+		if addrPort, err = netip.ParseAddrPort(addr.String()); err != nil {
+			return netip.AddrPort{}
+		}
+	}
+	return netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port())
 }
 
 // UserConnectHandler is used for socks5, socks4 and http
 type UserConnectHandler func(request *ProxyRequest) error
 
+// ConnectCheck is consulted by socks5, socks4 and http before they confirm a
+// connect request to the client. An error is answered as a failed connection
+// instead of calling the UserConnectHandler.
+type ConnectCheck func(request *ProxyRequest) error
+
 // UserAssociateHandler is used for socks5
 type UserAssociateHandler func(request *ProxyRequest) error
 
+// UserBindHandler is used for socks5 BIND requests, inbound is the connection
+// that was accepted on behalf of the client
+type UserBindHandler func(request *ProxyRequest, inbound net.Conn) error
+
 // ProxyDialFunc is used for socks5, socks4 and http
 type ProxyDialFunc func(ctx context.Context, network string, address string) (net.Conn, error)
 
@@ -57,6 +107,16 @@ func DefaultProxyListenPacket() ProxyListenPacket {
 	return listener.ListenPacket
 }
 
+// ProxyListenFunc specifies the optional listen function for accepting the
+// inbound connection of a BIND request
+type ProxyListenFunc func(ctx context.Context, network string, address string) (net.Listener, error)
+
+// DefaultProxyListen for ProxyListenFunc type
+func DefaultProxyListen() ProxyListenFunc {
+	var listener net.ListenConfig
+	return listener.Listen
+}
+
 // PacketForwardAddress specifies the packet forwarding address
 type PacketForwardAddress func(ctx context.Context, destinationAddr string,
 	packet net.PacketConn, conn net.Conn) (net.IP, int, error)
@@ -2,6 +2,7 @@ package statute
 
 import (
 	"context"
+	"errors"
 	"io"
 	"net"
 	"os"
@@ -43,6 +44,19 @@ func errno(v error) uintptr {
 	return 0
 }
 
+// ErrHalfCloseUnsupported is returned by CloseWrite for connections that can
+// only be closed as a whole
+var ErrHalfCloseUnsupported = errors.New("connection does not support half-close")
+
+// CloseWrite shuts down the writing side of conn, the peer reads an end of
+// stream while conn stays readable
+func CloseWrite(conn net.Conn) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return ErrHalfCloseUnsupported
+}
+
 // Tunnel create tunnels for two io.ReadWriteCloser
 func Tunnel(ctx context.Context, c1, c2 io.ReadWriteCloser, buf1, buf2 []byte) error {
 	ctx, cancel := context.WithCancel(ctx)
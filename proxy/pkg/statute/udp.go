@@ -0,0 +1,290 @@
+package statute
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultUDPIdleTimeout is how long a destination of a UDP association stays
+// mapped without any traffic
+const DefaultUDPIdleTimeout = 2 * time.Minute
+
+const maxDatagramSize = 64 * 1024
+
+const (
+	// udpResolveQueue is how many datagrams to a host name may wait for its
+	// lookup, more are dropped
+	udpResolveQueue = 16
+	// udpMaxResolving caps the host names of an association looked up at
+	// the same time, datagrams to further names are dropped
+	udpMaxResolving = 32
+)
+
+// UDPRelay forwards the datagrams of a single UDP association and behaves as
+// a full-cone NAT. Every destination shares one outbound socket per address
+// family, replies from any host are delivered back to the client, and a
+// reply from a destination the client addressed by name carries that name.
+// Host names are resolved off the read loop, so a slow lookup only holds up
+// the datagrams waiting for that name.
+type UDPRelay struct {
+	// Client is the client side of the association. ReadFrom must return the
+	// destination of each datagram and WriteTo sends replies to the client
+	// with the given source address.
+	Client net.PacketConn
+	// ListenPacket opens the outbound socket for "udp4" or "udp6"
+	ListenPacket func(network string) (net.PacketConn, error)
+	// Resolve looks up the address of a destination host name
+	Resolve func(ctx context.Context, host string) (netip.Addr, error)
+	// IdleTimeout expires destinations without traffic, zero means DefaultUDPIdleTimeout
+	IdleTimeout time.Duration
+	// Logger error log
+	Logger *slog.Logger
+
+	mu      sync.Mutex
+	closed  bool
+	sockets map[string]net.PacketConn
+	dests   map[string]*udpEntry
+	names   map[netip.AddrPort]string
+	// pending holds the datagrams waiting for the lookup of a destination
+	pending map[string][][]byte
+}
+
+type udpEntry struct {
+	addr     netip.AddrPort
+	lastSeen time.Time
+}
+
+// nameAddr is the source address of a reply from a destination that the
+// client addressed by host name
+type nameAddr string
+
+func (a nameAddr) Network() string { return "udp" }
+func (a nameAddr) String() string  { return string(a) }
+
+// Serve relays datagrams until the client side is closed or ctx is done
+func (r *UDPRelay) Serve(ctx context.Context) error {
+	if r.Logger == nil {
+		r.Logger = slog.Default()
+	}
+	if r.IdleTimeout == 0 {
+		r.IdleTimeout = DefaultUDPIdleTimeout
+	}
+	r.sockets = make(map[string]net.PacketConn)
+	r.dests = make(map[string]*udpEntry)
+	r.names = make(map[netip.AddrPort]string)
+	r.pending = make(map[string][][]byte)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer r.closeSockets()
+
+	go func() {
+		<-ctx.Done()
+		_ = r.Client.Close()
+	}()
+	go r.expire(ctx)
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := r.Client.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		dest := addr.String()
+		target, host, port, err := r.lookup(dest)
+		if err != nil {
+			r.Logger.Debug("dropping datagram", "destination", addr, "error", err)
+			continue
+		}
+		if host != "" {
+			r.resolveLater(ctx, dest, host, port, buf[:n])
+			continue
+		}
+		r.send(target, dest, buf[:n])
+	}
+}
+
+// lookup maps a destination as given by the client to an address. A host
+// name that is not mapped yet is returned with its port for resolveLater.
+func (r *UDPRelay) lookup(dest string) (addr netip.AddrPort, host string, port uint16, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if entry, ok := r.dests[dest]; ok {
+		entry.lastSeen = time.Now()
+		return entry.addr, "", 0, nil
+	}
+
+	host, portStr, err := net.SplitHostPort(dest)
+	if err != nil {
+		return netip.AddrPort{}, "", 0, err
+	}
+	p, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, "", 0, err
+	}
+
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.AddrPort{}, host, uint16(p), nil
+	}
+	addr = netip.AddrPortFrom(ip.Unmap(), uint16(p))
+	r.dests[dest] = &udpEntry{addr: addr, lastSeen: time.Now()}
+	return addr, "", 0, nil
+}
+
+// resolveLater queues a copy of data for dest and looks up host in the
+// background unless a lookup of dest is already running
+func (r *UDPRelay) resolveLater(ctx context.Context, dest, host string, port uint16, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	queued, ok := r.pending[dest]
+	switch {
+	case ok && len(queued) >= udpResolveQueue:
+		r.Logger.Debug("dropping datagram", "destination", dest, "reason", "too many datagrams waiting for the lookup")
+		return
+	case !ok && len(r.pending) >= udpMaxResolving:
+		r.Logger.Debug("dropping datagram", "destination", dest, "reason", "too many lookups")
+		return
+	}
+	r.pending[dest] = append(queued, slices.Clone(data))
+	if !ok {
+		go r.resolve(ctx, dest, host, port)
+	}
+}
+
+// resolve looks up host, remembers the address for dest and sends the
+// datagrams that waited for it
+func (r *UDPRelay) resolve(ctx context.Context, dest, host string, port uint16) {
+	ip, err := r.Resolve(ctx, host)
+	addr := netip.AddrPortFrom(ip.Unmap(), port)
+
+	r.mu.Lock()
+	queued := r.pending[dest]
+	delete(r.pending, dest)
+	if err == nil {
+		r.dests[dest] = &udpEntry{addr: addr, lastSeen: time.Now()}
+		r.names[addr] = dest
+	}
+	r.mu.Unlock()
+
+	if err != nil {
+		r.Logger.Debug("dropping datagrams", "destination", dest, "count", len(queued), "error", err)
+		return
+	}
+	for _, data := range queued {
+		r.send(addr, dest, data)
+	}
+}
+
+// send writes data to addr, which the client addressed as dest
+func (r *UDPRelay) send(addr netip.AddrPort, dest string, data []byte) {
+	conn, err := r.socket(addr)
+	if err != nil {
+		r.Logger.Debug("dropping datagram", "destination", dest, "error", err)
+		return
+	}
+	if _, err := conn.WriteTo(data, net.UDPAddrFromAddrPort(addr)); err != nil {
+		r.Logger.Debug("failed to send datagram", "destination", dest, "error", err)
+	}
+}
+
+// socket returns the outbound socket for the family of dest, opening it and
+// starting its reply loop on first use
+func (r *UDPRelay) socket(dest netip.AddrPort) (net.PacketConn, error) {
+	network := "udp6"
+	if dest.Addr().Is4() {
+		network = "udp4"
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		// a lookup finished after the association ended
+		return nil, net.ErrClosed
+	}
+	if conn, ok := r.sockets[network]; ok {
+		return conn, nil
+	}
+	conn, err := r.ListenPacket(network)
+	if err != nil {
+		return nil, err
+	}
+	r.sockets[network] = conn
+	go r.readReplies(conn)
+	return conn, nil
+}
+
+func (r *UDPRelay) readReplies(conn net.PacketConn) {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		src, err := netip.ParseAddrPort(addr.String())
+		if err != nil {
+			continue
+		}
+		src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+
+		var from net.Addr = net.UDPAddrFromAddrPort(src)
+		r.mu.Lock()
+		if name, ok := r.names[src]; ok {
+			from = nameAddr(name)
+			if entry, ok := r.dests[name]; ok {
+				entry.lastSeen = time.Now()
+			}
+		}
+		r.mu.Unlock()
+
+		if _, err := r.Client.WriteTo(buf[:n], from); err != nil {
+			r.Logger.Debug("failed to deliver datagram", "source", src, "error", err)
+		}
+	}
+}
+
+// expire forgets destinations that have been idle for longer than IdleTimeout
+func (r *UDPRelay) expire(ctx context.Context) {
+	ticker := time.NewTicker(r.IdleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			r.mu.Lock()
+			for dest, entry := range r.dests {
+				if now.Sub(entry.lastSeen) < r.IdleTimeout {
+					continue
+				}
+				delete(r.dests, dest)
+				if r.names[entry.addr] == dest {
+					delete(r.names, entry.addr)
+				}
+			}
+			r.mu.Unlock()
+		}
+	}
+}
+
+func (r *UDPRelay) closeSockets() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	for _, conn := range r.sockets {
+		_ = conn.Close()
+	}
+}
@@ -0,0 +1,202 @@
+package statute
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+type datagram struct {
+	data []byte
+	addr net.Addr
+}
+
+// testClient is the client side of an association, the test sends datagrams
+// through in and receives the replies of the relay from out
+type testClient struct {
+	in     chan datagram
+	out    chan datagram
+	closed chan struct{}
+}
+
+func newTestClient() *testClient {
+	return &testClient{
+		in:     make(chan datagram),
+		out:    make(chan datagram, 16),
+		closed: make(chan struct{}),
+	}
+}
+
+func (c *testClient) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case d := <-c.in:
+		return copy(b, d.data), d.addr, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *testClient) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.out <- datagram{data: append([]byte(nil), b...), addr: addr}
+	return len(b), nil
+}
+
+func (c *testClient) Close() error {
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+	}
+	return nil
+}
+
+func (c *testClient) LocalAddr() net.Addr              { return nil }
+func (c *testClient) SetDeadline(time.Time) error      { return nil }
+func (c *testClient) SetReadDeadline(time.Time) error  { return nil }
+func (c *testClient) SetWriteDeadline(time.Time) error { return nil }
+
+func (c *testClient) send(data string, addr net.Addr) {
+	c.in <- datagram{data: []byte(data), addr: addr}
+}
+
+func (c *testClient) receive(t *testing.T) datagram {
+	select {
+	case d := <-c.out:
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatal("no datagram for the client")
+		return datagram{}
+	}
+}
+
+// listenUDP returns a socket on 127.0.0.1
+func listenUDP(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	qt.Assert(t, err, qt.IsNil)
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+// receiveFrom reads a datagram from conn and returns it with its source
+func receiveFrom(t *testing.T, conn net.PacketConn) (string, net.Addr) {
+	buf := make([]byte, 1500)
+	n, addr, err := conn.ReadFrom(buf)
+	qt.Assert(t, err, qt.IsNil)
+	return string(buf[:n]), addr
+}
+
+func TestUDPRelay(t *testing.T) {
+	first := listenUDP(t)
+	second := listenUDP(t)
+	third := listenUDP(t)
+
+	client := newTestClient()
+	relay := &UDPRelay{
+		Client: client,
+		ListenPacket: func(network string) (net.PacketConn, error) {
+			return net.ListenPacket(network, "127.0.0.1:0")
+		},
+		Resolve: func(_ context.Context, host string) (netip.Addr, error) {
+			return netip.MustParseAddr("127.0.0.1"), nil
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- relay.Serve(ctx) }()
+
+	client.send("one", first.LocalAddr())
+	data, mapped := receiveFrom(t, first)
+	qt.Assert(t, data, qt.Equals, "one")
+
+	// every destination sees the same mapping
+	client.send("two", second.LocalAddr())
+	data, addr := receiveFrom(t, second)
+	qt.Assert(t, data, qt.Equals, "two")
+	qt.Assert(t, addr.String(), qt.Equals, mapped.String())
+
+	_, err := first.WriteTo([]byte("reply"), mapped)
+	qt.Assert(t, err, qt.IsNil)
+	d := client.receive(t)
+	qt.Assert(t, string(d.data), qt.Equals, "reply")
+	qt.Assert(t, d.addr.String(), qt.Equals, first.LocalAddr().String())
+
+	// a host the client never addressed reaches it through the mapping too
+	_, err = third.WriteTo([]byte("hello"), mapped)
+	qt.Assert(t, err, qt.IsNil)
+	d = client.receive(t)
+	qt.Assert(t, string(d.data), qt.Equals, "hello")
+	qt.Assert(t, d.addr.String(), qt.Equals, third.LocalAddr().String())
+
+	// replies of a destination addressed by name carry that name
+	_, port, _ := net.SplitHostPort(second.LocalAddr().String())
+	name := net.JoinHostPort("echo.example", port)
+	client.send("three", nameAddr(name))
+	data, addr = receiveFrom(t, second)
+	qt.Assert(t, data, qt.Equals, "three")
+	_, err = second.WriteTo([]byte("named"), addr)
+	qt.Assert(t, err, qt.IsNil)
+	d = client.receive(t)
+	qt.Assert(t, string(d.data), qt.Equals, "named")
+	qt.Assert(t, d.addr.String(), qt.Equals, name)
+
+	_ = client.Close()
+	select {
+	case err := <-done:
+		qt.Assert(t, err, qt.IsNil)
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay did not stop with its client")
+	}
+}
+
+func TestUDPRelaySlowLookup(t *testing.T) {
+	named := listenUDP(t)
+	direct := listenUDP(t)
+
+	release := make(chan struct{})
+	client := newTestClient()
+	relay := &UDPRelay{
+		Client: client,
+		ListenPacket: func(network string) (net.PacketConn, error) {
+			return net.ListenPacket(network, "127.0.0.1:0")
+		},
+		Resolve: func(ctx context.Context, host string) (netip.Addr, error) {
+			select {
+			case <-release:
+				return netip.MustParseAddr("127.0.0.1"), nil
+			case <-ctx.Done():
+				return netip.Addr{}, ctx.Err()
+			}
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = relay.Serve(ctx) }()
+
+	_, port, _ := net.SplitHostPort(named.LocalAddr().String())
+	name := nameAddr(net.JoinHostPort("slow.example", port))
+	client.send("first", name)
+	client.send("second", name)
+
+	// other destinations are served while the lookup hangs
+	client.send("direct", direct.LocalAddr())
+	data, _ := receiveFrom(t, direct)
+	qt.Assert(t, data, qt.Equals, "direct")
+
+	// the datagrams that waited go out in order once the name resolved
+	close(release)
+	data, _ = receiveFrom(t, named)
+	qt.Assert(t, data, qt.Equals, "first")
+	data, _ = receiveFrom(t, named)
+	qt.Assert(t, data, qt.Equals, "second")
+
+	// and later ones use the remembered address
+	client.send("third", name)
+	data, _ = receiveFrom(t, named)
+	qt.Assert(t, data, qt.Equals, "third")
+}
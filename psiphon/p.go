@@ -300,11 +300,13 @@ func (tunnel *Tunnel) Stop() {
 	psiphon.CloseDataStore()
 }
 
-func RunPsiphon(ctx context.Context, l *slog.Logger, wgBind, dir, localSocksPort, country string) error {
+// RunPsiphon starts a psiphon tunnel through the SOCKS5 proxy at wgBind. The
+// tunnel serves its local SOCKS proxy on SOCKSProxyPort until it is stopped.
+func RunPsiphon(ctx context.Context, l *slog.Logger, wgBind, dir, localSocksPort, country string) (*Tunnel, error) {
 	// Embedded configuration
 	host, port, err := net.SplitHostPort(localSocksPort)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if strings.HasPrefix(host, "127.0.0") {
 		host = ""
@@ -350,9 +352,9 @@ func RunPsiphon(ctx context.Context, l *slog.Logger, wgBind, dir, localSocksPort
 		select {
 		case <-childCtx.Done():
 			if errors.Is(childCtx.Err(), context.Canceled) {
-				return errors.New("psiphon handshake operation canceled")
+				return nil, errors.New("psiphon handshake operation canceled")
 			}
-			return errors.New("psiphon handshake maximum time exceeded")
+			return nil, errors.New("psiphon handshake maximum time exceeded")
 		case <-t.C:
 			tunnel, err := StartTunnel(ctx, []byte(configJSON), "", p)
 			if err != nil {
@@ -360,7 +362,7 @@ func RunPsiphon(ctx context.Context, l *slog.Logger, wgBind, dir, localSocksPort
 				continue
 			}
 			l.Info(fmt.Sprintf("Psiphon started successfully on port %d, handshake operation took %s", tunnel.SOCKSProxyPort, time.Since(t0)))
-			return nil
+			return tunnel, nil
 		}
 	}
 }
@@ -129,6 +129,27 @@ func makeClient() *http.Client {
 	}
 }
 
+// PingAPI sends a request to the WARP API with the client used for
+// registrations and returns how long the answer took. Any HTTP status counts
+// as an answer.
+func PingAPI(ctx context.Context) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", regURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	for k, v := range defaultHeaders {
+		req.Header.Set(k, v)
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return time.Since(start), nil
+}
+
 func doRegister(publicKey string) (Identity, error) {
 	data := map[string]interface{}{
 		"install_id":   "",
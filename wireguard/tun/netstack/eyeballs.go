@@ -0,0 +1,193 @@
+package netstack
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+)
+
+// connectionAttemptDelay is the head start of each TCP connection attempt
+// over the next one, the value recommended by RFC 8305
+const connectionAttemptDelay = 250 * time.Millisecond
+
+// AddressPreference selects the address families used to reach destinations
+// inside the tunnel and which of them is tried first
+type AddressPreference int32
+
+const (
+	// PreferIPv6 tries IPv6 addresses first when the tunnel has an IPv6 address
+	PreferIPv6 AddressPreference = iota
+	// PreferIPv4 tries IPv4 addresses first
+	PreferIPv4
+	// IPv4Only never uses IPv6 destinations
+	IPv4Only
+	// IPv6Only never uses IPv4 destinations
+	IPv6Only
+)
+
+var addressPreferenceNames = [...]string{
+	PreferIPv6: "prefer-v6",
+	PreferIPv4: "prefer-v4",
+	IPv4Only:   "v4-only",
+	IPv6Only:   "v6-only",
+}
+
+// AddressPreferences lists the names ParseAddressPreference accepts
+func AddressPreferences() []string {
+	return addressPreferenceNames[:]
+}
+
+// ParseAddressPreference parses prefer-v6, prefer-v4, v4-only or v6-only
+func ParseAddressPreference(s string) (AddressPreference, error) {
+	for p, name := range addressPreferenceNames {
+		if name == s {
+			return AddressPreference(p), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown address preference %q", s)
+}
+
+func (p AddressPreference) String() string {
+	if p < 0 || int(p) >= len(addressPreferenceNames) {
+		return fmt.Sprintf("AddressPreference(%d)", p)
+	}
+	return addressPreferenceNames[p]
+}
+
+// SetAddressPreference changes the address families used by LookupContextHost
+// and DialContext
+func (tnet *Net) SetAddressPreference(p AddressPreference) {
+	tnet.preference.Store(int32(p))
+}
+
+// AddressPreference returns the preference set with SetAddressPreference
+func (tnet *Net) AddressPreference() AddressPreference {
+	return AddressPreference(tnet.preference.Load())
+}
+
+// lookupFamilies reports which address families are worth resolving
+func (tnet *Net) lookupFamilies() (v4, v6 bool) {
+	p := tnet.AddressPreference()
+	return tnet.hasV4 && p != IPv6Only, tnet.hasV6 && p != IPv4Only
+}
+
+// preferV6 reports whether IPv6 addresses are tried before IPv4 ones
+func (tnet *Net) preferV6() bool {
+	switch tnet.AddressPreference() {
+	case PreferIPv6:
+		return tnet.hasV6
+	case IPv6Only:
+		return true
+	default:
+		return false
+	}
+}
+
+// interleave reorders addrs, which are sorted by family preference, so the
+// families alternate starting with the preferred one
+func interleave(addrs []netip.AddrPort) []netip.AddrPort {
+	if len(addrs) == 0 {
+		return addrs
+	}
+	var first, second []netip.AddrPort
+	for _, addr := range addrs {
+		if addr.Addr().Is4() == addrs[0].Addr().Is4() {
+			first = append(first, addr)
+		} else {
+			second = append(second, addr)
+		}
+	}
+
+	out := make([]netip.AddrPort, 0, len(addrs))
+	for len(first) > 0 || len(second) > 0 {
+		if len(first) > 0 {
+			out = append(out, first[0])
+			first = first[1:]
+		}
+		if len(second) > 0 {
+			out = append(out, second[0])
+			second = second[1:]
+		}
+	}
+	return out
+}
+
+// dialTCPRace connects to the first of addrs that accepts. Attempts alternate
+// between the address families and start connectionAttemptDelay apart, or
+// right away when the previous attempt failed, as described in RFC 8305.
+func (tnet *Net) dialTCPRace(ctx context.Context, addrs []netip.AddrPort) (net.Conn, error) {
+	if len(addrs) == 1 {
+		return tnet.DialContextTCPAddrPort(ctx, addrs[0])
+	}
+	addrs = interleave(addrs)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn *gonet.TCPConn
+		err  error
+	}
+	// buffered so attempts that lose the race never block
+	results := make(chan result, len(addrs))
+	next, pending := 0, 0
+	start := func() {
+		addr := addrs[next]
+		next++
+		pending++
+		go func() {
+			conn, err := tnet.DialContextTCPAddrPort(ctx, addr)
+			results <- result{conn, err}
+		}()
+	}
+
+	start()
+	delay := time.NewTimer(connectionAttemptDelay)
+	defer delay.Stop()
+	restart := func() {
+		if !delay.Stop() {
+			select {
+			case <-delay.C:
+			default:
+			}
+		}
+		delay.Reset(connectionAttemptDelay)
+	}
+
+	var firstErr error
+	for pending > 0 {
+		select {
+		case <-delay.C:
+			if next < len(addrs) {
+				start()
+				delay.Reset(connectionAttemptDelay)
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				cancel()
+				// attempts that still complete are not needed anymore
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if r := <-results; r.conn != nil {
+							_ = r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(addrs) {
+				start()
+				restart()
+			}
+		}
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,151 @@
+package netstack
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wireguard/tun"
+)
+
+func TestInterleave(t *testing.T) {
+	v4a := netip.MustParseAddrPort("192.0.2.1:443")
+	v4b := netip.MustParseAddrPort("192.0.2.2:443")
+	v4c := netip.MustParseAddrPort("192.0.2.3:443")
+	v6a := netip.MustParseAddrPort("[2001:db8::1]:443")
+	v6b := netip.MustParseAddrPort("[2001:db8::2]:443")
+
+	tests := []struct {
+		name string
+		in   []netip.AddrPort
+		want []netip.AddrPort
+	}{
+		{"empty", nil, nil},
+		{"single", []netip.AddrPort{v4a}, []netip.AddrPort{v4a}},
+		{"one family", []netip.AddrPort{v4a, v4b, v4c}, []netip.AddrPort{v4a, v4b, v4c}},
+		{"v6 first", []netip.AddrPort{v6a, v6b, v4a, v4b}, []netip.AddrPort{v6a, v4a, v6b, v4b}},
+		{"v4 first", []netip.AddrPort{v4a, v4b, v6a, v6b}, []netip.AddrPort{v4a, v6a, v4b, v6b}},
+		{"uneven", []netip.AddrPort{v4a, v4b, v4c, v6a}, []netip.AddrPort{v4a, v6a, v4b, v4c}},
+	}
+	for _, test := range tests {
+		if got := interleave(test.in); !slices.Equal(got, test.want) {
+			t.Errorf("%s: interleave(%v) = %v, want %v", test.name, test.in, got, test.want)
+		}
+	}
+}
+
+func TestParseAddressPreference(t *testing.T) {
+	for _, name := range AddressPreferences() {
+		p, err := ParseAddressPreference(name)
+		if err != nil {
+			t.Fatalf("ParseAddressPreference(%q): %v", name, err)
+		}
+		if p.String() != name {
+			t.Errorf("ParseAddressPreference(%q) = %v", name, p)
+		}
+	}
+	if _, err := ParseAddressPreference("v5-only"); err == nil {
+		t.Error("ParseAddressPreference accepted v5-only")
+	}
+}
+
+func TestAddressPreference(t *testing.T) {
+	dualStack := []netip.Addr{netip.MustParseAddr("172.16.0.2"), netip.MustParseAddr("fd01:db8::2")}
+	v4Stack := dualStack[:1]
+
+	tests := []struct {
+		addrs      []netip.Addr
+		preference AddressPreference
+		v4, v6     bool
+		preferV6   bool
+	}{
+		{dualStack, PreferIPv6, true, true, true},
+		{dualStack, PreferIPv4, true, true, false},
+		{dualStack, IPv4Only, true, false, false},
+		{dualStack, IPv6Only, false, true, true},
+		// without an IPv6 address v6 is never resolved
+		{v4Stack, PreferIPv6, true, false, false},
+		{v4Stack, IPv6Only, false, false, true},
+	}
+	for _, test := range tests {
+		_, tnet, err := CreateNetTUN(test.addrs, nil, 1420)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tnet.SetAddressPreference(test.preference)
+		v4, v6 := tnet.lookupFamilies()
+		if v4 != test.v4 || v6 != test.v6 {
+			t.Errorf("%v with %v: lookupFamilies() = %t, %t, want %t, %t", test.preference, test.addrs, v4, v6, test.v4, test.v6)
+		}
+		if got := tnet.preferV6(); got != test.preferV6 {
+			t.Errorf("%v with %v: preferV6() = %t, want %t", test.preference, test.addrs, got, test.preferV6)
+		}
+	}
+}
+
+// linkTun writes every packet leaving src into dst
+func linkTun(src, dst tun.Device) {
+	bufs := [][]byte{make([]byte, 65535)}
+	sizes := make([]int, 1)
+	for {
+		n, err := src.Read(bufs, sizes, 0)
+		if err != nil {
+			return
+		}
+		for i := range n {
+			if _, err := dst.Write([][]byte{bufs[i][:sizes[i]]}, 0); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func TestDialTCPRace(t *testing.T) {
+	local, tnet, err := CreateNetTUN([]netip.Addr{netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("fd00::1")}, nil, 1420)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the remote end has no IPv6 address, so the preferred v6 attempt never
+	// gets an answer
+	remote, rnet, err := CreateNetTUN([]netip.Addr{netip.MustParseAddr("10.0.0.2")}, nil, 1420)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go linkTun(local, remote)
+	go linkTun(remote, local)
+
+	v4 := netip.MustParseAddrPort("10.0.0.2:80")
+	ln, err := rnet.ListenTCPAddrPort(v4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	conn, err := tnet.DialContextAddrPorts(ctx, "tcp", []netip.AddrPort{v4, netip.MustParseAddrPort("[fd00::2]:80")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if got := conn.RemoteAddr().String(); got != v4.String() {
+		t.Errorf("connected to %s, want %s", got, v4)
+	}
+	// v4 only started after the head start of the v6 attempt
+	if elapsed := time.Since(start); elapsed < connectionAttemptDelay {
+		t.Errorf("connected after %v, within the head start of the v6 attempt", elapsed)
+	}
+}
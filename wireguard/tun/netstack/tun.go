@@ -7,6 +7,7 @@ package netstack
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	"crypto/rand"
 	"encoding/binary"
@@ -17,8 +18,10 @@ import (
 	"net/netip"
 	"os"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -47,6 +50,7 @@ type netTun struct {
 	mtu            int
 	dnsServers     []netip.Addr
 	hasV4, hasV6   bool
+	preference     atomic.Int32
 }
 
 type Net netTun
@@ -189,6 +193,18 @@ func (tun *netTun) BatchSize() int {
 	return 1
 }
 
+// InterfaceAddrs returns the local addresses assigned to the tunnel
+func (net *Net) InterfaceAddrs() []netip.Addr {
+	var addrs []netip.Addr
+	for _, protoAddr := range net.stack.AllAddresses()[1] {
+		addr, ok := netip.AddrFromSlice(protoAddr.AddressWithPrefix.Address.AsSlice())
+		if ok {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
 func convertToFullAddr(endpoint netip.AddrPort) (tcpip.FullAddress, tcpip.NetworkProtocolNumber) {
 	var protoNumber tcpip.NetworkProtocolNumber
 	if endpoint.Addr().Is4() {
@@ -831,22 +847,26 @@ func (tnet *Net) LookupContextHost(ctx context.Context, host string) ([]string,
 		error
 	}
 	var addrsV4, addrsV6 []netip.Addr
+	lookupV4, lookupV6 := tnet.lookupFamilies()
 	lanes := 0
-	if tnet.hasV4 {
+	if lookupV4 {
 		lanes++
 	}
-	if tnet.hasV6 {
+	if lookupV6 {
 		lanes++
 	}
+	if lanes == 0 {
+		return nil, &net.DNSError{Err: errNoSuchHost.Error(), Name: host, IsNotFound: true}
+	}
 	lane := make(chan result, lanes)
 	var lastErr error
-	if tnet.hasV4 {
+	if lookupV4 {
 		go func() {
 			p, server, err := tnet.tryOneName(ctx, host+".", dnsmessage.TypeA)
 			lane <- result{p, server, err}
 		}()
 	}
-	if tnet.hasV6 {
+	if lookupV6 {
 		go func() {
 			p, server, err := tnet.tryOneName(ctx, host+".", dnsmessage.TypeAAAA)
 			lane <- result{p, server, err}
@@ -912,9 +932,9 @@ func (tnet *Net) LookupContextHost(ctx context.Context, host string) ([]string,
 			}
 		}
 	}
-	// We don't do RFC6724. Instead just put V6 addresses first if an IPv6 address is enabled
+	// We don't do RFC6724. Instead just put the addresses of the preferred family first
 	var addrs []netip.Addr
-	if tnet.hasV6 {
+	if tnet.preferV6() {
 		addrs = append(addrsV6, addrsV4...)
 	} else {
 		addrs = append(addrsV4, addrsV6...)
@@ -956,16 +976,9 @@ func (tnet *Net) DialContext(ctx context.Context, network, address string) (net.
 	if ctx == nil {
 		panic("nil context")
 	}
-	var acceptV4, acceptV6 bool
-	matches := protoSplitter.FindStringSubmatch(network)
-	if matches == nil {
-		return nil, &net.OpError{Op: "dial", Err: net.UnknownNetworkError(network)}
-	} else if len(matches[2]) == 0 {
-		acceptV4 = true
-		acceptV6 = true
-	} else {
-		acceptV4 = matches[2][0] == '4'
-		acceptV6 = !acceptV4
+	matches, acceptV4, acceptV6, err := tnet.splitNetwork(network)
+	if err != nil {
+		return nil, err
 	}
 	var host string
 	var port int
@@ -973,7 +986,6 @@ func (tnet *Net) DialContext(ctx context.Context, network, address string) (net.
 		host = address
 	} else {
 		var sport string
-		var err error
 		host, sport, err = net.SplitHostPort(address)
 		if err != nil {
 			return nil, &net.OpError{Op: "dial", Err: err}
@@ -997,6 +1009,73 @@ func (tnet *Net) DialContext(ctx context.Context, network, address string) (net.
 	if len(addrs) == 0 && len(allAddr) != 0 {
 		return nil, &net.OpError{Op: "dial", Err: errNoSuitableAddress}
 	}
+	return tnet.dialAddrs(ctx, matches[1], addrs)
+}
+
+// DialContextAddrPorts connects to the first of addrs that answers, the way
+// DialContext does with the addresses a name resolves to. Addresses of
+// families that network, the tunnel or the address preference exclude are
+// skipped, the others are tried in the order of the preference.
+func (tnet *Net) DialContextAddrPorts(ctx context.Context, network string, addrs []netip.AddrPort) (net.Conn, error) {
+	matches, acceptV4, acceptV6, err := tnet.splitNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+	lookupV4, lookupV6 := tnet.lookupFamilies()
+	acceptV4, acceptV6 = acceptV4 && lookupV4, acceptV6 && lookupV6
+
+	var accepted []netip.AddrPort
+	for _, addr := range addrs {
+		addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+		if (addr.Addr().Is4() && acceptV4) || (addr.Addr().Is6() && acceptV6) {
+			accepted = append(accepted, addr)
+		}
+	}
+	if len(accepted) == 0 && len(addrs) != 0 {
+		return nil, &net.OpError{Op: "dial", Err: errNoSuitableAddress}
+	}
+	preferV6 := tnet.preferV6()
+	slices.SortStableFunc(accepted, func(a, b netip.AddrPort) int {
+		// the preferred family sorts first
+		rank := func(addr netip.AddrPort) int {
+			if addr.Addr().Is6() == preferV6 {
+				return 0
+			}
+			return 1
+		}
+		return cmp.Compare(rank(a), rank(b))
+	})
+	return tnet.dialAddrs(ctx, matches[1], accepted)
+}
+
+// splitNetwork splits network into the submatches of protoSplitter and
+// reports the address families it accepts under the address preference
+func (tnet *Net) splitNetwork(network string) (matches []string, acceptV4, acceptV6 bool, err error) {
+	matches = protoSplitter.FindStringSubmatch(network)
+	if matches == nil {
+		return nil, false, false, &net.OpError{Op: "dial", Err: net.UnknownNetworkError(network)}
+	} else if len(matches[2]) == 0 {
+		acceptV4 = true
+		acceptV6 = true
+	} else {
+		acceptV4 = matches[2][0] == '4'
+		acceptV6 = !acceptV4
+	}
+	switch tnet.AddressPreference() {
+	case IPv4Only:
+		acceptV6 = false
+	case IPv6Only:
+		acceptV4 = false
+	}
+	return matches, acceptV4, acceptV6, nil
+}
+
+// dialAddrs connects to the first of addrs that answers over proto, TCP
+// attempts race each other
+func (tnet *Net) dialAddrs(ctx context.Context, proto string, addrs []netip.AddrPort) (net.Conn, error) {
+	if proto == "tcp" && len(addrs) > 0 {
+		return tnet.dialTCPRace(ctx, addrs)
+	}
 
 	var firstErr error
 	for i, addr := range addrs {
@@ -1029,7 +1108,8 @@ func (tnet *Net) DialContext(ctx context.Context, network, address string) (net.
 		}
 
 		var c net.Conn
-		switch matches[1] {
+		var err error
+		switch proto {
 		case "tcp":
 			c, err = tnet.DialContextTCPAddrPort(dialCtx, addr)
 		case "udp":
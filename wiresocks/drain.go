@@ -0,0 +1,129 @@
+package wiresocks
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// Drainer collects the listeners, relayed connections and UDP sessions of
+// the tunnels and outbounds sharing it, so a shutdown can stop accepting
+// clients and let the transfers in flight finish. A nil Drainer tracks
+// nothing.
+type Drainer struct {
+	mu        sync.Mutex
+	draining  bool
+	listeners []io.Closer
+	conns     map[uint64]func()
+	next      uint64
+	// idle is closed once no connection is left while draining
+	idle chan struct{}
+}
+
+// NewDrainer returns a Drainer tracking nothing yet
+func NewDrainer() *Drainer {
+	return &Drainer{conns: make(map[uint64]func()), idle: make(chan struct{})}
+}
+
+// addListener registers ln to be closed when draining starts, it is closed
+// right away when draining already started
+func (d *Drainer) addListener(ln io.Closer) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	if !d.draining {
+		d.listeners = append(d.listeners, ln)
+		d.mu.Unlock()
+		return
+	}
+	d.mu.Unlock()
+	_ = ln.Close()
+}
+
+// closerFunc adapts a function to io.Closer, for listeners that stop taking
+// new clients without closing a socket
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
+
+// track registers a relayed connection that closeConn cuts, the returned
+// function removes it again once the relay ended
+func (d *Drainer) track(closeConn func()) func() {
+	if d == nil {
+		return func() {}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	id := d.next
+	d.next++
+	d.conns[id] = closeConn
+
+	return func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		delete(d.conns, id)
+		if d.draining && len(d.conns) == 0 {
+			d.closeIdle()
+		}
+	}
+}
+
+// closeIdle closes idle once, d.mu must be held
+func (d *Drainer) closeIdle() {
+	select {
+	case <-d.idle:
+	default:
+		close(d.idle)
+	}
+}
+
+// Active returns the number of relayed connections and UDP sessions
+func (d *Drainer) Active() int {
+	if d == nil {
+		return 0
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.conns)
+}
+
+// Drain closes the listeners and waits until the relayed connections ended
+// or ctx is done, then cuts the connections still active. It returns how many
+// had to be cut.
+func (d *Drainer) Drain(ctx context.Context) int {
+	if d == nil {
+		return 0
+	}
+	d.mu.Lock()
+	d.draining = true
+	listeners := d.listeners
+	d.listeners = nil
+	if len(d.conns) == 0 {
+		d.closeIdle()
+	}
+	d.mu.Unlock()
+
+	for _, ln := range listeners {
+		_ = ln.Close()
+	}
+
+	select {
+	case <-d.idle:
+		return 0
+	case <-ctx.Done():
+	}
+
+	d.mu.Lock()
+	cut := make([]func(), 0, len(d.conns))
+	for _, closeConn := range d.conns {
+		cut = append(cut, closeConn)
+	}
+	d.mu.Unlock()
+	for _, closeConn := range cut {
+		closeConn()
+	}
+	return len(cut)
+}
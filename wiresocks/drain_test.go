@@ -0,0 +1,156 @@
+package wiresocks
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/things-go/go-socks5/bufferpool"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+)
+
+// drainedRelay relays between two loopback connections tracked by d and
+// returns the far ends and a channel closed once the relay returned
+func drainedRelay(t *testing.T, d *Drainer) (*net.TCPConn, *net.TCPConn, <-chan struct{}) {
+	user, client := tcpPair(t)
+	conn, dest := tcpPair(t)
+	active := d.Active()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		relay(slog.Default(), bufferpool.NewPool(32*1024), d, Timeouts{}, client, conn)
+	}()
+	for _, c := range []net.Conn{user, dest} {
+		_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	}
+	// the relay is tracked once it runs
+	for d.Active() == active {
+		time.Sleep(time.Millisecond)
+	}
+	return user, dest, done
+}
+
+// drain runs d.Drain with grace in the background and returns its result
+func drain(d *Drainer, grace time.Duration) <-chan int {
+	cut := make(chan int, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), grace)
+		defer cancel()
+		cut <- d.Drain(ctx)
+	}()
+	return cut
+}
+
+func TestDrainGrace(t *testing.T) {
+	d := NewDrainer()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	qt.Assert(t, err, qt.IsNil)
+	d.addListener(ln)
+	user, dest, done := drainedRelay(t, d)
+
+	cut := drain(d, 5*time.Second)
+
+	// new clients are refused right away
+	_, err = ln.Accept()
+	qt.Assert(t, err, qt.ErrorIs, net.ErrClosed)
+
+	// while the transfer in flight goes on
+	_, err = user.Write([]byte("request"))
+	qt.Assert(t, err, qt.IsNil)
+	buf := make([]byte, 7)
+	_, err = io.ReadFull(dest, buf)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, string(buf), qt.Equals, "request")
+
+	_ = user.CloseWrite()
+	_ = dest.CloseWrite()
+	waitRelay(t, done)
+	select {
+	case n := <-cut:
+		qt.Assert(t, n, qt.Equals, 0)
+	case <-time.After(5 * time.Second):
+		t.Fatal("drain did not end with the last connection")
+	}
+	qt.Assert(t, d.Active(), qt.Equals, 0)
+
+	// listeners registered while draining are closed right away
+	late, err := net.Listen("tcp", "127.0.0.1:0")
+	qt.Assert(t, err, qt.IsNil)
+	d.addListener(late)
+	_, err = late.Accept()
+	qt.Assert(t, err, qt.ErrorIs, net.ErrClosed)
+}
+
+func TestDrainForcedClose(t *testing.T) {
+	d := NewDrainer()
+	user, dest, done := drainedRelay(t, d)
+
+	start := time.Now()
+	n := <-drain(d, 50*time.Millisecond)
+	qt.Assert(t, n, qt.Equals, 1)
+	qt.Assert(t, time.Since(start) >= 50*time.Millisecond, qt.IsTrue)
+
+	// both ends see the connection go away
+	waitRelay(t, done)
+	for _, c := range []net.Conn{user, dest} {
+		_, err := c.Read(make([]byte, 1))
+		qt.Assert(t, err, qt.Not(qt.IsNil))
+	}
+}
+
+func TestDrainZeroGrace(t *testing.T) {
+	d := NewDrainer()
+	_, _, done := drainedRelay(t, d)
+	_, _, done2 := drainedRelay(t, d)
+
+	select {
+	case n := <-drain(d, 0):
+		qt.Assert(t, n, qt.Equals, 2)
+	case <-time.After(time.Second):
+		t.Fatal("drain without grace waited")
+	}
+	waitRelay(t, done)
+	waitRelay(t, done2)
+
+	// nothing to cut
+	qt.Assert(t, <-drain(NewDrainer(), 0), qt.Equals, 0)
+}
+
+func TestNilDrainer(t *testing.T) {
+	var d *Drainer
+	d.addListener(io.NopCloser(nil))
+	d.track(func() {})()
+	qt.Assert(t, d.Active(), qt.Equals, 0)
+	qt.Assert(t, d.Drain(context.Background()), qt.Equals, 0)
+}
+
+func TestDrainUDPAssociation(t *testing.T) {
+	d := NewDrainer()
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	qt.Assert(t, err, qt.IsNil)
+	defer client.Close()
+	relay := &statute.UDPRelay{
+		Client:       client,
+		ListenPacket: func(network string) (net.PacketConn, error) { return net.ListenPacket(network, "127.0.0.1:0") },
+		Logger:       slog.Default(),
+	}
+	done := make(chan error, 1)
+	go func() { done <- serveUDP(context.Background(), relay, d, Timeouts{Idle: time.Minute}) }()
+	for d.Active() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// an association has no end of its own, so it is cut
+	qt.Assert(t, <-drain(d, 0), qt.Equals, 1)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("association was not cut")
+	}
+	qt.Assert(t, d.Active(), qt.Equals, 0)
+}
@@ -0,0 +1,122 @@
+package wiresocks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+const (
+	// minAcceptDelay and maxAcceptDelay bound the backoff after failed accepts
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+// Forward is a static port forward from a local address to a destination
+// reached through the tunnel
+type Forward struct {
+	// Network is "tcp" or "udp"
+	Network string
+	// Local is the address to listen on
+	Local netip.AddrPort
+	// Remote is the host:port to connect to, host names are resolved with
+	// the DNS servers of the tunnel
+	Remote string
+}
+
+func (f Forward) String() string {
+	return fmt.Sprintf("%s/%s=%s", f.Network, f.Local, f.Remote)
+}
+
+// ParseForward parses a forward in the form [tcp/|udp/]local=remote, for
+// example "127.0.0.1:5432=db.example:5432" or "udp/127.0.0.1:53=1.1.1.1:53"
+func ParseForward(s string) (Forward, error) {
+	f := Forward{Network: "tcp"}
+	if network, rest, ok := strings.Cut(s, "/"); ok && (network == "tcp" || network == "udp") {
+		f.Network, s = network, rest
+	}
+
+	local, remote, ok := strings.Cut(s, "=")
+	if !ok {
+		return Forward{}, fmt.Errorf("invalid forward %q, expected local=remote", s)
+	}
+	var err error
+	if f.Local, err = netip.ParseAddrPort(local); err != nil {
+		return Forward{}, fmt.Errorf("invalid forward listen address: %w", err)
+	}
+	if _, _, err := net.SplitHostPort(remote); err != nil {
+		return Forward{}, fmt.Errorf("invalid forward destination: %w", err)
+	}
+	f.Remote = remote
+	return f, nil
+}
+
+// StartForward listens on the local address of f and relays every client
+// to the remote destination through the tunnel
+func (vt *VirtualTun) StartForward(f Forward) (netip.AddrPort, error) {
+	switch f.Network {
+	case "tcp":
+		ln, err := net.Listen("tcp", f.Local.String())
+		if err != nil {
+			return netip.AddrPort{}, err
+		}
+		go func() {
+			<-vt.Ctx.Done()
+			_ = ln.Close()
+		}()
+		vt.Drainer.addListener(ln)
+		go vt.serveTCPForward(ln, f.Remote)
+		return ln.Addr().(*net.TCPAddr).AddrPort(), nil
+	case "udp":
+		conn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(f.Local))
+		if err != nil {
+			return netip.AddrPort{}, err
+		}
+		fw := newUDPForwarder(vt, conn, f.Remote, maxDatagramSize, vt.Timeouts.udp(), vt.Drainer)
+		go fw.serve(vt.Ctx)
+		return fw.LocalAddr(), nil
+	default:
+		return netip.AddrPort{}, fmt.Errorf("unsupported forward network %q", f.Network)
+	}
+}
+
+func (vt *VirtualTun) serveTCPForward(ln net.Listener, remote string) {
+	var acceptDelay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			// back off so running out of file descriptors does not spin
+			if acceptDelay == 0 {
+				acceptDelay = minAcceptDelay
+			} else {
+				acceptDelay = min(2*acceptDelay, maxAcceptDelay)
+			}
+			vt.Logger.Error("failed to accept forward connection", "error", err, "retry", acceptDelay)
+			select {
+			case <-time.After(acceptDelay):
+			case <-vt.Ctx.Done():
+				return
+			}
+			continue
+		}
+		acceptDelay = 0
+
+		go func() {
+			vt.Logger.Info("handling forward", "protocol", "tcp", "destination", remote)
+			rconn, err := vt.dial(vt.Ctx, "tcp", remote)
+			if err != nil {
+				vt.Logger.Error("failed to dial forward destination", "destination", remote, "error", err)
+				_ = conn.Close()
+				return
+			}
+			vt.relay(conn, rconn)
+		}()
+	}
+}
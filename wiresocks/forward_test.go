@@ -0,0 +1,87 @@
+package wiresocks
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestParseForward(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Forward
+		err  string
+	}{
+		{in: "127.0.0.1:5432=db.example:5432", want: Forward{Network: "tcp", Local: netip.MustParseAddrPort("127.0.0.1:5432"), Remote: "db.example:5432"}},
+		{in: "tcp/[::1]:8080=10.0.0.2:80", want: Forward{Network: "tcp", Local: netip.MustParseAddrPort("[::1]:8080"), Remote: "10.0.0.2:80"}},
+		{in: "udp/127.0.0.1:53=1.1.1.1:53", want: Forward{Network: "udp", Local: netip.MustParseAddrPort("127.0.0.1:53"), Remote: "1.1.1.1:53"}},
+		{in: "udp/127.0.0.1:53=[2606:4700::1111]:53", want: Forward{Network: "udp", Local: netip.MustParseAddrPort("127.0.0.1:53"), Remote: "[2606:4700::1111]:53"}},
+		{in: "sctp/127.0.0.1:53=1.1.1.1:53", err: "invalid forward listen address: .*"},
+		{in: "127.0.0.1:5432", err: `invalid forward "127.0.0.1:5432", expected local=remote`},
+		{in: "localhost:5432=db.example:5432", err: "invalid forward listen address: .*"},
+		{in: "127.0.0.1:5432=db.example", err: "invalid forward destination: .*"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			f, err := ParseForward(test.in)
+			if test.err != "" {
+				qt.Assert(t, err, qt.ErrorMatches, test.err)
+				return
+			}
+			qt.Assert(t, err, qt.IsNil)
+			qt.Assert(t, f, qt.Equals, test.want)
+
+			// String gives back an equivalent forward
+			again, err := ParseForward(f.String())
+			qt.Assert(t, err, qt.IsNil)
+			qt.Assert(t, again, qt.Equals, f)
+		})
+	}
+}
+
+func TestTCPForward(t *testing.T) {
+	vt, remote := testTunnel(t)
+
+	// the destination echoes what it reads until the client half-closes
+	ln, err := remote.ListenTCPAddrPort(netip.AddrPortFrom(remoteAddr, 80))
+	qt.Assert(t, err, qt.IsNil)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	local, err := vt.StartForward(Forward{
+		Network: "tcp",
+		Local:   netip.MustParseAddrPort("127.0.0.1:0"),
+		Remote:  netip.AddrPortFrom(remoteAddr, 80).String(),
+	})
+	qt.Assert(t, err, qt.IsNil)
+
+	for range 2 {
+		conn, err := net.Dial("tcp", local.String())
+		qt.Assert(t, err, qt.IsNil)
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		_, err = conn.Write([]byte("through the tunnel"))
+		qt.Assert(t, err, qt.IsNil)
+		qt.Assert(t, conn.(*net.TCPConn).CloseWrite(), qt.IsNil)
+		got, err := io.ReadAll(conn)
+		qt.Assert(t, err, qt.IsNil)
+		qt.Assert(t, string(got), qt.Equals, "through the tunnel")
+		_ = conn.Close()
+	}
+}
@@ -0,0 +1,149 @@
+package wiresocks
+
+import (
+	"bufio"
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bepass-org/warp-plus/wireguard/device"
+)
+
+// healthInterval is how often the WireGuard sessions are inspected
+const healthInterval = time.Second
+
+// DefaultDownAfter is how old the last handshake may get before the tunnel
+// counts as down. With keepalives a peer renews its session every
+// device.RekeyAfterTime and a working endpoint answers the first attempts, so
+// the tunnel is known to be down long before device.RejectAfterTime rejects
+// the session.
+const DefaultDownAfter = device.RekeyAfterTime + 5*device.RekeyTimeout
+
+// health tracks whether the tunnel has a usable WireGuard session
+type health struct {
+	mu sync.Mutex
+	up bool
+	// changed is closed and replaced whenever up flips
+	changed chan struct{}
+	// downAfter is the handshake age at which the tunnel counts as down
+	downAfter time.Duration
+}
+
+func newHealth() *health {
+	return &health{changed: make(chan struct{}), downAfter: DefaultDownAfter}
+}
+
+// SetDownAfter sets how old the last handshake may get before the tunnel
+// counts as down, zero or less restores DefaultDownAfter. Keep it above
+// device.RekeyAfterTime, a working tunnel does not handshake more often.
+func (vt *VirtualTun) SetDownAfter(d time.Duration) {
+	if vt.health == nil {
+		return
+	}
+	if d <= 0 {
+		d = DefaultDownAfter
+	}
+	vt.health.mu.Lock()
+	defer vt.health.mu.Unlock()
+	vt.health.downAfter = d
+}
+
+// monitorHealth follows the handshakes of vt's peers until vt.Ctx is done
+func (vt *VirtualTun) monitorHealth() {
+	ticker := time.NewTicker(healthInterval)
+	defer ticker.Stop()
+
+	for {
+		last, err := lastHandshake(vt.Dev)
+		if err != nil {
+			vt.Logger.Debug("failed to read wireguard state", "error", err)
+		}
+		vt.checkHealth(last, err)
+
+		select {
+		case <-vt.Ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkHealth updates the state of the tunnel from the time of the last
+// handshake of any peer and the error reading it. The tunnel is up while
+// that handshake is younger than the downAfter threshold.
+func (vt *VirtualTun) checkHealth(last time.Time, err error) {
+	vt.health.mu.Lock()
+	defer vt.health.mu.Unlock()
+
+	up := err == nil && !last.IsZero() && time.Since(last) < vt.health.downAfter
+	if up == vt.health.up {
+		return
+	}
+	vt.health.up = up
+	close(vt.health.changed)
+	vt.health.changed = make(chan struct{})
+	if up {
+		vt.Logger.Info("tunnel is up")
+	} else {
+		vt.Logger.Warn("tunnel is down", "last_handshake", last)
+	}
+}
+
+// Up reports whether the tunnel currently has a WireGuard session. A tunnel
+// without a device, such as one built for tests, is always up.
+func (vt *VirtualTun) Up() bool {
+	if vt.health == nil {
+		return true
+	}
+	vt.health.mu.Lock()
+	defer vt.health.mu.Unlock()
+	return vt.health.up
+}
+
+// WaitUp blocks until the tunnel is up or ctx is done
+func (vt *VirtualTun) WaitUp(ctx context.Context) error {
+	if vt.health == nil {
+		return nil
+	}
+	for {
+		vt.health.mu.Lock()
+		up, changed := vt.health.up, vt.health.changed
+		vt.health.mu.Unlock()
+		if up {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// lastHandshake returns the most recent handshake of any peer of dev
+func lastHandshake(dev *device.Device) (time.Time, error) {
+	state, err := dev.IpcGet()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var last time.Time
+	var sec, nsec int64
+	scanner := bufio.NewScanner(strings.NewReader(state))
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), "=")
+		switch key {
+		case "last_handshake_time_sec":
+			sec, _ = strconv.ParseInt(value, 10, 64)
+		case "last_handshake_time_nsec":
+			nsec, _ = strconv.ParseInt(value, 10, 64)
+			if t := time.Unix(sec, nsec); (sec != 0 || nsec != 0) && t.After(last) {
+				last = t
+			}
+		}
+	}
+	return last, scanner.Err()
+}
@@ -0,0 +1,59 @@
+package wiresocks
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestHealthDown(t *testing.T) {
+	vt := downTunnel()
+	vt.SetDownAfter(time.Minute)
+
+	vt.checkHealth(time.Now(), nil)
+	qt.Assert(t, vt.Up(), qt.IsTrue)
+	qt.Assert(t, vt.WaitUp(context.Background()), qt.IsNil)
+
+	// a session old enough for a renewal that never came is down, long
+	// before wireguard rejects it
+	vt.health.mu.Lock()
+	changed := vt.health.changed
+	vt.health.mu.Unlock()
+	vt.checkHealth(time.Now().Add(-time.Minute-time.Second), nil)
+	qt.Assert(t, vt.Up(), qt.IsFalse)
+	select {
+	case <-changed:
+	default:
+		t.Fatal("going down was not announced")
+	}
+
+	// a new handshake brings it back
+	vt.checkHealth(time.Now().Add(-30*time.Second), nil)
+	qt.Assert(t, vt.Up(), qt.IsTrue)
+
+	// failing to read the state and never having had a handshake are down
+	vt.checkHealth(time.Now(), errors.New("device closed"))
+	qt.Assert(t, vt.Up(), qt.IsFalse)
+	vt.checkHealth(time.Now(), nil)
+	vt.checkHealth(time.Time{}, nil)
+	qt.Assert(t, vt.Up(), qt.IsFalse)
+}
+
+func TestSetDownAfter(t *testing.T) {
+	vt := downTunnel()
+	qt.Assert(t, vt.health.downAfter, qt.Equals, DefaultDownAfter)
+	vt.SetDownAfter(10 * time.Second)
+	vt.checkHealth(time.Now().Add(-15*time.Second), nil)
+	qt.Assert(t, vt.Up(), qt.IsFalse)
+
+	vt.SetDownAfter(0)
+	qt.Assert(t, vt.health.downAfter, qt.Equals, DefaultDownAfter)
+	vt.checkHealth(time.Now().Add(-15*time.Second), nil)
+	qt.Assert(t, vt.Up(), qt.IsTrue)
+
+	// a tunnel without health ignores it
+	(&VirtualTun{}).SetDownAfter(time.Second)
+}
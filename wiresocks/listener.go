@@ -0,0 +1,114 @@
+package wiresocks
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+)
+
+// ProxyListener is one address the inbound proxy accepts clients on
+type ProxyListener struct {
+	// Network is "tcp" or "unix"
+	Network string
+	// Address is a host:port for tcp and a socket path for unix
+	Address string
+	// Mode sets the permissions of a unix socket, zero keeps the umask
+	Mode os.FileMode
+	// Protocols restricts the listener to some of statute.ProtocolSOCKS5,
+	// statute.ProtocolSOCKS4 and statute.ProtocolHTTP, empty serves all
+	Protocols []string
+}
+
+// TCPListener serves every protocol on the tcp address bind
+func TCPListener(bind netip.AddrPort) ProxyListener {
+	return ProxyListener{Network: "tcp", Address: bind.String()}
+}
+
+// ParseProxyListener parses "[protocols@]address" where protocols is a comma
+// separated list of socks5, socks4, socks (both) and http, and address is
+// either host:port or unix:path[:mode] with an octal file mode.
+func ParseProxyListener(s string) (ProxyListener, error) {
+	var l ProxyListener
+	if protocols, address, ok := strings.Cut(s, "@"); ok {
+		for _, protocol := range strings.Split(protocols, ",") {
+			switch protocol {
+			case "socks":
+				l.Protocols = append(l.Protocols, statute.ProtocolSOCKS5, statute.ProtocolSOCKS4)
+			case statute.ProtocolSOCKS5, statute.ProtocolSOCKS4, statute.ProtocolHTTP:
+				l.Protocols = append(l.Protocols, protocol)
+			default:
+				return ProxyListener{}, fmt.Errorf("unknown protocol %q in listener %q", protocol, s)
+			}
+		}
+		s = address
+	}
+
+	if path, ok := strings.CutPrefix(s, "unix:"); ok {
+		l.Network = "unix"
+		if i := strings.LastIndexByte(path, ':'); i >= 0 {
+			mode, err := strconv.ParseUint(path[i+1:], 8, 32)
+			if err != nil || mode > 0o777 {
+				return ProxyListener{}, fmt.Errorf("invalid socket mode %q", path[i+1:])
+			}
+			l.Mode, path = os.FileMode(mode), path[:i]
+		}
+		if path == "" {
+			return ProxyListener{}, errors.New("missing unix socket path")
+		}
+		l.Address = path
+		return l, nil
+	}
+
+	bind, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return ProxyListener{}, fmt.Errorf("invalid listen address %q: %w", s, err)
+	}
+	l.Network, l.Address = "tcp", bind.String()
+	return l, nil
+}
+
+// String formats l the way ParseProxyListener reads it
+func (l ProxyListener) String() string {
+	s := l.Address
+	if l.Network == "unix" {
+		s = "unix:" + s
+		if l.Mode != 0 {
+			s += fmt.Sprintf(":%o", l.Mode)
+		}
+	}
+	if len(l.Protocols) > 0 {
+		s = strings.Join(l.Protocols, ",") + "@" + s
+	}
+	return s
+}
+
+// listen opens l. A socket left behind by an earlier run is replaced.
+func (l ProxyListener) listen() (net.Listener, error) {
+	if l.Network != "unix" {
+		return net.Listen(l.Network, l.Address)
+	}
+
+	if info, err := os.Lstat(l.Address); err == nil && info.Mode().Type() == fs.ModeSocket {
+		if err := os.Remove(l.Address); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", l.Address)
+	if err != nil {
+		return nil, err
+	}
+	if l.Mode != 0 {
+		if err := os.Chmod(l.Address, l.Mode); err != nil {
+			_ = ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
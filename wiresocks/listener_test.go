@@ -0,0 +1,59 @@
+package wiresocks
+
+import (
+	"os"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+)
+
+func TestParseProxyListener(t *testing.T) {
+	tests := []struct {
+		in   string
+		want ProxyListener
+		err  string
+	}{
+		{in: "127.0.0.1:8086", want: ProxyListener{Network: "tcp", Address: "127.0.0.1:8086"}},
+		{in: "[::1]:8086", want: ProxyListener{Network: "tcp", Address: "[::1]:8086"}},
+		{in: "http@0.0.0.0:8080", want: ProxyListener{Network: "tcp", Address: "0.0.0.0:8080", Protocols: []string{statute.ProtocolHTTP}}},
+		{in: "socks@127.0.0.1:1080", want: ProxyListener{Network: "tcp", Address: "127.0.0.1:1080", Protocols: []string{statute.ProtocolSOCKS5, statute.ProtocolSOCKS4}}},
+		{in: "socks5,http@127.0.0.1:1080", want: ProxyListener{Network: "tcp", Address: "127.0.0.1:1080", Protocols: []string{statute.ProtocolSOCKS5, statute.ProtocolHTTP}}},
+		{in: "unix:/run/warp.sock", want: ProxyListener{Network: "unix", Address: "/run/warp.sock"}},
+		{in: "unix:/run/warp.sock:660", want: ProxyListener{Network: "unix", Address: "/run/warp.sock", Mode: 0o660}},
+		{in: "socks4@unix:relative.sock:0600", want: ProxyListener{Network: "unix", Address: "relative.sock", Mode: 0o600, Protocols: []string{statute.ProtocolSOCKS4}}},
+		{in: "ftp@127.0.0.1:21", err: `unknown protocol "ftp" in listener "ftp@127.0.0.1:21"`},
+		{in: "@127.0.0.1:8086", err: `unknown protocol "" in listener "@127.0.0.1:8086"`},
+		{in: "http,@127.0.0.1:8086", err: `unknown protocol "" in listener "http,@127.0.0.1:8086"`},
+		{in: "unix:", err: "missing unix socket path"},
+		{in: "unix::660", err: "missing unix socket path"},
+		{in: "unix:/run/warp.sock:rw", err: `invalid socket mode "rw"`},
+		{in: "unix:/run/warp.sock:1777", err: `invalid socket mode "1777"`},
+		{in: "localhost:8086", err: `invalid listen address "localhost:8086": .*`},
+		{in: "127.0.0.1", err: `invalid listen address "127.0.0.1": .*`},
+		{in: "", err: `invalid listen address "": .*`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			l, err := ParseProxyListener(test.in)
+			if test.err != "" {
+				qt.Assert(t, err, qt.ErrorMatches, test.err)
+				return
+			}
+			qt.Assert(t, err, qt.IsNil)
+			qt.Assert(t, l, qt.DeepEquals, test.want)
+
+			// String gives back an equivalent listener
+			again, err := ParseProxyListener(l.String())
+			qt.Assert(t, err, qt.IsNil)
+			qt.Assert(t, again, qt.DeepEquals, l)
+		})
+	}
+}
+
+func TestProxyListenerString(t *testing.T) {
+	l := ProxyListener{Network: "unix", Address: "/run/warp.sock", Mode: os.FileMode(0o660), Protocols: []string{statute.ProtocolHTTP}}
+	qt.Assert(t, l.String(), qt.Equals, "http@unix:/run/warp.sock:660")
+}
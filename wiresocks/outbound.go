@@ -0,0 +1,101 @@
+package wiresocks
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+	"github.com/things-go/go-socks5/bufferpool"
+	"golang.org/x/net/proxy"
+)
+
+var errUDPUnsupported = errors.New("outbound does not support udp")
+
+// Outbound carries the proxy requests routed to it to their destination
+type Outbound interface {
+	Handle(req *statute.ProxyRequest) error
+}
+
+// Handle relays req through the tunnel, so a VirtualTun can serve as the
+// Outbound of other users
+func (vt *VirtualTun) Handle(req *statute.ProxyRequest) error {
+	return vt.generalHandler(req, vt.Drainer)
+}
+
+// DialOutbound relays requests through a dialer outside of the tunnel, either
+// directly or through an upstream proxy
+type DialOutbound struct {
+	Dial statute.ProxyDialFunc
+	// ListenPacket opens the sockets of UDP associations, nil refuses them
+	ListenPacket func(network string) (net.PacketConn, error)
+	Resolve      func(ctx context.Context, host string) (netip.Addr, error)
+	Logger       *slog.Logger
+	// Timeouts bounds the relayed connections, zero values use the defaults
+	Timeouts RelayTimeouts
+	// Drainer tracks the relayed connections and UDP associations for
+	// shutdown, nil skips that
+	Drainer *Drainer
+	pool    bufferpool.BufPool
+}
+
+// NewDirectOutbound connects to destinations from this host, bypassing the
+// tunnel
+func NewDirectOutbound(l *slog.Logger) *DialOutbound {
+	var dialer net.Dialer
+	return &DialOutbound{
+		Dial: dialer.DialContext,
+		ListenPacket: func(network string) (net.PacketConn, error) {
+			return net.ListenPacket(network, ":0")
+		},
+		Resolve: func(ctx context.Context, host string) (netip.Addr, error) {
+			addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+			if err != nil {
+				return netip.Addr{}, err
+			}
+			return addrs[0].Unmap(), nil
+		},
+		Logger: l,
+		pool:   bufferpool.NewPool(256 * 1024),
+	}
+}
+
+// NewSOCKS5Outbound connects to destinations through the SOCKS5 proxy at
+// address. Only TCP is supported.
+func NewSOCKS5Outbound(l *slog.Logger, address string) (*DialOutbound, error) {
+	dialer, err := proxy.SOCKS5("tcp", address, nil, proxy.Direct)
+	if err != nil {
+		return nil, err
+	}
+	return &DialOutbound{
+		Dial:   dialer.(proxy.ContextDialer).DialContext,
+		Logger: l,
+		pool:   bufferpool.NewPool(256 * 1024),
+	}, nil
+}
+
+func (o *DialOutbound) Handle(req *statute.ProxyRequest) error {
+	if client, ok := req.Conn.(net.PacketConn); ok && req.Network == "udp" {
+		if o.ListenPacket == nil {
+			return errUDPUnsupported
+		}
+		o.Logger.Info("handling udp association", "destination", req.Destination, "source", req.Source, "inbound", req.Protocol)
+		relay := &statute.UDPRelay{
+			Client:       client,
+			ListenPacket: o.ListenPacket,
+			Resolve:      o.Resolve,
+			Logger:       o.Logger,
+		}
+		return serveUDP(req.Context, relay, o.Drainer, o.Timeouts.udp())
+	}
+
+	o.Logger.Info("handling connection", "protocol", req.Network, "destination", req.Destination, "source", req.Source, "inbound", req.Protocol)
+	conn, err := o.Dial(req.Context, req.Network, req.Destination)
+	if err != nil {
+		return err
+	}
+	relay(o.Logger, o.pool, o.Drainer, o.Timeouts.tcp(), req.Conn, conn)
+	return nil
+}
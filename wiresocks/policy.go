@@ -0,0 +1,187 @@
+package wiresocks
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+)
+
+// actions of a DownPolicy
+const (
+	// DownFail refuses the request right away
+	DownFail = "fail"
+	// DownDirect connects without the tunnel
+	DownDirect = "direct"
+	// DownQueue holds the request until the tunnel is back, up to Wait
+	DownQueue = "queue"
+)
+
+// defaultQueueWait bounds a queue policy that names no duration
+const defaultQueueWait = 30 * time.Second
+
+// errTunnelDown wraps ENETUNREACH so proxies report an unreachable network
+var errTunnelDown = fmt.Errorf("tunnel is down: %w", syscall.ENETUNREACH)
+
+// DownPolicy decides what happens to requests for a class of destinations
+// while the tunnel has no WireGuard session
+type DownPolicy struct {
+	// Match is a domain suffix, an IP prefix or "*" for every destination
+	Match string
+	// Action is one of DownFail, DownDirect or DownQueue
+	Action string
+	// Wait is how long DownQueue holds a request
+	Wait time.Duration
+
+	prefix netip.Prefix
+}
+
+func (p DownPolicy) String() string {
+	if p.Action == DownQueue {
+		return fmt.Sprintf("%s=%s:%s", p.Match, p.Action, p.Wait)
+	}
+	return p.Match + "=" + p.Action
+}
+
+// ParseDownPolicy parses a policy in the form match=action, for example
+// "*=queue:10s", "10.0.0.0/8=fail" or "example.com=direct"
+func ParseDownPolicy(s string) (DownPolicy, error) {
+	match, action, ok := strings.Cut(s, "=")
+	if !ok || match == "" {
+		return DownPolicy{}, fmt.Errorf("invalid tunnel down policy %q, expected match=action", s)
+	}
+
+	p := DownPolicy{Match: strings.ToLower(strings.TrimPrefix(match, "*."))}
+	if addr, err := netip.ParseAddr(match); err == nil {
+		p.prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+	} else if prefix, err := netip.ParsePrefix(match); err == nil {
+		p.prefix = prefix.Masked()
+	}
+
+	action, wait, hasWait := strings.Cut(action, ":")
+	switch action {
+	case DownFail, DownDirect:
+		if hasWait {
+			return DownPolicy{}, fmt.Errorf("tunnel down action %q takes no duration", action)
+		}
+	case DownQueue:
+		p.Wait = defaultQueueWait
+		if hasWait {
+			d, err := time.ParseDuration(wait)
+			if err != nil {
+				return DownPolicy{}, fmt.Errorf("invalid queue duration: %w", err)
+			}
+			p.Wait = d
+		}
+	default:
+		return DownPolicy{}, fmt.Errorf("unknown tunnel down action %q", action)
+	}
+	p.Action = action
+	return p, nil
+}
+
+// matches reports whether the destination of req belongs to the class of p
+func (p DownPolicy) matches(req *statute.ProxyRequest) bool {
+	if p.Match == "*" {
+		return true
+	}
+	if addr, err := netip.ParseAddr(req.DestHost); err == nil {
+		return p.prefix.IsValid() && p.prefix.Contains(addr.Unmap())
+	}
+	host := strings.ToLower(strings.TrimSuffix(req.DestHost, "."))
+	return !p.prefix.IsValid() && (host == p.Match || strings.HasSuffix(host, "."+p.Match))
+}
+
+// admit applies the first matching policy to req while the tunnel is down.
+// It reports whether req has to bypass the tunnel. Without a matching
+// policy the request is sent into the tunnel as usual.
+func (vt *VirtualTun) admit(req *statute.ProxyRequest, policies []DownPolicy) (bool, error) {
+	if vt.Up() {
+		return false, nil
+	}
+
+	for _, p := range policies {
+		if !p.matches(req) {
+			continue
+		}
+		switch p.Action {
+		case DownDirect:
+			return true, nil
+		case DownQueue:
+			ctx, cancel := context.WithTimeout(req.Context, p.Wait)
+			defer cancel()
+			if err := vt.WaitUp(ctx); err != nil {
+				return false, errTunnelDown
+			}
+			return false, nil
+		default:
+			return false, errTunnelDown
+		}
+	}
+	return false, nil
+}
+
+// hasDirectPolicy reports whether any of policies can bypass the tunnel
+func hasDirectPolicy(policies []DownPolicy) bool {
+	for _, p := range policies {
+		if p.Action == DownDirect {
+			return true
+		}
+	}
+	return false
+}
+
+// admissionKey keys the decision of admit in the context of a request
+type admissionKey struct{}
+
+// downRouter relays requests through the tunnel, or around it when a policy
+// says so while the tunnel is down
+type downRouter struct {
+	vt       *VirtualTun
+	policies []DownPolicy
+	direct   Outbound
+	drainer  *Drainer
+}
+
+func (vt *VirtualTun) newDownRouter(policies []DownPolicy, d *Drainer) *downRouter {
+	r := &downRouter{vt: vt, policies: policies, drainer: d}
+	if hasDirectPolicy(policies) {
+		direct := NewDirectOutbound(vt.Logger.With("outbound", DownDirect))
+		direct.Timeouts = vt.Timeouts
+		direct.Drainer = d
+		r.direct = direct
+	}
+	return r
+}
+
+// check decides on req before the proxy answers the client, so a refused
+// request gets a proper error reply. The decision is kept on req for handle,
+// a queued request must not wait twice.
+func (r *downRouter) check(req *statute.ProxyRequest) error {
+	bypass, err := r.vt.admit(req, r.policies)
+	if err != nil {
+		return err
+	}
+	req.Context = context.WithValue(req.Context, admissionKey{}, bypass)
+	return nil
+}
+
+// handle relays req as decided by check. Requests that never pass a connect
+// check, UDP associations and Shadowsocks clients, are decided here.
+func (r *downRouter) handle(req *statute.ProxyRequest) error {
+	bypass, ok := req.Context.Value(admissionKey{}).(bool)
+	if !ok {
+		var err error
+		if bypass, err = r.vt.admit(req, r.policies); err != nil {
+			return err
+		}
+	}
+	if bypass {
+		return r.direct.Handle(req)
+	}
+	return r.vt.generalHandler(req, r.drainer)
+}
@@ -0,0 +1,148 @@
+package wiresocks
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/netip"
+	"syscall"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+)
+
+func TestParseDownPolicy(t *testing.T) {
+	tests := []struct {
+		in   string
+		want DownPolicy
+		err  string
+	}{
+		{in: "*=fail", want: DownPolicy{Match: "*", Action: DownFail}},
+		{in: "*=queue", want: DownPolicy{Match: "*", Action: DownQueue, Wait: defaultQueueWait}},
+		{in: "*=queue:10s", want: DownPolicy{Match: "*", Action: DownQueue, Wait: 10 * time.Second}},
+		{in: "Example.COM=direct", want: DownPolicy{Match: "example.com", Action: DownDirect}},
+		{in: "*.example.com=direct", want: DownPolicy{Match: "example.com", Action: DownDirect}},
+		{in: "10.1.2.3/8=fail", want: DownPolicy{Match: "10.1.2.3/8", Action: DownFail, prefix: netip.MustParsePrefix("10.0.0.0/8")}},
+		{in: "192.0.2.1=direct", want: DownPolicy{Match: "192.0.2.1", Action: DownDirect, prefix: netip.MustParsePrefix("192.0.2.1/32")}},
+		{in: "::ffff:192.0.2.1=direct", want: DownPolicy{Match: "::ffff:192.0.2.1", Action: DownDirect, prefix: netip.MustParsePrefix("192.0.2.1/32")}},
+		{in: "2001:db8::/32=queue:1m", want: DownPolicy{Match: "2001:db8::/32", Action: DownQueue, Wait: time.Minute, prefix: netip.MustParsePrefix("2001:db8::/32")}},
+		{in: "*", err: `invalid tunnel down policy "\*", expected match=action`},
+		{in: "=fail", err: `invalid tunnel down policy "=fail", expected match=action`},
+		{in: "*=", err: `unknown tunnel down action ""`},
+		{in: "*=drop", err: `unknown tunnel down action "drop"`},
+		{in: "*=fail:10s", err: `tunnel down action "fail" takes no duration`},
+		{in: "*=direct:10s", err: `tunnel down action "direct" takes no duration`},
+		{in: "*=queue:soon", err: `invalid queue duration: .*`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			p, err := ParseDownPolicy(test.in)
+			if test.err != "" {
+				qt.Assert(t, err, qt.ErrorMatches, test.err)
+				return
+			}
+			qt.Assert(t, err, qt.IsNil)
+			qt.Assert(t, p, qt.Equals, test.want)
+		})
+	}
+}
+
+func TestDownPolicyString(t *testing.T) {
+	for _, s := range []string{"*=fail", "example.com=direct", "10.0.0.0/8=queue:10s"} {
+		p, err := ParseDownPolicy(s)
+		qt.Assert(t, err, qt.IsNil)
+		qt.Assert(t, p.String(), qt.Equals, s)
+	}
+}
+
+func TestDownPolicyMatches(t *testing.T) {
+	tests := []struct {
+		policy string
+		host   string
+		want   bool
+	}{
+		{"*=fail", "example.com", true},
+		{"*=fail", "192.0.2.1", true},
+		{"example.com=fail", "example.com", true},
+		{"example.com=fail", "WWW.Example.com.", true},
+		{"example.com=fail", "badexample.com", false},
+		{"example.com=fail", "192.0.2.1", false},
+		{"10.0.0.0/8=fail", "10.1.2.3", true},
+		{"10.0.0.0/8=fail", "::ffff:10.1.2.3", true},
+		{"10.0.0.0/8=fail", "11.1.2.3", false},
+		{"10.0.0.0/8=fail", "10.example.com", false},
+		{"2001:db8::/32=fail", "2001:db8::1", true},
+		{"2001:db8::/32=fail", "2001:db9::1", false},
+	}
+
+	for _, test := range tests {
+		p, err := ParseDownPolicy(test.policy)
+		qt.Assert(t, err, qt.IsNil)
+		req := &statute.ProxyRequest{DestHost: test.host}
+		qt.Check(t, p.matches(req), qt.Equals, test.want, qt.Commentf("%s for %s", test.policy, test.host))
+	}
+}
+
+// downTunnel returns a tunnel whose health is down until the test sets it
+func downTunnel() *VirtualTun {
+	return &VirtualTun{Logger: slog.Default(), Ctx: context.Background(), health: newHealth()}
+}
+
+func TestDownRouterCheck(t *testing.T) {
+	policies := []DownPolicy{
+		{Match: "direct.example", Action: DownDirect},
+		{Match: "queue.example", Action: DownQueue, Wait: 20 * time.Millisecond},
+		{Match: "*", Action: DownFail},
+	}
+	vt := downTunnel()
+	r := vt.newDownRouter(policies, nil)
+	qt.Assert(t, r.direct, qt.Not(qt.IsNil))
+
+	tests := []struct {
+		host   string
+		bypass bool
+		err    error
+	}{
+		{"direct.example", true, nil},
+		{"queue.example", false, syscall.ENETUNREACH},
+		{"other.example", false, syscall.ENETUNREACH},
+	}
+	for _, test := range tests {
+		req := &statute.ProxyRequest{DestHost: test.host, Context: context.Background()}
+		err := r.check(req)
+		if test.err != nil {
+			qt.Check(t, errors.Is(err, test.err), qt.IsTrue, qt.Commentf("%s: %v", test.host, err))
+			continue
+		}
+		qt.Assert(t, err, qt.IsNil)
+		// the handler acts on this decision instead of deciding again
+		qt.Check(t, req.Context.Value(admissionKey{}), qt.Equals, test.bypass, qt.Commentf("%s", test.host))
+	}
+}
+
+func TestAdmitQueue(t *testing.T) {
+	policies := []DownPolicy{{Match: "*", Action: DownQueue, Wait: time.Minute}}
+	vt := downTunnel()
+
+	// a client hanging up stops the wait
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	_, err := vt.admit(&statute.ProxyRequest{DestHost: "example.com", Context: ctx}, policies)
+	qt.Assert(t, errors.Is(err, errTunnelDown), qt.IsTrue)
+
+	// the tunnel coming back releases the request into it
+	time.AfterFunc(10*time.Millisecond, func() {
+		vt.health.mu.Lock()
+		defer vt.health.mu.Unlock()
+		vt.health.up = true
+		close(vt.health.changed)
+		vt.health.changed = make(chan struct{})
+	})
+	bypass, err := vt.admit(&statute.ProxyRequest{DestHost: "example.com", Context: context.Background()}, policies)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, bypass, qt.IsFalse)
+}
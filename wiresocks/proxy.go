@@ -2,11 +2,14 @@ package wiresocks
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
-	"io"
+	"fmt"
 	"log/slog"
 	"net"
+	"net/http"
 	"net/netip"
+	"sync"
 	"time"
 
 	"github.com/bepass-org/warp-plus/proxy/pkg/mixed"
@@ -22,73 +25,204 @@ type VirtualTun struct {
 	Logger *slog.Logger
 	Dev    *device.Device
 	Ctx    context.Context
-	pool   bufferpool.BufPool
+	// Timeouts bounds the connections relayed through the tunnel, zero
+	// values use the defaults
+	Timeouts RelayTimeouts
+	// ResolvePolicies pick where destination names are looked up, the first
+	// match wins and names without a match are resolved inside the tunnel
+	ResolvePolicies []ResolvePolicy
+	// Drainer tracks the listeners and relayed connections of the tunnel
+	// for shutdown, nil skips that
+	Drainer *Drainer
+	pool    bufferpool.BufPool
+	health  *health
+
+	// fwMu guards the UDP forwarders running on the tunnel
+	fwMu       sync.Mutex
+	forwarders []*UDPForwarder
 }
 
-// StartProxy spawns a socks5 server.
-func (vt *VirtualTun) StartProxy(bindAddress netip.AddrPort) (netip.AddrPort, error) {
-	ln, err := net.Listen("tcp", bindAddress.String())
-	if err != nil {
-		return netip.AddrPort{}, err // Return error if binding was unsuccessful
+// ProxyOptions configures the inbound proxy spawned by StartProxy
+type ProxyOptions struct {
+	// Credentials maps user names to passwords. When non-empty every
+	// client has to authenticate.
+	Credentials map[string]string
+	// Allow lists the client networks that may connect, empty allows all
+	Allow []netip.Prefix
+	// Deny lists client networks that are always rejected
+	Deny []netip.Prefix
+	// MaxConnsPerClient caps concurrent connections per client address
+	MaxConnsPerClient int
+	// MaxConns caps concurrent connections of all clients together
+	MaxConns int
+	// HandshakeTimeout drops clients that stay silent after connecting, zero
+	// keeps the proxy default
+	HandshakeTimeout time.Duration
+	// PACBypass lists domains and networks the served PAC file sends directly
+	PACBypass []string
+	// Status serves the landing page shown when the proxy address is opened
+	// in a browser
+	Status http.Handler
+	// TLSConfig additionally accepts TLS wrapped clients when set
+	TLSConfig *tls.Config
+	// ProxyProtocol lists the balancers that announce the real client with a
+	// PROXY protocol header
+	ProxyProtocol []netip.Prefix
+	// Outbounds routes the requests of authenticated users by user name,
+	// everyone else goes through the tunnel
+	Outbounds map[string]Outbound
+	// DownPolicies decide by destination what happens to requests for the
+	// tunnel while it is down, the first match wins
+	DownPolicies []DownPolicy
+	// Ready rejects every client while it reports false, nil serves right
+	// away
+	Ready func() bool
+	// Internal marks a proxy used by this program itself, such as the
+	// upstream of psiphon. It is left out of draining, its connections end
+	// with the tunnel.
+	Internal bool
+}
+
+// StartProxy spawns a mixed proxy server on every listener and returns their
+// addresses in the same order.
+func (vt *VirtualTun) StartProxy(listeners []ProxyListener, opts ProxyOptions) ([]net.Addr, error) {
+	if len(listeners) == 0 {
+		return nil, errors.New("no proxy listeners")
+	}
+
+	lns := make([]net.Listener, 0, len(listeners))
+	for _, listener := range listeners {
+		ln, err := listener.listen()
+		if err != nil {
+			for _, ln := range lns {
+				_ = ln.Close()
+			}
+			return nil, err // Return error if binding was unsuccessful
+		}
+		lns = append(lns, ln)
 	}
 
-	proxy := mixed.NewProxy(
-		mixed.WithListener(ln),
+	drainer := vt.Drainer
+	if opts.Internal {
+		drainer = nil
+	}
+	for _, ln := range lns {
+		drainer.addListener(ln)
+	}
+
+	router := vt.newDownRouter(opts.DownPolicies, drainer)
+
+	options := []mixed.Option{
 		mixed.WithLogger(vt.Logger),
 		mixed.WithContext(vt.Ctx),
 		mixed.WithUserHandler(func(request *statute.ProxyRequest) error {
-			return vt.generalHandler(request)
+			if outbound, ok := opts.Outbounds[request.User]; ok {
+				return outbound.Handle(request)
+			}
+			return router.handle(request)
 		}),
-	)
-	go func() {
-		_ = proxy.ListenAndServe()
-	}()
+		mixed.WithUserBindHandler(vt.bindHandler),
+		mixed.WithUserListenFunc(vt.listen),
+	}
+	if len(opts.Credentials) > 0 {
+		options = append(options, mixed.WithCredentials(statute.StaticCredentials(opts.Credentials)))
+	}
+	if len(opts.Allow) > 0 || len(opts.Deny) > 0 || opts.MaxConnsPerClient > 0 {
+		options = append(options, mixed.WithAccessControl(mixed.AccessControl{
+			Allow:             opts.Allow,
+			Deny:              opts.Deny,
+			MaxConnsPerSource: opts.MaxConnsPerClient,
+		}))
+	}
+
+	if len(opts.DownPolicies) > 0 {
+		options = append(options, mixed.WithConnectCheck(func(request *statute.ProxyRequest) error {
+			if _, ok := opts.Outbounds[request.User]; ok {
+				return nil
+			}
+			return router.check(request)
+		}))
+	}
+	if opts.MaxConns > 0 {
+		options = append(options, mixed.WithMaxConnections(opts.MaxConns))
+	}
+	if opts.HandshakeTimeout > 0 {
+		options = append(options, mixed.WithHandshakeTimeout(opts.HandshakeTimeout))
+	}
+
+	if len(opts.ProxyProtocol) > 0 {
+		options = append(options, mixed.WithProxyProtocol(opts.ProxyProtocol))
+	}
+
+	if len(opts.PACBypass) > 0 {
+		options = append(options, mixed.WithPACBypass(opts.PACBypass))
+	}
+	if opts.Status != nil {
+		options = append(options, mixed.WithStatusHandler(opts.Status))
+	}
+	if opts.TLSConfig != nil {
+		options = append(options, mixed.WithTLSConfig(opts.TLSConfig))
+	}
+	if opts.Ready != nil {
+		options = append(options, mixed.WithReadyCheck(opts.Ready))
+	}
+
+	proxy := mixed.NewProxy(options...)
+	addrs := make([]net.Addr, len(lns))
+	for i, ln := range lns {
+		addrs[i] = ln.Addr()
+		go func() {
+			_ = proxy.Serve(ln, listeners[i].Protocols...)
+		}()
+	}
 	go func() {
 		<-vt.Ctx.Done()
+		// closing also removes unix sockets
+		for _, ln := range lns {
+			_ = ln.Close()
+		}
 		vt.Stop()
 	}()
 
-	return ln.Addr().(*net.TCPAddr).AddrPort(), nil
+	return addrs, nil
 }
 
-func (vt *VirtualTun) generalHandler(req *statute.ProxyRequest) error {
-	vt.Logger.Info("handling connection", "protocol", req.Network, "destination", req.Destination)
-	conn, err := vt.Tnet.Dial(req.Network, req.Destination)
-	if err != nil {
-		return err
+// generalHandler relays req through the tunnel, tracking it with d
+func (vt *VirtualTun) generalHandler(req *statute.ProxyRequest, d *Drainer) error {
+	if client, ok := req.Conn.(net.PacketConn); ok && req.Network == "udp" {
+		return vt.udpHandler(req, client, d)
 	}
-	// Close the connections when this function exits
-	defer conn.Close()
-	defer req.Conn.Close()
-	// Channel to notify when copy operation is done
-	done := make(chan error, 1)
-	// Copy data from req.Conn to conn
-	go func() {
-		req.Conn.SetReadDeadline(time.Now().Add(15 * time.Second))
-		buf1 := vt.pool.Get()
-		defer vt.pool.Put(buf1)
-		_, err := copyConnTimeout(conn, req.Conn, buf1[:cap(buf1)], 15*time.Second)
-		done <- err
-	}()
-	// Copy data from conn to req.Conn
-	go func() {
-		conn.SetReadDeadline(time.Now().Add(15 * time.Second))
-		buf2 := vt.pool.Get()
-		defer vt.pool.Put(buf2)
-		_, err := copyConnTimeout(req.Conn, conn, buf2[:cap(buf2)], 15*time.Second)
-		done <- err
-	}()
-	// Wait for one of the copy operations to finish
-	err = <-done
+
+	vt.Logger.Info("handling connection", "protocol", req.Network, "destination", req.Destination, "source", req.Source, "inbound", req.Protocol)
+	conn, err := vt.dial(req.Context, req.Network, req.Destination)
 	if err != nil {
-		vt.Logger.Warn(err.Error())
+		return err
 	}
+	relay(vt.Logger, vt.pool, d, vt.Timeouts.tcp(), req.Conn, conn)
+	return nil
+}
 
-	// Close connections and wait for the other copy operation to finish
-	<-done
+// bindHandler relays a connection accepted inside the tunnel for a socks5 BIND request
+func (vt *VirtualTun) bindHandler(req *statute.ProxyRequest, inbound net.Conn) error {
+	vt.Logger.Info("handling bind connection", "peer", req.Destination)
+	vt.relay(req.Conn, inbound)
 	return nil
 }
 
+// listen accepts BIND connections on the tunnel address of the requested family
+func (vt *VirtualTun) listen(_ context.Context, _, address string) (net.Listener, error) {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return nil, err
+	}
+	for _, local := range vt.Tnet.InterfaceAddrs() {
+		if local.Is4() == addrPort.Addr().Is4() {
+			return vt.Tnet.ListenTCPAddrPort(netip.AddrPortFrom(local, addrPort.Port()))
+		}
+	}
+	return nil, fmt.Errorf("no tunnel address to listen on for %s", address)
+}
+
 func (vt *VirtualTun) Stop() {
 	if vt.Dev != nil {
 		if err := vt.Dev.Down(); err != nil {
@@ -97,43 +231,10 @@ func (vt *VirtualTun) Stop() {
 	}
 }
 
-var errInvalidWrite = errors.New("invalid write result")
-
-func copyConnTimeout(dst net.Conn, src net.Conn, buf []byte, timeout time.Duration) (written int64, err error) {
-	if buf != nil && len(buf) == 0 {
-		panic("empty buffer in CopyBuffer")
-	}
-
-	for {
-		if err := src.SetReadDeadline(time.Now().Add(timeout)); err != nil {
-			return 0, err
-		}
-
-		nr, er := src.Read(buf)
-		if nr > 0 {
-			nw, ew := dst.Write(buf[0:nr])
-			if nw < 0 || nr < nw {
-				nw = 0
-				if ew == nil {
-					ew = errInvalidWrite
-				}
-			}
-			written += int64(nw)
-			if ew != nil {
-				err = ew
-				break
-			}
-			if nr != nw {
-				err = io.ErrShortWrite
-				break
-			}
-		}
-		if er != nil {
-			if er != io.EOF {
-				err = er
-			}
-			break
-		}
+// Close shuts the device down for good and releases its sockets. It returns
+// once the device stopped.
+func (vt *VirtualTun) Close() {
+	if vt.Dev != nil {
+		vt.Dev.Close()
 	}
-	return written, err
 }
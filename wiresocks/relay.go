@@ -0,0 +1,169 @@
+package wiresocks
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+	"github.com/things-go/go-socks5/bufferpool"
+)
+
+// DefaultTCPIdleTimeout closes relayed TCP connections that moved no data in
+// either direction for this long
+const DefaultTCPIdleTimeout = 10 * time.Minute
+
+// Timeouts bounds how long a relayed connection or UDP association lives
+type Timeouts struct {
+	// Idle closes it once no data moved in either direction for this long
+	Idle time.Duration
+	// MaxLifetime closes it this long after it started no matter the
+	// traffic, zero means no limit
+	MaxLifetime time.Duration
+}
+
+// RelayTimeouts holds the timeouts of each protocol, zero values fall back to
+// the defaults
+type RelayTimeouts struct {
+	TCP Timeouts
+	UDP Timeouts
+}
+
+// tcp returns the TCP timeouts with defaults applied
+func (t RelayTimeouts) tcp() Timeouts {
+	if t.TCP.Idle == 0 {
+		t.TCP.Idle = DefaultTCPIdleTimeout
+	}
+	return t.TCP
+}
+
+// udp returns the UDP timeouts with defaults applied
+func (t RelayTimeouts) udp() Timeouts {
+	if t.UDP.Idle == 0 {
+		t.UDP.Idle = statute.DefaultUDPIdleTimeout
+	}
+	return t.UDP
+}
+
+// WithDefaults returns t with the defaults applied to its zero values
+func (t RelayTimeouts) WithDefaults() RelayTimeouts {
+	return RelayTimeouts{TCP: t.tcp(), UDP: t.udp()}
+}
+
+// relay copies data between the client and the tunnel connection with the
+// TCP timeouts of vt
+func (vt *VirtualTun) relay(client, conn net.Conn) {
+	relay(vt.Logger, vt.pool, vt.Drainer, vt.Timeouts.tcp(), client, conn)
+}
+
+// relay copies data between client and conn. The end of one direction is
+// passed on with a half-close so the other direction keeps flowing, both
+// connections are closed once both directions ended, on the first error, or
+// when t expires. The relay is tracked by d while it runs.
+func relay(l *slog.Logger, pool bufferpool.BufPool, d *Drainer, t Timeouts, client, conn net.Conn) {
+	var once sync.Once
+	closeBoth := func() {
+		once.Do(func() {
+			_ = client.Close()
+			_ = conn.Close()
+		})
+	}
+	defer closeBoth()
+	defer d.track(closeBoth)()
+
+	var active atomic.Int64
+	active.Store(time.Now().UnixNano())
+
+	stop := make(chan struct{})
+	defer close(stop)
+	if t.Idle > 0 || t.MaxLifetime > 0 {
+		go watchRelay(l, t, &active, stop, closeBoth)
+	}
+
+	done := make(chan error, 2)
+	pipe := func(dst, src net.Conn) {
+		buf := pool.Get()
+		defer pool.Put(buf)
+		err := copyActive(dst, src, buf[:cap(buf)], &active)
+		if err == nil {
+			err = statute.CloseWrite(dst)
+		}
+		if err != nil {
+			// without a half-close the other direction can't finish cleanly
+			closeBoth()
+		}
+		done <- err
+	}
+	go pipe(conn, client)
+	go pipe(client, conn)
+
+	var first error
+	for range 2 {
+		if err := <-done; first == nil && err != nil && !errors.Is(err, net.ErrClosed) && !errors.Is(err, statute.ErrHalfCloseUnsupported) {
+			first = err
+		}
+	}
+	if first != nil {
+		l.Debug("relay ended", "error", first)
+	}
+}
+
+// watchRelay calls expire once the relay was inactive for t.Idle or lived for
+// t.MaxLifetime, whichever comes first, unless stop is closed before
+func watchRelay(l *slog.Logger, t Timeouts, active *atomic.Int64, stop <-chan struct{}, expire func()) {
+	var idle, lifetime <-chan time.Time
+	var idleTimer *time.Timer
+	if t.Idle > 0 {
+		idleTimer = time.NewTimer(t.Idle)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+	if t.MaxLifetime > 0 {
+		lifetimeTimer := time.NewTimer(t.MaxLifetime)
+		defer lifetimeTimer.Stop()
+		lifetime = lifetimeTimer.C
+	}
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-lifetime:
+			l.Debug("closing connection at its maximum lifetime", "lifetime", t.MaxLifetime)
+			expire()
+			return
+		case <-idle:
+			inactive := time.Since(time.Unix(0, active.Load()))
+			if inactive >= t.Idle {
+				l.Debug("closing idle connection", "timeout", t.Idle)
+				expire()
+				return
+			}
+			idleTimer.Reset(t.Idle - inactive)
+		}
+	}
+}
+
+// copyActive copies src to dst until src ends and records the time of every
+// read in active
+func copyActive(dst, src net.Conn, buf []byte, active *atomic.Int64) error {
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			active.Store(time.Now().UnixNano())
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package wiresocks
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/things-go/go-socks5/bufferpool"
+)
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	qt.Assert(t, err, qt.IsNil)
+	defer ln.Close()
+
+	accepted := make(chan *net.TCPConn, 1)
+	go func() {
+		conn, _ := ln.AcceptTCP()
+		accepted <- conn
+	}()
+	dialed, err := net.DialTCP("tcp", nil, ln.Addr().(*net.TCPAddr))
+	qt.Assert(t, err, qt.IsNil)
+	conn := <-accepted
+	qt.Assert(t, conn, qt.Not(qt.IsNil))
+	t.Cleanup(func() {
+		_ = dialed.Close()
+		_ = conn.Close()
+	})
+	return dialed, conn
+}
+
+// startRelay relays between two loopback connections and returns the far
+// ends, the one of the client and the one of the destination, and a channel
+// closed once the relay returned
+func startRelay(t *testing.T, timeouts Timeouts) (*net.TCPConn, *net.TCPConn, <-chan struct{}) {
+	user, client := tcpPair(t)
+	conn, dest := tcpPair(t)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		relay(slog.Default(), bufferpool.NewPool(32*1024), nil, timeouts, client, conn)
+	}()
+	for _, c := range []net.Conn{user, dest} {
+		_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	}
+	return user, dest, done
+}
+
+func waitRelay(t *testing.T, done <-chan struct{}) {
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay did not end")
+	}
+}
+
+func TestRelayHalfClose(t *testing.T) {
+	tests := []struct {
+		name string
+		// first closes its writing side after sending, second answers once
+		// it saw the end
+		first, second func(user, dest *net.TCPConn) *net.TCPConn
+	}{{
+		name:   "client ends first",
+		first:  func(user, _ *net.TCPConn) *net.TCPConn { return user },
+		second: func(_, dest *net.TCPConn) *net.TCPConn { return dest },
+	}, {
+		name:   "destination ends first",
+		first:  func(_, dest *net.TCPConn) *net.TCPConn { return dest },
+		second: func(user, _ *net.TCPConn) *net.TCPConn { return user },
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user, dest, done := startRelay(t, Timeouts{Idle: time.Minute})
+			first, second := test.first(user, dest), test.second(user, dest)
+
+			_, err := first.Write([]byte("request"))
+			qt.Assert(t, err, qt.IsNil)
+			qt.Assert(t, first.CloseWrite(), qt.IsNil)
+
+			// the end of the first direction arrives as EOF
+			got, err := io.ReadAll(second)
+			qt.Assert(t, err, qt.IsNil)
+			qt.Assert(t, string(got), qt.Equals, "request")
+
+			// while the other direction still flows
+			_, err = second.Write([]byte("response"))
+			qt.Assert(t, err, qt.IsNil)
+			qt.Assert(t, second.CloseWrite(), qt.IsNil)
+			got, err = io.ReadAll(first)
+			qt.Assert(t, err, qt.IsNil)
+			qt.Assert(t, string(got), qt.Equals, "response")
+
+			waitRelay(t, done)
+		})
+	}
+}
+
+func TestRelayReset(t *testing.T) {
+	user, dest, done := startRelay(t, Timeouts{Idle: time.Minute})
+
+	// a destination going away entirely ends the relay for the client too
+	_ = dest.SetLinger(0)
+	_ = dest.Close()
+	waitRelay(t, done)
+	_, err := io.ReadAll(user)
+	qt.Assert(t, err, qt.IsNil)
+}
+
+func TestRelayWithoutHalfClose(t *testing.T) {
+	client, user := net.Pipe()
+	conn, dest := tcpPair(t)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		relay(slog.Default(), bufferpool.NewPool(32*1024), nil, Timeouts{Idle: time.Minute}, client, conn)
+	}()
+	_ = dest.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// a pipe can't be half-closed, the end of the destination closes it
+	qt.Assert(t, dest.CloseWrite(), qt.IsNil)
+	waitRelay(t, done)
+	_, err := user.Write([]byte("late"))
+	qt.Assert(t, err, qt.Not(qt.IsNil))
+}
+
+func TestRelayTimeouts(t *testing.T) {
+	tests := []struct {
+		name     string
+		timeouts Timeouts
+		// chatty keeps data flowing, which only holds off the idle timeout
+		chatty bool
+	}{
+		{name: "idle", timeouts: Timeouts{Idle: 50 * time.Millisecond}},
+		{name: "lifetime", timeouts: Timeouts{Idle: time.Minute, MaxLifetime: 200 * time.Millisecond}, chatty: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user, dest, done := startRelay(t, test.timeouts)
+			if test.chatty {
+				go func() {
+					for {
+						if _, err := user.Write([]byte("ping")); err != nil {
+							return
+						}
+						time.Sleep(10 * time.Millisecond)
+					}
+				}()
+				go func() { _, _ = io.Copy(io.Discard, dest) }()
+			}
+
+			start := time.Now()
+			waitRelay(t, done)
+			limit := test.timeouts.Idle
+			if test.timeouts.MaxLifetime > 0 {
+				limit = test.timeouts.MaxLifetime
+			}
+			qt.Assert(t, time.Since(start) >= limit-10*time.Millisecond, qt.IsTrue)
+		})
+	}
+}
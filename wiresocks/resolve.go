@@ -0,0 +1,135 @@
+package wiresocks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/bepass-org/warp-plus/wireguard/tun/netstack"
+)
+
+// resolvers of a ResolvePolicy
+const (
+	// ResolveLocal looks names up with the resolver of this host and dials
+	// the address through the tunnel
+	ResolveLocal = "local"
+	// ResolveRemote looks names up with the DNS servers of the tunnel
+	ResolveRemote = "remote"
+)
+
+// ResolvePolicy picks where the names of a domain are looked up
+type ResolvePolicy struct {
+	// Match is a domain suffix or "*" for every name
+	Match string
+	// Resolver is ResolveLocal or ResolveRemote
+	Resolver string
+}
+
+func (p ResolvePolicy) String() string {
+	return p.Match + "=" + p.Resolver
+}
+
+// ParseResolvePolicy parses a policy in the form match=resolver, for example
+// "corp.example.com=local" or "*=remote"
+func ParseResolvePolicy(s string) (ResolvePolicy, error) {
+	match, resolver, ok := strings.Cut(s, "=")
+	if !ok || match == "" {
+		return ResolvePolicy{}, fmt.Errorf("invalid resolve policy %q, expected domain=resolver", s)
+	}
+	if _, err := netip.ParseAddr(match); err == nil {
+		return ResolvePolicy{}, fmt.Errorf("resolve policy %q must match a domain", s)
+	}
+	if _, err := netip.ParsePrefix(match); err == nil {
+		return ResolvePolicy{}, fmt.Errorf("resolve policy %q must match a domain", s)
+	}
+
+	switch resolver {
+	case ResolveLocal, ResolveRemote:
+	default:
+		return ResolvePolicy{}, fmt.Errorf("unknown resolver %q", resolver)
+	}
+	return ResolvePolicy{Match: strings.ToLower(strings.TrimPrefix(match, "*.")), Resolver: resolver}, nil
+}
+
+// matches reports whether p covers the name host
+func (p ResolvePolicy) matches(host string) bool {
+	if p.Match == "*" {
+		return true
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	return host == p.Match || strings.HasSuffix(host, "."+p.Match)
+}
+
+// resolvesLocally reports whether the first policy matching host resolves it
+// on this host
+func (vt *VirtualTun) resolvesLocally(host string) bool {
+	if _, err := netip.ParseAddr(host); err == nil {
+		return false
+	}
+	for _, p := range vt.ResolvePolicies {
+		if p.matches(host) {
+			return p.Resolver == ResolveLocal
+		}
+	}
+	return false
+}
+
+// lookupLocal resolves host with the resolver of this host and returns the
+// addresses the tunnel may dial, in the order of its address preference
+func (vt *VirtualTun) lookupLocal(ctx context.Context, host string) ([]netip.Addr, error) {
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+
+	var v4, v6 []netip.Addr
+	for _, addr := range addrs {
+		if addr = addr.Unmap(); addr.Is4() {
+			v4 = append(v4, addr)
+		} else {
+			v6 = append(v6, addr)
+		}
+	}
+	var candidates []netip.Addr
+	switch vt.Tnet.AddressPreference() {
+	case netstack.PreferIPv6:
+		candidates = append(v6, v4...)
+	case netstack.PreferIPv4:
+		candidates = append(v4, v6...)
+	case netstack.IPv4Only:
+		candidates = v4
+	case netstack.IPv6Only:
+		candidates = v6
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no suitable address for %s", host)
+	}
+	vt.Logger.Debug("resolved locally", "host", host, "addresses", candidates)
+	return candidates, nil
+}
+
+// dial connects to address through the tunnel, resolving its host locally
+// when a policy asks for it and racing the connections to its addresses the
+// way the tunnel does for names it resolves itself
+func (vt *VirtualTun) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err == nil && vt.resolvesLocally(host) {
+		portNum, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: fmt.Errorf("invalid port %q", port)}
+		}
+		addrs, err := vt.lookupLocal(ctx, host)
+		if err != nil {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+		}
+		addrPorts := make([]netip.AddrPort, 0, len(addrs))
+		for _, addr := range addrs {
+			addrPorts = append(addrPorts, netip.AddrPortFrom(addr, uint16(portNum)))
+		}
+		return vt.Tnet.DialContextAddrPorts(ctx, network, addrPorts)
+	}
+	return vt.Tnet.DialContext(ctx, network, address)
+}
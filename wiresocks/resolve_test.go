@@ -0,0 +1,85 @@
+package wiresocks
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestParseResolvePolicy(t *testing.T) {
+	tests := []struct {
+		in   string
+		want ResolvePolicy
+		err  string
+	}{
+		{in: "corp.example.com=local", want: ResolvePolicy{Match: "corp.example.com", Resolver: ResolveLocal}},
+		{in: "*.Example.COM=remote", want: ResolvePolicy{Match: "example.com", Resolver: ResolveRemote}},
+		{in: "*=remote", want: ResolvePolicy{Match: "*", Resolver: ResolveRemote}},
+		{in: "*=local", want: ResolvePolicy{Match: "*", Resolver: ResolveLocal}},
+		{in: "example.com", err: `invalid resolve policy "example.com", expected domain=resolver`},
+		{in: "=local", err: `invalid resolve policy "=local", expected domain=resolver`},
+		{in: "192.0.2.1=local", err: `resolve policy "192.0.2.1=local" must match a domain`},
+		{in: "2001:db8::1=local", err: `resolve policy "2001:db8::1=local" must match a domain`},
+		{in: "10.0.0.0/8=local", err: `resolve policy "10.0.0.0/8=local" must match a domain`},
+		{in: "example.com=", err: `unknown resolver ""`},
+		{in: "example.com=system", err: `unknown resolver "system"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			p, err := ParseResolvePolicy(test.in)
+			if test.err != "" {
+				qt.Assert(t, err, qt.ErrorMatches, test.err)
+				return
+			}
+			qt.Assert(t, err, qt.IsNil)
+			qt.Assert(t, p, qt.Equals, test.want)
+
+			// String gives back an equivalent policy
+			again, err := ParseResolvePolicy(p.String())
+			qt.Assert(t, err, qt.IsNil)
+			qt.Assert(t, again, qt.Equals, p)
+		})
+	}
+}
+
+func TestResolvePolicyMatches(t *testing.T) {
+	tests := []struct {
+		policy string
+		host   string
+		want   bool
+	}{
+		{"*=local", "example.com", true},
+		{"example.com=local", "example.com", true},
+		{"example.com=local", "WWW.Example.com.", true},
+		{"example.com=local", "badexample.com", false},
+		{"example.com=local", "example.com.evil", false},
+	}
+
+	for _, test := range tests {
+		p, err := ParseResolvePolicy(test.policy)
+		qt.Assert(t, err, qt.IsNil)
+		qt.Check(t, p.matches(test.host), qt.Equals, test.want, qt.Commentf("%s for %s", test.policy, test.host))
+	}
+}
+
+func TestResolvesLocally(t *testing.T) {
+	vt := &VirtualTun{ResolvePolicies: []ResolvePolicy{
+		{Match: "public.corp.example", Resolver: ResolveRemote},
+		{Match: "corp.example", Resolver: ResolveLocal},
+	}}
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"intranet.corp.example", true},
+		// the first matching policy wins
+		{"www.public.corp.example", false},
+		{"example.com", false},
+		// literal addresses are never looked up
+		{"192.0.2.1", false},
+	}
+	for _, test := range tests {
+		qt.Check(t, vt.resolvesLocally(test.host), qt.Equals, test.want, qt.Commentf("%s", test.host))
+	}
+}
@@ -0,0 +1,45 @@
+package wiresocks
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/shadowsocks"
+)
+
+// StartShadowsocks spawns a Shadowsocks server whose TCP and UDP listeners
+// share bindAddress. Its requests are served like those of the mixed proxy,
+// policies apply while the tunnel is down.
+func (vt *VirtualTun) StartShadowsocks(bindAddress netip.AddrPort, method, password string, policies []DownPolicy) (netip.AddrPort, error) {
+	c, err := shadowsocks.NewCipher(method, password)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	ln, err := net.Listen("tcp", bindAddress.String())
+	if err != nil {
+		return netip.AddrPort{}, err // Return error if binding was unsuccessful
+	}
+	pc, err := net.ListenPacket("udp", ln.Addr().String())
+	if err != nil {
+		_ = ln.Close()
+		return netip.AddrPort{}, err
+	}
+
+	router := vt.newDownRouter(policies, vt.Drainer)
+	server := shadowsocks.NewServer(
+		shadowsocks.WithListener(ln),
+		shadowsocks.WithPacketConn(pc),
+		shadowsocks.WithCipher(c),
+		shadowsocks.WithLogger(vt.Logger),
+		shadowsocks.WithContext(vt.Ctx),
+		shadowsocks.WithConnectHandle(router.handle),
+	)
+	vt.Drainer.addListener(ln)
+	vt.Drainer.addListener(pc)
+	go func() {
+		_ = server.ListenAndServe()
+	}()
+
+	return ln.Addr().(*net.TCPAddr).AddrPort(), nil
+}
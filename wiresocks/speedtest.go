@@ -0,0 +1,302 @@
+package wiresocks
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaults of SpeedTestOptions, served by the Cloudflare speed test
+const (
+	DefaultSpeedTestDownloadURL = "https://speed.cloudflare.com/__down?bytes=25000000"
+	DefaultSpeedTestUploadURL   = "https://speed.cloudflare.com/__up"
+	DefaultSpeedTestLatencyURL  = "https://speed.cloudflare.com/__down?bytes=0"
+
+	defaultSpeedTestStreams  = 4
+	defaultSpeedTestDuration = 10 * time.Second
+	defaultSpeedTestPings    = 10
+	// speedTestUploadSize is the body size of each upload request
+	speedTestUploadSize = 25 << 20
+)
+
+// SpeedTestOptions configures VirtualTun.SpeedTest, zero values fall back to
+// the defaults
+type SpeedTestOptions struct {
+	// DownloadURL is fetched with GET again and again, the bodies are
+	// discarded
+	DownloadURL string
+	// UploadURL receives POST requests with generated bodies, "-" skips the
+	// upload
+	UploadURL string
+	// LatencyURL is requested for the latency samples, it should answer
+	// with a short body
+	LatencyURL string
+	// Streams is the number of parallel connections of each direction
+	Streams int
+	// Duration is how long each direction is measured
+	Duration time.Duration
+	// Pings is the number of latency samples
+	Pings int
+}
+
+func (o SpeedTestOptions) withDefaults() SpeedTestOptions {
+	if o.DownloadURL == "" {
+		o.DownloadURL = DefaultSpeedTestDownloadURL
+	}
+	if o.UploadURL == "" {
+		o.UploadURL = DefaultSpeedTestUploadURL
+	}
+	if o.LatencyURL == "" {
+		o.LatencyURL = DefaultSpeedTestLatencyURL
+	}
+	if o.Streams <= 0 {
+		o.Streams = defaultSpeedTestStreams
+	}
+	if o.Duration <= 0 {
+		o.Duration = defaultSpeedTestDuration
+	}
+	if o.Pings <= 0 {
+		o.Pings = defaultSpeedTestPings
+	}
+	return o
+}
+
+// SpeedTestResult is the outcome of VirtualTun.SpeedTest, throughputs are in
+// bits per second
+type SpeedTestResult struct {
+	Latency       time.Duration `json:"latency_ns"`
+	Jitter        time.Duration `json:"jitter_ns"`
+	Download      float64       `json:"download_bps"`
+	DownloadBytes int64         `json:"download_bytes"`
+	Upload        float64       `json:"upload_bps,omitempty"`
+	UploadBytes   int64         `json:"upload_bytes,omitempty"`
+	Streams       int           `json:"streams"`
+}
+
+func (r *SpeedTestResult) String() string {
+	s := fmt.Sprintf("latency %s, jitter %s, download %s", r.Latency.Round(time.Microsecond), r.Jitter.Round(time.Microsecond), formatBits(r.Download))
+	if r.UploadBytes > 0 {
+		s += ", upload " + formatBits(r.Upload)
+	}
+	return s
+}
+
+// formatBits formats a throughput in bits per second
+func formatBits(bps float64) string {
+	switch {
+	case bps >= 1e9:
+		return fmt.Sprintf("%.2f Gbit/s", bps/1e9)
+	case bps >= 1e6:
+		return fmt.Sprintf("%.2f Mbit/s", bps/1e6)
+	default:
+		return fmt.Sprintf("%.2f kbit/s", bps/1e3)
+	}
+}
+
+// SpeedTest measures the latency, jitter and throughput of the tunnel against
+// HTTP servers. Every stream uses its own connection so the streams are
+// spread like the traffic of several clients.
+func (vt *VirtualTun) SpeedTest(ctx context.Context, opts SpeedTestOptions) (*SpeedTestResult, error) {
+	opts = opts.withDefaults()
+
+	transport := &http.Transport{
+		DialContext:         vt.dial,
+		MaxIdleConnsPerHost: opts.Streams,
+		// HTTP/2 would multiplex the streams on one connection
+		TLSNextProto: map[string]func(string, *tls.Conn) http.RoundTripper{},
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+
+	r := &SpeedTestResult{Streams: opts.Streams}
+	var err error
+	if r.Latency, r.Jitter, err = measureLatency(ctx, client, opts.LatencyURL, opts.Pings); err != nil {
+		return nil, fmt.Errorf("latency: %w", err)
+	}
+	vt.Logger.Debug("measured latency", "latency", r.Latency, "jitter", r.Jitter)
+
+	if r.DownloadBytes, r.Download, err = measureThroughput(ctx, opts, func(ctx context.Context, n *atomic.Int64) error {
+		return download(ctx, client, opts.DownloadURL, n)
+	}); err != nil {
+		return nil, fmt.Errorf("download: %w", err)
+	}
+	vt.Logger.Debug("measured download", "bytes", r.DownloadBytes, "throughput", formatBits(r.Download))
+
+	if opts.UploadURL != "-" {
+		if r.UploadBytes, r.Upload, err = measureThroughput(ctx, opts, func(ctx context.Context, n *atomic.Int64) error {
+			return upload(ctx, client, opts.UploadURL, n)
+		}); err != nil {
+			return nil, fmt.Errorf("upload: %w", err)
+		}
+		vt.Logger.Debug("measured upload", "bytes", r.UploadBytes, "throughput", formatBits(r.Upload))
+	}
+	return r, nil
+}
+
+// measureLatency requests url pings times on one connection and returns the
+// median time to the response headers and the mean difference of consecutive
+// samples. A first request opens the connection and is not counted.
+func measureLatency(ctx context.Context, client *http.Client, url string, pings int) (latency, jitter time.Duration, err error) {
+	get := func() (time.Duration, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return 0, err
+		}
+		start := time.Now()
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		took := time.Since(start)
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode >= http.StatusBadRequest {
+			return 0, fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		return took, nil
+	}
+
+	if _, err := get(); err != nil {
+		return 0, 0, err
+	}
+	samples := make([]time.Duration, pings)
+	for i := range samples {
+		if samples[i], err = get(); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	for i := 1; i < len(samples); i++ {
+		jitter += (samples[i] - samples[i-1]).Abs()
+	}
+	if len(samples) > 1 {
+		jitter /= time.Duration(len(samples) - 1)
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	return samples[len(samples)/2], jitter, nil
+}
+
+// measureThroughput runs transfer on opts.Streams goroutines for
+// opts.Duration and returns the bytes they moved and the rate in bits per
+// second. transfer adds the bytes it moves to n as they go and repeats until
+// its context ends.
+func measureThroughput(ctx context.Context, opts SpeedTestOptions, transfer func(context.Context, *atomic.Int64) error) (int64, float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, opts.Duration)
+	defer cancel()
+
+	var (
+		n        atomic.Int64
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	start := time.Now()
+	for range opts.Streams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				if err := transfer(ctx, &n); err != nil && ctx.Err() == nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	if firstErr != nil {
+		return 0, 0, firstErr
+	}
+	// the test ended because the caller gave up, not because time was up
+	if err := context.Cause(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		return 0, 0, err
+	}
+	bytes := n.Load()
+	if bytes == 0 {
+		return 0, 0, errors.New("no data transferred")
+	}
+	return bytes, float64(bytes*8) / elapsed.Seconds(), nil
+}
+
+// download fetches url once and adds the body bytes read to n
+func download(ctx context.Context, client *http.Client, url string, n *atomic.Int64) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		m, err := resp.Body.Read(buf)
+		n.Add(int64(m))
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// upload posts a generated body to url once and adds the body bytes sent to n
+func upload(ctx context.Context, client *http.Client, url string, n *atomic.Int64) error {
+	body := &countingReader{r: io.LimitReader(zeroReader{}, speedTestUploadSize), n: n}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = speedTestUploadSize
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// zeroReader is an endless source of zero bytes
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// countingReader adds the bytes read from r to n
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	m, err := c.r.Read(p)
+	c.n.Add(int64(m))
+	return m, err
+}
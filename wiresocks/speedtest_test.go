@@ -0,0 +1,86 @@
+package wiresocks
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/bepass-org/warp-plus/wireguard/tun/netstack"
+)
+
+// serveRemote serves handler at remoteAddr:80 behind the test tunnel and
+// returns its base URL
+func serveRemote(t *testing.T, remote *netstack.Net, handler http.Handler) string {
+	ln, err := remote.ListenTCPAddrPort(netip.AddrPortFrom(remoteAddr, 80))
+	qt.Assert(t, err, qt.IsNil)
+	s := httptest.NewUnstartedServer(handler)
+	_ = s.Listener.Close()
+	s.Listener = ln
+	s.Start()
+	t.Cleanup(s.Close)
+	return s.URL
+}
+
+func TestSpeedTest(t *testing.T) {
+	vt, remote := testTunnel(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/down", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(bytes.Repeat([]byte{0}, 1<<20))
+	})
+	mux.HandleFunc("/up", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+	})
+	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {})
+	url := serveRemote(t, remote, mux)
+
+	result, err := vt.SpeedTest(context.Background(), SpeedTestOptions{
+		DownloadURL: url + "/down",
+		UploadURL:   url + "/up",
+		LatencyURL:  url + "/ping",
+		Streams:     2,
+		Duration:    200 * time.Millisecond,
+		Pings:       3,
+	})
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, result.Streams, qt.Equals, 2)
+	qt.Assert(t, result.Latency > 0, qt.IsTrue)
+	qt.Assert(t, result.DownloadBytes > 0, qt.IsTrue)
+	qt.Assert(t, result.Download > 0, qt.IsTrue)
+	qt.Assert(t, result.UploadBytes > 0, qt.IsTrue)
+	qt.Assert(t, result.Upload > 0, qt.IsTrue)
+}
+
+func TestSpeedTestSkipUpload(t *testing.T) {
+	vt, remote := testTunnel(t)
+	url := serveRemote(t, remote, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		qt.Check(t, r.Method, qt.Equals, http.MethodGet)
+		_, _ = w.Write([]byte("data"))
+	}))
+
+	result, err := vt.SpeedTest(context.Background(), SpeedTestOptions{
+		DownloadURL: url,
+		UploadURL:   "-",
+		LatencyURL:  url,
+		Streams:     1,
+		Duration:    100 * time.Millisecond,
+		Pings:       1,
+	})
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, result.DownloadBytes > 0, qt.IsTrue)
+	qt.Assert(t, result.UploadBytes, qt.Equals, int64(0))
+}
+
+func TestSpeedTestError(t *testing.T) {
+	vt, remote := testTunnel(t)
+	url := serveRemote(t, remote, http.NotFoundHandler())
+
+	_, err := vt.SpeedTest(context.Background(), SpeedTestOptions{LatencyURL: url, Pings: 1})
+	qt.Assert(t, err, qt.ErrorMatches, "latency: unexpected status 404 Not Found")
+}
@@ -0,0 +1,125 @@
+package wiresocks
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// DefaultTraceURL answers with the Cloudflare trace of the requesting client
+const DefaultTraceURL = "https://www.cloudflare.com/cdn-cgi/trace"
+
+// ErrWarpOff is returned by VirtualTun.Trace when traffic leaves the tunnel
+// but not through WARP
+var ErrWarpOff = errors.New("traffic does not egress through warp")
+
+// Trace is what the Cloudflare trace endpoint reports about the tunnel
+type Trace struct {
+	// Warp is "on" or "plus" when traffic egresses through WARP
+	Warp string `json:"warp"`
+	// IP is the exit address seen by Cloudflare
+	IP netip.Addr `json:"ip"`
+	// Colo is the Cloudflare data center, Loc the country of the exit
+	Colo string `json:"colo"`
+	Loc  string `json:"loc"`
+}
+
+// Verified reports whether t shows traffic egressing through WARP
+func (t *Trace) Verified() bool {
+	return t.Warp == "on" || t.Warp == "plus"
+}
+
+// ParseTrace reads the key=value lines of a /cdn-cgi/trace response
+func ParseTrace(r io.Reader) (*Trace, error) {
+	t := &Trace{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "warp":
+			t.Warp = value
+		case "ip":
+			ip, err := netip.ParseAddr(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trace ip %q", value)
+			}
+			t.IP = ip
+		case "colo":
+			t.Colo = value
+		case "loc":
+			t.Loc = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if t.Warp == "" || !t.IP.IsValid() {
+		return nil, errors.New("not a cloudflare trace response")
+	}
+	return t, nil
+}
+
+// Trace fetches url, a Cloudflare trace endpoint, through the tunnel. The
+// trace is returned together with ErrWarpOff when it shows that traffic
+// does not egress through WARP.
+func (vt *VirtualTun) Trace(ctx context.Context, url string) (*Trace, error) {
+	if url == "" {
+		url = DefaultTraceURL
+	}
+	client := &http.Client{
+		Transport: &http.Transport{DialContext: vt.dial, DisableKeepAlives: true},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected trace status %s", resp.Status)
+	}
+
+	t, err := ParseTrace(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, err
+	}
+	if !t.Verified() {
+		return t, ErrWarpOff
+	}
+	return t, nil
+}
+
+// SetEndpoint points every peer of the tunnel at endpoint. The keys stay the
+// same, so the sessions continue as soon as the new endpoint answers.
+func (vt *VirtualTun) SetEndpoint(endpoint string) error {
+	state, err := vt.Dev.IpcGet()
+	if err != nil {
+		return err
+	}
+
+	var request strings.Builder
+	scanner := bufio.NewScanner(strings.NewReader(state))
+	for scanner.Scan() {
+		if key, ok := strings.CutPrefix(scanner.Text(), "public_key="); ok {
+			fmt.Fprintf(&request, "public_key=%s\nupdate_only=true\nendpoint=%s\n", key, endpoint)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if request.Len() == 0 {
+		return errors.New("tunnel has no peers")
+	}
+	return vt.Dev.IpcSet(request.String())
+}
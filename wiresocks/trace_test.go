@@ -0,0 +1,102 @@
+package wiresocks
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/netip"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+const testTrace = `fl=123f45
+h=www.cloudflare.com
+ip=2a09:bac1::1
+ts=1718000000.123
+visit_scheme=https
+uag=Go-http-client/1.1
+colo=FRA
+sliver=none
+http=http/1.1
+loc=DE
+tls=TLSv1.3
+sni=plaintext
+warp=on
+gateway=off
+rbi=off
+kex=X25519
+`
+
+func TestParseTrace(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want *Trace
+		err  string
+	}{
+		{
+			name: "warp",
+			in:   testTrace,
+			want: &Trace{Warp: "on", IP: netip.MustParseAddr("2a09:bac1::1"), Colo: "FRA", Loc: "DE"},
+		},
+		{
+			name: "warp plus with crlf",
+			in:   "ip=104.28.0.1\r\nwarp=plus\r\ncolo=AMS\r\nloc=NL\r\n",
+			want: &Trace{Warp: "plus", IP: netip.MustParseAddr("104.28.0.1"), Colo: "AMS", Loc: "NL"},
+		},
+		{
+			name: "without warp",
+			in:   "ip=192.0.2.1\nwarp=off\n",
+			want: &Trace{Warp: "off", IP: netip.MustParseAddr("192.0.2.1")},
+		},
+		{name: "invalid ip", in: "ip=not-an-ip\nwarp=on\n", err: `invalid trace ip "not-an-ip"`},
+		{name: "missing warp", in: "ip=192.0.2.1\n", err: "not a cloudflare trace response"},
+		{name: "missing ip", in: "warp=on\n", err: "not a cloudflare trace response"},
+		{name: "html", in: "<html><body>blocked</body></html>", err: "not a cloudflare trace response"},
+		{name: "empty", in: "", err: "not a cloudflare trace response"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			trace, err := ParseTrace(strings.NewReader(test.in))
+			if test.err != "" {
+				qt.Assert(t, err, qt.ErrorMatches, test.err)
+				return
+			}
+			qt.Assert(t, err, qt.IsNil)
+			qt.Assert(t, *trace, qt.Equals, *test.want)
+		})
+	}
+}
+
+func TestTrace(t *testing.T) {
+	vt, remote := testTunnel(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/on", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, testTrace)
+	})
+	mux.HandleFunc("/off", func(w http.ResponseWriter, r *http.Request) {
+		// the stub reports the address the request came from like
+		// Cloudflare does
+		addr, _ := netip.ParseAddrPort(r.RemoteAddr)
+		_, _ = io.WriteString(w, "ip="+addr.Addr().String()+"\nwarp=off\n")
+	})
+	mux.HandleFunc("/blocked", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "blocked", http.StatusForbidden)
+	})
+	url := serveRemote(t, remote, mux)
+
+	trace, err := vt.Trace(context.Background(), url+"/on")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, trace.Verified(), qt.IsTrue)
+	qt.Assert(t, trace.Colo, qt.Equals, "FRA")
+
+	trace, err = vt.Trace(context.Background(), url+"/off")
+	qt.Assert(t, err, qt.Equals, ErrWarpOff)
+	qt.Assert(t, trace.IP, qt.Equals, tunnelAddr)
+
+	_, err = vt.Trace(context.Background(), url+"/blocked")
+	qt.Assert(t, err, qt.ErrorMatches, "unexpected trace status 403 Forbidden")
+}
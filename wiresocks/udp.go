@@ -0,0 +1,65 @@
+package wiresocks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+)
+
+// udpHandler relays a socks5 UDP association through the tunnel, tracking it
+// with d. Every destination the client sends to shares the same tunnel
+// sockets.
+func (vt *VirtualTun) udpHandler(req *statute.ProxyRequest, client net.PacketConn, d *Drainer) error {
+	vt.Logger.Info("handling udp association", "destination", req.Destination, "source", req.Source, "inbound", req.Protocol)
+	relay := &statute.UDPRelay{
+		Client:       client,
+		ListenPacket: vt.listenPacket,
+		Resolve:      vt.resolve,
+		Logger:       vt.Logger,
+	}
+	return serveUDP(req.Context, relay, d, vt.Timeouts.udp())
+}
+
+// serveUDP runs relay until its association ends, outlives t.MaxLifetime or
+// is cut by d, destinations expire after t.Idle
+func serveUDP(ctx context.Context, relay *statute.UDPRelay, d *Drainer, t Timeouts) error {
+	relay.IdleTimeout = t.Idle
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if t.MaxLifetime > 0 {
+		ctx, cancel = context.WithTimeout(ctx, t.MaxLifetime)
+		defer cancel()
+	}
+	defer d.track(cancel)()
+	return relay.Serve(ctx)
+}
+
+// listenPacket opens a UDP socket on the tunnel address of the given family
+func (vt *VirtualTun) listenPacket(network string) (net.PacketConn, error) {
+	for _, local := range vt.Tnet.InterfaceAddrs() {
+		if local.Is4() == (network == "udp4") {
+			return vt.Tnet.ListenUDPAddrPort(netip.AddrPortFrom(local, 0))
+		}
+	}
+	return nil, fmt.Errorf("no tunnel address for %s", network)
+}
+
+// resolve looks up host with the DNS servers of the tunnel, or on this host
+// when a policy asks for it, and returns the preferred address
+func (vt *VirtualTun) resolve(ctx context.Context, host string) (netip.Addr, error) {
+	if vt.resolvesLocally(host) {
+		addrs, err := vt.lookupLocal(ctx, host)
+		if err != nil {
+			return netip.Addr{}, err
+		}
+		return addrs[0], nil
+	}
+	addrs, err := vt.Tnet.LookupContextHost(ctx, host)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return netip.ParseAddr(addrs[0])
+}
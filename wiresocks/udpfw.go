@@ -2,73 +2,409 @@ package wiresocks
 
 import (
 	"context"
+	"errors"
 	"net"
 	"net/netip"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
 )
 
-func NewVtunUDPForwarder(ctx context.Context, localBind netip.AddrPort, dest string, vtun *VirtualTun, mtu int) (netip.AddrPort, error) {
-	destAddr, err := net.ResolveUDPAddr("udp", dest)
-	if err != nil {
-		return netip.AddrPort{}, err
+const (
+	// maxDatagramSize is large enough for any UDP payload
+	maxDatagramSize = 64 * 1024
+	// udpSessionQueue is how many datagrams of a client may wait while its
+	// session dials the destination or sends, more are dropped
+	udpSessionQueue = 64
+)
+
+// UDPForwarder relays datagrams between local clients and one destination
+// behind the tunnel. Every client source address gets a session with its own
+// tunnel socket, so replies always reach the client that caused them.
+type UDPForwarder struct {
+	vt       *VirtualTun
+	listener *net.UDPConn
+	dest     string
+	bufSize  int
+	idle     time.Duration
+	lifetime time.Duration
+	// drainer tracks the sessions for shutdown, nil skips that
+	drainer *Drainer
+	// draining stops new sessions, the open ones run until they end
+	draining atomic.Bool
+
+	mu       sync.Mutex
+	sessions map[netip.AddrPort]*udpSession
+
+	sessionsTotal atomic.Uint64
+	packetsOut    atomic.Uint64
+	packetsIn     atomic.Uint64
+	bytesOut      atomic.Uint64
+	bytesIn       atomic.Uint64
+	dropped       atomic.Uint64
+}
+
+// UDPForwarderStats are the counters of a UDPForwarder. Out is the direction
+// from the clients to the destination, In the replies.
+type UDPForwarderStats struct {
+	ActiveSessions int
+	TotalSessions  uint64
+	PacketsOut     uint64
+	PacketsIn      uint64
+	BytesOut       uint64
+	BytesIn        uint64
+	Dropped        uint64
+}
+
+type udpSession struct {
+	client  netip.AddrPort
+	started time.Time
+	// pending holds the datagrams of the client until the session sends them
+	pending chan []byte
+	// done is closed with the session
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu sync.Mutex
+	// conn is the tunnel socket, nil until the destination is dialed
+	conn     net.Conn
+	lastSeen time.Time
+}
+
+func (s *udpSession) touch() {
+	s.mu.Lock()
+	s.lastSeen = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *udpSession) idleFor() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Since(s.lastSeen)
+}
+
+// closed reports whether the session was closed
+func (s *udpSession) closed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// setConn stores the tunnel socket of the session, it reports false and
+// leaves conn alone when the session was closed while dialing
+func (s *udpSession) setConn(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed() {
+		return false
 	}
+	s.conn = conn
+	return true
+}
+
+func (s *udpSession) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.conn != nil {
+			_ = s.conn.Close()
+		}
+	})
+}
 
+// NewVtunUDPForwarder forwards the UDP datagrams received on localBind to
+// dest through vtun until ctx is done. Datagrams larger than mtu are
+// truncated. Sessions only expire when idle, the configured lifetime of vtun
+// does not apply to the long lived WireGuard session this usually carries.
+func NewVtunUDPForwarder(ctx context.Context, localBind netip.AddrPort, dest string, vtun *VirtualTun, mtu int) (*UDPForwarder, error) {
 	listener, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(localBind))
 	if err != nil {
-		return netip.AddrPort{}, err
+		return nil, err
 	}
 
-	rconn, err := vtun.Tnet.DialUDP(nil, destAddr)
-	if err != nil {
-		return netip.AddrPort{}, err
+	f := newUDPForwarder(vtun, listener, dest, mtu, Timeouts{Idle: vtun.Timeouts.udp().Idle}, nil)
+	go f.serve(ctx)
+	return f, nil
+}
+
+// newUDPForwarder returns a forwarder whose sessions are tracked with d. An
+// idle timeout of zero or less uses statute.DefaultUDPIdleTimeout.
+func newUDPForwarder(vt *VirtualTun, listener *net.UDPConn, dest string, bufSize int, t Timeouts, d *Drainer) *UDPForwarder {
+	if t.Idle <= 0 {
+		t.Idle = statute.DefaultUDPIdleTimeout
 	}
+	f := &UDPForwarder{
+		vt:       vt,
+		listener: listener,
+		dest:     dest,
+		bufSize:  bufSize,
+		idle:     t.Idle,
+		lifetime: t.MaxLifetime,
+		drainer:  d,
+		sessions: make(map[netip.AddrPort]*udpSession),
+	}
+	// the listener stays open for the replies of the sessions draining
+	d.addListener(closerFunc(func() error {
+		f.draining.Store(true)
+		return nil
+	}))
+	return f
+}
+
+// Dest returns the destination datagrams are forwarded to
+func (f *UDPForwarder) Dest() string {
+	return f.dest
+}
+
+// LocalAddr returns the address clients send to
+func (f *UDPForwarder) LocalAddr() netip.AddrPort {
+	return f.listener.LocalAddr().(*net.UDPAddr).AddrPort()
+}
 
-	var clientAddr *net.UDPAddr
-	var wg sync.WaitGroup
-	wg.Add(2)
+// Stats returns a snapshot of the counters
+func (f *UDPForwarder) Stats() UDPForwarderStats {
+	f.mu.Lock()
+	active := len(f.sessions)
+	f.mu.Unlock()
+
+	return UDPForwarderStats{
+		ActiveSessions: active,
+		TotalSessions:  f.sessionsTotal.Load(),
+		PacketsOut:     f.packetsOut.Load(),
+		PacketsIn:      f.packetsIn.Load(),
+		BytesOut:       f.bytesOut.Load(),
+		BytesIn:        f.bytesIn.Load(),
+		Dropped:        f.dropped.Load(),
+	}
+}
 
+// serve reads client datagrams until ctx is done, closing the listener and
+// every session on return
+func (f *UDPForwarder) serve(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	go func() {
-		buffer := make([]byte, mtu)
-		for {
-			select {
-			case <-ctx.Done():
-				wg.Done()
-				return
-			default:
-				n, cAddr, err := listener.ReadFrom(buffer)
-				if err != nil {
-					continue
-				}
+		<-ctx.Done()
+		// unblocks the read loop
+		_ = f.listener.Close()
+	}()
+	go f.expire(ctx)
+	f.vt.addForwarder(f)
+	defer func() {
+		f.closeSessions()
+		f.vt.removeForwarder(f)
+		stats := f.Stats()
+		f.vt.Logger.Debug("udp forwarder stopped",
+			"local", f.LocalAddr(),
+			"destination", f.dest,
+			"sessions", stats.TotalSessions,
+			"packets_out", stats.PacketsOut,
+			"packets_in", stats.PacketsIn,
+			"bytes_out", stats.BytesOut,
+			"bytes_in", stats.BytesIn,
+			"dropped", stats.Dropped,
+		)
+	}()
 
-				clientAddr = cAddr.(*net.UDPAddr)
+	var readDelay time.Duration
+	buf := make([]byte, f.bufSize)
+	for {
+		n, client, err := f.listener.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 
-				rconn.WriteTo(buffer[:n], destAddr)
+			// back off like after failed accepts so a failing socket does
+			// not spin
+			if readDelay == 0 {
+				readDelay = minAcceptDelay
+			} else {
+				readDelay = min(2*readDelay, maxAcceptDelay)
 			}
-		}
-	}()
-	go func() {
-		buffer := make([]byte, mtu)
-		for {
+			f.vt.Logger.Debug("failed to read forward datagram", "error", err, "retry", readDelay)
 			select {
+			case <-time.After(readDelay):
 			case <-ctx.Done():
-				wg.Done()
 				return
-			default:
-				n, _, err := rconn.ReadFrom(buffer)
-				if err != nil {
-					continue
-				}
-				if clientAddr != nil {
-					listener.WriteTo(buffer[:n], clientAddr)
-				}
 			}
+			continue
 		}
-	}()
+		readDelay = 0
+		client = netip.AddrPortFrom(client.Addr().Unmap(), client.Port())
+
+		session := f.session(ctx, client)
+		if session == nil {
+			f.dropped.Add(1)
+			f.vt.Logger.Debug("dropping forward datagram", "client", client, "destination", f.dest, "error", "shutting down")
+			continue
+		}
+		select {
+		case session.pending <- slices.Clone(buf[:n]):
+		default:
+			f.dropped.Add(1)
+			f.vt.Logger.Debug("dropping forward datagram", "client", client, "destination", f.dest, "error", "session queue is full")
+		}
+	}
+}
+
+// session returns the session of client, starting a new one unless it is
+// already open or the forwarder is draining, then it returns nil. The read
+// loop never waits for a dial, every session dials the destination through
+// the tunnel on its own.
+func (f *UDPForwarder) session(ctx context.Context, client netip.AddrPort) *udpSession {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if session, ok := f.sessions[client]; ok && !session.closed() {
+		session.touch()
+		return session
+	}
+	if f.draining.Load() {
+		return nil
+	}
+
+	now := time.Now()
+	session := &udpSession{
+		client:   client,
+		started:  now,
+		pending:  make(chan []byte, udpSessionQueue),
+		done:     make(chan struct{}),
+		lastSeen: now,
+	}
+	f.sessions[client] = session
+	f.sessionsTotal.Add(1)
+
+	untrack := f.drainer.track(session.close)
 	go func() {
-		wg.Wait()
-		_ = listener.Close()
-		_ = rconn.Close()
+		defer untrack()
+		f.run(ctx, session)
 	}()
+	return session
+}
+
+// run dials the destination of session and sends the queued datagrams of
+// its client until the session is closed
+func (f *UDPForwarder) run(ctx context.Context, session *udpSession) {
+	defer f.remove(session)
+
+	conn, err := f.vt.dial(ctx, "udp", f.dest)
+	if err != nil {
+		f.dropped.Add(uint64(len(session.pending)))
+		f.vt.Logger.Debug("dropping forward datagrams", "client", session.client, "destination", f.dest, "error", err)
+		return
+	}
+	if !session.setConn(conn) {
+		_ = conn.Close()
+		return
+	}
+	go f.readReplies(session, conn)
+
+	for {
+		select {
+		case <-session.done:
+			return
+		case data := <-session.pending:
+			if _, err := conn.Write(data); err != nil {
+				f.dropped.Add(1)
+				f.vt.Logger.Debug("failed to send forward datagram", "destination", f.dest, "error", err)
+				continue
+			}
+			f.packetsOut.Add(1)
+			f.bytesOut.Add(uint64(len(data)))
+		}
+	}
+}
+
+// readReplies delivers the datagrams of the destination read from conn to the
+// client of session until the session is closed
+func (f *UDPForwarder) readReplies(session *udpSession, conn net.Conn) {
+	defer session.close()
+
+	buf := make([]byte, f.bufSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		session.touch()
+		if _, err := f.listener.WriteToUDPAddrPort(buf[:n], session.client); err != nil {
+			f.dropped.Add(1)
+			f.vt.Logger.Debug("failed to deliver forward datagram", "client", session.client, "error", err)
+			continue
+		}
+		f.packetsIn.Add(1)
+		f.bytesIn.Add(uint64(n))
+	}
+}
+
+func (f *UDPForwarder) remove(session *udpSession) {
+	session.close()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.sessions[session.client] == session {
+		delete(f.sessions, session.client)
+	}
+}
+
+// expire closes sessions that have been idle for longer than f.idle or
+// outlived f.lifetime
+func (f *UDPForwarder) expire(ctx context.Context) {
+	interval := f.idle / 2
+	if f.lifetime > 0 {
+		interval = min(interval, f.lifetime/2)
+	}
+	// a ticker needs a positive interval, even for tiny timeouts
+	interval = max(interval, time.Millisecond)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			f.mu.Lock()
+			for _, session := range f.sessions {
+				if session.idleFor() > f.idle || f.lifetime > 0 && time.Since(session.started) > f.lifetime {
+					// run removes the session once it noticed
+					session.close()
+				}
+			}
+			f.mu.Unlock()
+		}
+	}
+}
+
+func (f *UDPForwarder) closeSessions() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, session := range f.sessions {
+		session.close()
+	}
+}
+
+// UDPForwarders returns the UDP forwarders running on the tunnel
+func (vt *VirtualTun) UDPForwarders() []*UDPForwarder {
+	vt.fwMu.Lock()
+	defer vt.fwMu.Unlock()
+	return slices.Clone(vt.forwarders)
+}
+
+func (vt *VirtualTun) addForwarder(f *UDPForwarder) {
+	vt.fwMu.Lock()
+	defer vt.fwMu.Unlock()
+	vt.forwarders = append(vt.forwarders, f)
+}
 
-	return listener.LocalAddr().(*net.UDPAddr).AddrPort(), nil
+func (vt *VirtualTun) removeForwarder(f *UDPForwarder) {
+	vt.fwMu.Lock()
+	defer vt.fwMu.Unlock()
+	vt.forwarders = slices.DeleteFunc(vt.forwarders, func(other *UDPForwarder) bool { return other == f })
 }
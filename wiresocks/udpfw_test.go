@@ -0,0 +1,141 @@
+package wiresocks
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/bepass-org/warp-plus/proxy/pkg/statute"
+)
+
+// startUDPForwarder forwards to a destination behind the test tunnel that
+// answers every datagram with the address it came from. The sessions are
+// tracked with d.
+func startUDPForwarder(t *testing.T, d *Drainer) *UDPForwarder {
+	vt, remote := testTunnel(t)
+
+	dest, err := remote.ListenUDPAddrPort(netip.AddrPortFrom(remoteAddr, 53))
+	qt.Assert(t, err, qt.IsNil)
+	t.Cleanup(func() { _ = dest.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := dest.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = dest.WriteTo([]byte(string(buf[:n])+" from "+addr.String()), addr)
+		}
+	}()
+
+	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	qt.Assert(t, err, qt.IsNil)
+	f := newUDPForwarder(vt, listener, netip.AddrPortFrom(remoteAddr, 53).String(), maxDatagramSize, vt.Timeouts.udp(), d)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go f.serve(ctx)
+	return f
+}
+
+// udpClient returns a client of f
+func udpClient(t *testing.T, f *UDPForwarder) *net.UDPConn {
+	client, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(f.LocalAddr()))
+	qt.Assert(t, err, qt.IsNil)
+	t.Cleanup(func() { _ = client.Close() })
+	return client
+}
+
+// exchange sends msg from client and returns the reply and the source the
+// destination saw
+func exchange(client *net.UDPConn, msg string, timeout time.Duration) (string, string, error) {
+	_ = client.SetDeadline(time.Now().Add(timeout))
+	if _, err := client.Write([]byte(msg)); err != nil {
+		return "", "", err
+	}
+	buf := make([]byte, 1500)
+	n, err := client.Read(buf)
+	if err != nil {
+		return "", "", err
+	}
+	reply, source, _ := strings.Cut(string(buf[:n]), " from ")
+	return reply, source, nil
+}
+
+func TestUDPForwarderSessions(t *testing.T) {
+	f := startUDPForwarder(t, nil)
+
+	// every client gets its own tunnel socket and only its own replies
+	var sources []string
+	for _, name := range []string{"first", "second"} {
+		reply, source, err := exchange(udpClient(t, f), name, 5*time.Second)
+		qt.Assert(t, err, qt.IsNil)
+		qt.Assert(t, reply, qt.Equals, name)
+		sources = append(sources, source)
+	}
+	qt.Assert(t, sources[0], qt.Not(qt.Equals), sources[1])
+
+	stats := f.Stats()
+	qt.Assert(t, stats.ActiveSessions, qt.Equals, 2)
+	qt.Assert(t, stats.TotalSessions, qt.Equals, uint64(2))
+	qt.Assert(t, stats.Dropped, qt.Equals, uint64(0))
+}
+
+func TestUDPForwarderDrain(t *testing.T) {
+	d := NewDrainer()
+	f := startUDPForwarder(t, d)
+	client := udpClient(t, f)
+	_, _, err := exchange(client, "before", 5*time.Second)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, d.Active(), qt.Equals, 1)
+
+	cut := drain(d, 5*time.Second)
+
+	// the open session keeps working, new clients are not served
+	for f.Stats().Dropped == 0 {
+		_, _, err = exchange(udpClient(t, f), "late", 20*time.Millisecond)
+		qt.Assert(t, err, qt.ErrorMatches, ".*i/o timeout")
+	}
+	reply, _, err := exchange(client, "during", 5*time.Second)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, reply, qt.Equals, "during")
+
+	// the drain ends with the session, as when it expires
+	f.closeSessions()
+	qt.Assert(t, <-cut, qt.Equals, 0)
+	qt.Assert(t, f.Stats().TotalSessions, qt.Equals, uint64(1))
+}
+
+func TestUDPForwarderDrainCut(t *testing.T) {
+	d := NewDrainer()
+	f := startUDPForwarder(t, d)
+	_, _, err := exchange(udpClient(t, f), "before", 5*time.Second)
+	qt.Assert(t, err, qt.IsNil)
+
+	qt.Assert(t, <-drain(d, 0), qt.Equals, 1)
+	for f.Stats().ActiveSessions > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	qt.Assert(t, d.Active(), qt.Equals, 0)
+}
+
+func TestUDPForwarderDefaultIdle(t *testing.T) {
+	vt, _ := testTunnel(t)
+	for _, idle := range []time.Duration{0, -time.Second} {
+		listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		qt.Assert(t, err, qt.IsNil)
+		t.Cleanup(func() { _ = listener.Close() })
+
+		f := newUDPForwarder(vt, listener, netip.AddrPortFrom(remoteAddr, 53).String(), maxDatagramSize, Timeouts{Idle: idle}, nil)
+		qt.Assert(t, f.idle, qt.Equals, statute.DefaultUDPIdleTimeout)
+
+		// the expiry ticker is derived from the idle timeout
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		f.expire(ctx)
+	}
+}
@@ -46,11 +46,15 @@ func StartWireguard(ctx context.Context, l *slog.Logger, conf *Configuration) (*
 		return nil, err
 	}
 
-	return &VirtualTun{
+	vt := &VirtualTun{
 		Tnet:   tnet,
 		Logger: l.With("subsystem", "vtun"),
 		Dev:    dev,
 		Ctx:    ctx,
 		pool:   bufferpool.NewPool(256 * 1024),
-	}, nil
+		health: newHealth(),
+	}
+	go vt.monitorHealth()
+
+	return vt, nil
 }
@@ -0,0 +1,60 @@
+package wiresocks
+
+import (
+	"context"
+	"log/slog"
+	"net/netip"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/things-go/go-socks5/bufferpool"
+
+	"github.com/bepass-org/warp-plus/wireguard/tun"
+	"github.com/bepass-org/warp-plus/wireguard/tun/netstack"
+)
+
+var (
+	// tunnelAddr is the address of a test tunnel, remoteAddr the address of
+	// the network on its other end
+	tunnelAddr = netip.MustParseAddr("10.0.0.1")
+	remoteAddr = netip.MustParseAddr("10.0.0.2")
+)
+
+// testTunnel returns a tunnel without WireGuard whose netstack is linked
+// directly to a second one standing in for the internet. The test serves the
+// destinations of the tunnel on the returned remote netstack at remoteAddr.
+func testTunnel(t *testing.T) (*VirtualTun, *netstack.Net) {
+	local, tnet, err := netstack.CreateNetTUN([]netip.Addr{tunnelAddr}, nil, 1420)
+	qt.Assert(t, err, qt.IsNil)
+	remote, rnet, err := netstack.CreateNetTUN([]netip.Addr{remoteAddr}, nil, 1420)
+	qt.Assert(t, err, qt.IsNil)
+	go linkTun(local, remote)
+	go linkTun(remote, local)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	vt := &VirtualTun{
+		Tnet:   tnet,
+		Logger: slog.Default(),
+		Ctx:    ctx,
+		pool:   bufferpool.NewPool(256 * 1024),
+	}
+	return vt, rnet
+}
+
+// linkTun writes every packet leaving src into dst
+func linkTun(src, dst tun.Device) {
+	bufs := [][]byte{make([]byte, 65535)}
+	sizes := make([]int, 1)
+	for {
+		n, err := src.Read(bufs, sizes, 0)
+		if err != nil {
+			return
+		}
+		for i := range n {
+			if _, err := dst.Write([][]byte{bufs[i][:sizes[i]]}, 0); err != nil {
+				return
+			}
+		}
+	}
+}